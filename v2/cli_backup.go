@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// Written last in backup archives, once the checksums of the files before it are known.
+const backupManifestName = "manifest.json"
+
+// backupManifest describes what a backup archive holds, and what it was taken from.
+type backupManifest struct {
+	Config  string    `json:"config"`
+	Created time.Time `json:"created"`
+	// Image the container ran, and its id
+	Image     string         `json:"image"`
+	ImageId   string         `json:"image_id,omitempty"`
+	BuildHash string         `json:"build_hash"`
+	EnvHash   string         `json:"env_hash"`
+	Volumes   []backupVolume `json:"volumes"`
+	// sha256 checksums of archived files, by path in the archive
+	Files map[string]string `json:"files"`
+}
+
+type backupVolume struct {
+	Host  string `json:"host"`
+	Guest string `json:"guest"`
+	// Directory in the archive
+	Path string `json:"path"`
+}
+
+/*
+ * backup
+ * restore
+ */
+type BackupCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Output string `name:"output" short:"o" default:"./backups" help:"Directory to write the archive to." predictor:"dir"`
+	Live   bool   `name:"live" help:"Back up without stopping a running container. Databases in the volumes may not be consistent."`
+}
+
+func (r *BackupCmd) Run(cli *Cli, ctx *context.Context) error {
+	unlock, err := cli.lock(ctx, r.Config, "backup")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+	if err != nil {
+		return configLoadError(err)
+	}
+	manifest := &backupManifest{
+		Config:    r.Config,
+		Created:   time.Now().UTC(),
+		Image:     conf.RunImage(),
+		BuildHash: conf.BuildHash(),
+		EnvHash:   conf.EnvHash(),
+		Files:     map[string]string{},
+	}
+	for i, path := range volumeHostPaths(conf) {
+		guest := ""
+		for _, v := range conf.Volumes {
+			if strings.TrimRight(v.Volume.Host, "/") == path {
+				guest = v.Volume.Guest
+			}
+		}
+		manifest.Volumes = append(manifest.Volumes, backupVolume{Host: path, Guest: guest, Path: "volumes/" + strconv.Itoa(i)})
+	}
+	if len(manifest.Volumes) == 0 {
+		return errors.New(r.Config + " has no host directory volumes to back up")
+	}
+	archive := filepath.Join(r.Output, r.Config+"-"+manifest.Created.Format("20060102-150405")+".tar.gz")
+	if cli.DryRun {
+		utils.LogInfo("Dry run, not writing " + archive + " of:")
+		for _, v := range manifest.Volumes {
+			fmt.Fprintln(utils.Out, v.Host)
+		}
+		return nil
+	}
+
+	if exists, _ := docker.ContainerExists(r.Config); exists {
+		manifest.ImageId, _ = docker.ContainerImageId(r.Config)
+	} else {
+		manifest.ImageId, _ = docker.ImageId(manifest.Image)
+	}
+	running, err := docker.ContainerRunning(r.Config)
+	if err != nil {
+		return err
+	}
+	if running && !r.Live {
+		utils.LogInfo("Stopping " + r.Config + " for a consistent backup, it is started again afterwards")
+		stop := StopCmd{Config: r.Config}
+		if err := stop.Run(cli, ctx); err != nil {
+			return err
+		}
+		defer func() {
+			start := StartCmd{Config: r.Config}
+			if err := start.Run(cli, ctx); err != nil {
+				utils.LogError("Unable to start " + r.Config + " again: " + err.Error())
+			}
+		}()
+	}
+
+	if err := os.MkdirAll(r.Output, 0700); err != nil {
+		return err
+	}
+	if err := writeBackup(archive, manifest); err != nil {
+		os.Remove(archive)
+		return err
+	}
+	checksum, err := utils.FileChecksum(archive)
+	if err != nil {
+		return err
+	}
+	// in the format sha256sum -c reads
+	if err := os.WriteFile(archive+".sha256", []byte(checksum+"  "+filepath.Base(archive)+"\n"), 0600); err != nil {
+		return err
+	}
+	utils.LogInfo("Backed up " + r.Config + " to " + archive)
+	return nil
+}
+
+func writeBackup(archive string, manifest *backupManifest) error {
+	f, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, v := range manifest.Volumes {
+		utils.LogInfo("Archiving " + v.Host)
+		checksums, err := utils.TarDir(tw, v.Host, v.Path)
+		if err != nil {
+			return err
+		}
+		for name, checksum := range checksums {
+			manifest.Files[name] = checksum
+		}
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: backupManifestName, Mode: 0600, Size: int64(len(content)), ModTime: manifest.Created, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type RestoreCmd struct {
+	Config  string `arg:"" name:"config" help:"config" predictor:"config"`
+	Archive string `arg:"" name:"archive" help:"Backup archive to restore." predictor:"file"`
+	Force   bool   `name:"force" help:"Restore a backup of another config, or without a .sha256 checksum file."`
+}
+
+func (r *RestoreCmd) Run(cli *Cli, ctx *context.Context) error {
+	unlock, err := cli.lock(ctx, r.Config, "restore")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+	if err != nil {
+		return configLoadError(err)
+	}
+	if err := r.verifyChecksum(); err != nil {
+		return err
+	}
+	manifest, err := readBackupManifest(r.Archive)
+	if err != nil {
+		return err
+	}
+	if manifest.Config != r.Config && !r.Force {
+		return errors.New(r.Archive + " is a backup of " + manifest.Config + ", not " + r.Config + ". Run with --force to restore it anyway")
+	}
+	if manifest.BuildHash != conf.BuildHash() {
+		utils.LogWarn("The backup was taken from image " + manifest.Image + " built from a different config. Rebuild " + r.Config + " if the restored data needs it")
+	}
+
+	// restore volumes where the config mounts them now, in case host directories moved
+	targets := map[string]string{}
+	for _, v := range manifest.Volumes {
+		targets[v.Path] = v.Host
+		for _, current := range conf.Volumes {
+			if current.Volume.Kind() == config.VolumeBind && current.Volume.Guest == v.Guest && v.Guest != "" {
+				targets[v.Path] = strings.TrimRight(current.Volume.Host, "/")
+			}
+		}
+	}
+	if cli.DryRun {
+		utils.LogInfo("Dry run, not restoring " + r.Archive + " to:")
+		for _, v := range manifest.Volumes {
+			fmt.Fprintln(utils.Out, targets[v.Path])
+		}
+		return nil
+	}
+
+	running, err := docker.ContainerRunning(r.Config)
+	if err != nil {
+		return err
+	}
+	if running {
+		stop := StopCmd{Config: r.Config}
+		if err := stop.Run(cli, ctx); err != nil {
+			return err
+		}
+	}
+
+	// keep the current data until the restore succeeds
+	suffix := ".before-restore-" + time.Now().UTC().Format("20060102-150405")
+	moved := []string{}
+	for _, v := range manifest.Volumes {
+		target := targets[v.Path]
+		if _, err := os.Stat(target); err == nil {
+			// mountpoints are emptied in place, as they can not be renamed
+			if err := utils.MoveDir(target, target+suffix); err != nil {
+				return errors.New("Unable to move " + target + " aside: " + err.Error())
+			}
+			moved = append(moved, target)
+		}
+	}
+	if err := extractBackup(r.Archive, manifest, targets); err != nil {
+		for _, target := range moved {
+			utils.RemoveContents(target)
+			utils.MoveDir(target+suffix, target)
+		}
+		return errors.New("Restore failed, the previous data was put back: " + err.Error())
+	}
+	utils.LogInfo("Restored " + r.Archive)
+	for _, target := range moved {
+		utils.LogInfo("The previous data is in " + target + suffix + ", remove it once the site works")
+	}
+
+	if running {
+		start := StartCmd{Config: r.Config}
+		return start.Run(cli, ctx)
+	}
+	return nil
+}
+
+// verifyChecksum checks the archive against the .sha256 file written along with it.
+func (r *RestoreCmd) verifyChecksum() error {
+	content, err := os.ReadFile(r.Archive + ".sha256")
+	if os.IsNotExist(err) && r.Force {
+		utils.LogWarn("No checksum file " + r.Archive + ".sha256, the archive is not verified")
+		return nil
+	}
+	if err != nil {
+		return errors.New("Unable to read checksum file " + r.Archive + ".sha256, run with --force to restore without it: " + err.Error())
+	}
+	expected, _, _ := strings.Cut(string(content), " ")
+	checksum, err := utils.FileChecksum(r.Archive)
+	if err != nil {
+		return err
+	}
+	if checksum != expected {
+		return errors.New(r.Archive + " does not match its checksum, it may be corrupt or incomplete")
+	}
+	return nil
+}
+
+// readBackupManifest reads an archive's manifest, and checks its files against their checksums.
+func readBackupManifest(archive string) (*backupManifest, error) {
+	var manifest *backupManifest
+	checksums := map[string]string{}
+	err := readBackup(archive, func(header *tar.Header, r io.Reader) error {
+		if header.Name == backupManifestName {
+			manifest = &backupManifest{}
+			return json.NewDecoder(r).Decode(manifest)
+		}
+		if header.Typeflag == tar.TypeReg {
+			checksum, err := utils.Checksum(r)
+			checksums[header.Name] = checksum
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, errors.New(archive + " has no " + backupManifestName + ", it is not a launcher backup or is incomplete")
+	}
+	if len(checksums) != len(manifest.Files) {
+		return nil, errors.New(archive + " has " + strconv.Itoa(len(checksums)) + " files, its manifest lists " + strconv.Itoa(len(manifest.Files)))
+	}
+	for name, checksum := range manifest.Files {
+		if checksums[name] != checksum {
+			return nil, errors.New(name + " in " + archive + " does not match its checksum")
+		}
+	}
+	return manifest, nil
+}
+
+func extractBackup(archive string, manifest *backupManifest, targets map[string]string) error {
+	return readBackup(archive, func(header *tar.Header, r io.Reader) error {
+		for _, v := range manifest.Volumes {
+			rel, ok := strings.CutPrefix(header.Name, v.Path+"/")
+			if !ok && strings.TrimSuffix(header.Name, "/") != v.Path {
+				continue
+			}
+			entry := *header
+			entry.Name = rel
+			return utils.Untar(&entry, r, targets[v.Path])
+		}
+		return nil
+	})
+}
+
+func readBackup(archive string, read func(header *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.New(archive + " is not a gzip archive: " + err.Error())
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("Unable to read " + archive + ": " + err.Error())
+		}
+		if err := read(header, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Backup", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+		os.MkdirAll(testDir+"/shared/postgres_data", 0700)
+		os.WriteFile(testDir+"/shared/postgres_data/PG_VERSION", []byte("15\n"), 0600)
+		os.WriteFile(testDir+"/app.yml", []byte(`base_image: discourse/base
+volumes:
+  - volume:
+      host: `+testDir+`/shared
+      guest: /shared
+  - volume:
+      name: uploads
+      guest: /uploads
+`), 0644)
+
+		cli = &ddocker.Cli{
+			ConfDir:      testDir,
+			TemplatesDir: testDir,
+			BuildDir:     testDir + "/tmp",
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+
+	AfterEach(func() {
+		utils.Rename = os.Rename
+		os.RemoveAll(testDir)
+	})
+
+	backup := func() string {
+		runner := ddocker.BackupCmd{Config: "app", Output: testDir + "/backups"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		archives, _ := filepath.Glob(testDir + "/backups/app-*.tar.gz")
+		Expect(archives).To(HaveLen(1))
+		return archives[0]
+	}
+
+	It("backs up host directories with a checksum file", func() {
+		archive := backup()
+		Expect(archive + ".sha256").To(BeARegularFile())
+		checksum, _ := utils.FileChecksum(archive)
+		content, _ := os.ReadFile(archive + ".sha256")
+		Expect(string(content)).To(Equal(checksum + "  " + filepath.Base(archive) + "\n"))
+	})
+
+	It("restores a backup, keeping the previous data", func() {
+		archive := backup()
+		os.WriteFile(testDir+"/shared/postgres_data/PG_VERSION", []byte("16\n"), 0600)
+
+		runner := ddocker.RestoreCmd{Config: "app", Archive: archive}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		content, _ := os.ReadFile(testDir + "/shared/postgres_data/PG_VERSION")
+		Expect(string(content)).To(Equal("15\n"))
+		previous, _ := filepath.Glob(testDir + "/shared.before-restore-*/postgres_data/PG_VERSION")
+		Expect(previous).To(HaveLen(1))
+	})
+
+	It("restores into a shared directory that is a mountpoint", func() {
+		archive := backup()
+		os.WriteFile(testDir+"/shared/postgres_data/PG_VERSION", []byte("16\n"), 0600)
+		utils.Rename = func(src string, dest string) error {
+			if src == testDir+"/shared" {
+				return &os.LinkError{Op: "rename", Old: src, New: dest, Err: syscall.EBUSY}
+			}
+			return os.Rename(src, dest)
+		}
+
+		runner := ddocker.RestoreCmd{Config: "app", Archive: archive}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		content, _ := os.ReadFile(testDir + "/shared/postgres_data/PG_VERSION")
+		Expect(string(content)).To(Equal("15\n"))
+		previous, _ := filepath.Glob(testDir + "/shared.before-restore-*/postgres_data/PG_VERSION")
+		Expect(previous).To(HaveLen(1))
+		content, _ = os.ReadFile(previous[0])
+		Expect(string(content)).To(Equal("16\n"))
+	})
+
+	It("refuses a corrupt archive", func() {
+		archive := backup()
+		f, _ := os.OpenFile(archive, os.O_WRONLY|os.O_APPEND, 0600)
+		f.Write([]byte("garbage"))
+		f.Close()
+
+		runner := ddocker.RestoreCmd{Config: "app", Archive: archive}
+		err := runner.Run(cli, &ctx)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("does not match its checksum"))
+	})
+
+	It("refuses a backup of another config", func() {
+		archive := backup()
+		os.WriteFile(testDir+"/web.yml", []byte(`base_image: discourse/base`), 0644)
+
+		runner := ddocker.RestoreCmd{Config: "web", Archive: archive}
+		err := runner.Run(cli, &ctx)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is a backup of app, not web"))
+	})
+})
@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/discourse/launcher/v2/config"
 	"github.com/discourse/launcher/v2/docker"
@@ -24,20 +32,30 @@ type DockerBuildCmd struct {
 	Tag     string `default:"latest" help:"Resulting image tag."`
 
 	Config string `arg:"" name:"config" help:"configuration" predictor:"config"`
+
+	RetryFlags `embed:""`
 }
 
 func (r *DockerBuildCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	unlock, err := cli.lock(ctx, r.Config, "build")
 	if err != nil {
-		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+		return err
 	}
+	defer unlock()
 
-	dir := cli.BuildDir + "/" + r.Config
-	if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
-		return err
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+	if err != nil {
+		return configLoadError(err)
 	}
-	if err := config.WriteYamlConfig(dir); err != nil {
-		return err
+
+	dir := cli.BuildDir + "/" + r.Config
+	if !cli.DryRun {
+		if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := config.WriteYamlConfig(dir); err != nil {
+			return err
+		}
 	}
 
 	namespace := cli.Namespace
@@ -45,16 +63,25 @@ func (r *DockerBuildCmd) Run(cli *Cli, ctx *context.Context) error {
 		namespace = utils.DefaultNamespace
 	}
 	pupsArgs := "--skip-tags=precompile,migrate,db"
+	dockerfile := config.Dockerfile(pupsArgs, r.BakeEnv)
 	builder := docker.DockerBuilder{
 		Config:    config,
 		Ctx:       ctx,
-		Stdin:     strings.NewReader(config.Dockerfile(pupsArgs, r.BakeEnv)),
 		Dir:       dir,
 		Namespace: namespace,
 		ImageTag:  r.Tag,
 	}
-	if err := builder.Run(); err != nil {
-		return err
+	build := func() error {
+		// retries need the dockerfile again
+		builder.Stdin = strings.NewReader(dockerfile)
+		return builder.Run()
+	}
+	tag := r.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+	if err := cli.stage("build", namespace+"/"+r.Config+":"+tag, r.retry(ctx, "build", build)); err != nil {
+		return stageError(utils.ErrBuild, "build", err)
 	}
 	cleaner := CleanCmd{Config: r.Config}
 	cleaner.Run(cli)
@@ -66,13 +93,21 @@ type DockerConfigureCmd struct {
 	SourceTag string `help:"Source image tag to build from."`
 	TargetTag string `help:"Target image tag to save as."`
 	Config    string `arg:"" name:"config" help:"config" predictor:"config"`
+
+	RetryFlags `embed:""`
 }
 
 func (r *DockerConfigureCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	unlock, err := cli.lock(ctx, r.Config, "configure")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
 
 	if err != nil {
-		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+		return configLoadError(err)
 	}
 
 	var uuidString string
@@ -107,19 +142,28 @@ func (r *DockerConfigureCmd) Run(cli *Cli, ctx *context.Context) error {
 		ContainerId:    containerId,
 	}
 
-	return pups.Run()
+	err = cli.stage("configure", pups.SavedImageName, r.retry(ctx, "configure", pups.Run))
+	return stageError(utils.ErrPrecompile, "configure", err)
 }
 
 type DockerMigrateCmd struct {
 	Config                       string `arg:"" name:"config" help:"config" predictor:"config"`
 	Tag                          string `default:"latest" help:"Image tag to migrate."`
 	SkipPostDeploymentMigrations bool   `env:"SKIP_POST_DEPLOYMENT_MIGRATIONS" help:"Skip post-deployment migrations. Runs safe migrations only. Defers breaking-change migrations. Make sure you run post-deployment migrations after a full deploy is complete if you use this option."`
+
+	RetryFlags `embed:""`
 }
 
 func (r *DockerMigrateCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	unlock, err := cli.lock(ctx, r.Config, "migrate")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
 	if err != nil {
-		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+		return configLoadError(err)
 	}
 	containerId := "discourse-build-" + uuid.NewString()
 	env := []string{"SKIP_EMBER_CLI_COMPILE=1"}
@@ -143,26 +187,240 @@ func (r *DockerMigrateCmd) Run(cli *Cli, ctx *context.Context) error {
 		Ctx:           ctx,
 		ContainerId:   containerId,
 	}
-	return pups.Run()
+	err = cli.stage("migrate", "", r.retry(ctx, "migrate", pups.Run))
+	return stageError(utils.ErrMigrate, "migrate", err)
+}
+
+// Errors in the output of failed stages that are likely to pass on retry
+var transientErrors = []string{
+	"toomanyrequests",
+	"TLS handshake timeout",
+	"i/o timeout",
+	"connection reset by peer",
+	"net/http: request canceled",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+}
+
+// Flags to retry failed stages, for commands that build images.
+type RetryFlags struct {
+	Retries      int           `name:"retries" default:"0" help:"Retry failed stages up to this many times, when pups requests a retry with exit code 77, or on transient errors."`
+	RetryBackoff time.Duration `name:"retry-backoff" default:"30s" help:"Time to wait before retrying, doubled after each retry."`
+	RetryOn      []string      `name:"retry-on" sep:"none" placeholder:"REGEXP" help:"Retry when the error output of a failed stage matches this regular expression. Replaces the default transient errors, such as registry pull rate limits and network timeouts. Can be repeated."`
+}
+
+// retry wraps a stage to run again when it fails with a retry request from pups, or a transient error.
+func (r RetryFlags) retry(ctx *context.Context, stage string, run func() error) func() error {
+	if r.Retries <= 0 {
+		return run
+	}
+	return func() error {
+		patterns := []*regexp.Regexp{}
+		retryOn := r.RetryOn
+		if len(retryOn) == 0 {
+			for _, e := range transientErrors {
+				retryOn = append(retryOn, regexp.QuoteMeta(e))
+			}
+		}
+		for _, p := range retryOn {
+			pattern, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("invalid --retry-on pattern %s: %w", p, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+
+		backoff := r.RetryBackoff
+		for attempt := 1; ; attempt++ {
+			tail := &utils.TailWriter{Size: 64 * 1024}
+			stderr := utils.Stderr
+			utils.Stderr = io.MultiWriter(stderr, tail)
+			err := run()
+			utils.Stderr = stderr
+
+			if err == nil || attempt > r.Retries || (*ctx).Err() != nil {
+				return err
+			}
+			reason := retryReason(err, tail.String(), patterns)
+			if reason == "" {
+				return err
+			}
+			utils.LogWarn(fmt.Sprintf("%s failed, %s. Retrying in %s (retry %d of %d)", stage, reason, backoff, attempt, r.Retries))
+			utils.Emit(utils.Event{Type: utils.EventStageRetry, Stage: stage, Message: reason, ExitCode: utils.ExitCode(err)})
+			select {
+			case <-time.After(backoff):
+			case <-(*ctx).Done():
+				return err
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// retryReason explains why a failed stage should be retried, or is empty when it should not be.
+func retryReason(err error, output string, patterns []*regexp.Regexp) string {
+	if utils.ExitCode(err) == utils.ExitRetry {
+		return "pups requested a retry"
+	}
+	for _, p := range patterns {
+		if match := p.FindString(output); match != "" {
+			return "transient error: " + match
+		}
+	}
+	return ""
+}
+
+// Wraps the error of a failed stage with its kind.
+func stageError(kind utils.ErrorKind, stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return utils.NewError(kind, fmt.Sprintf("%s failed with exit code %d", stage, exitErr.ExitCode()), err)
+	}
+	return utils.NewError(kind, stage+" failed: "+err.Error(), err)
 }
 
 type DockerBootstrapCmd struct {
-	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Config   string `arg:"" name:"config" help:"config" predictor:"config"`
+	Resume   bool   `xor:"resume" help:"Resume a failed bootstrap, skipping steps that already completed. Starts over from build if the build config changed since, or from migrate if the env changed."`
+	FromStep string `xor:"resume" name:"from-step" placeholder:"STEP" help:"Start from the given step (build, migrate, or configure), skipping earlier steps."`
+
+	RetryFlags     `embed:""`
+	PreflightFlags `embed:""`
 }
 
-func (r *DockerBootstrapCmd) Run(cli *Cli, ctx *context.Context) error {
-	buildStep := DockerBuildCmd{Config: r.Config, BakeEnv: false}
-	migrateStep := DockerMigrateCmd{Config: r.Config}
-	configureStep := DockerConfigureCmd{Config: r.Config}
-	if err := buildStep.Run(cli, ctx); err != nil {
+var bootstrapSteps = []string{"build", "migrate", "configure"}
+
+// Bootstrap steps completed so far, saved as BuildDir/<config>.bootstrap.json
+// so a failed bootstrap can be resumed.
+type bootstrapState struct {
+	Completed []string `json:"completed"`
+	BuildHash string   `json:"build_hash"`
+	EnvHash   string   `json:"env_hash"`
+}
+
+func bootstrapStateFile(cli *Cli, name string) string {
+	return cli.BuildDir + "/" + name + ".bootstrap.json"
+}
+
+func readBootstrapState(file string) *bootstrapState {
+	state := &bootstrapState{}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(content, state); err != nil {
+		return &bootstrapState{}
+	}
+	return state
+}
+
+func (state *bootstrapState) write(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
 		return err
 	}
-	if err := migrateStep.Run(cli, ctx); err != nil {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, content, 0644)
+}
+
+// resumeStep finds the first step to run after the completed steps of a previous bootstrap
+func (state *bootstrapState) resumeStep(conf *config.Config) int {
+	step := 0
+	for step < len(state.Completed) && step < len(bootstrapSteps) && state.Completed[step] == bootstrapSteps[step] {
+		step++
+	}
+	if step > 0 && state.BuildHash != conf.BuildHash() {
+		utils.LogInfo("Build config changed since the last bootstrap, resuming from build")
+		return 0
+	}
+	if step > 1 && state.EnvHash != conf.EnvHash() {
+		utils.LogInfo("Env changed since the last bootstrap, resuming from migrate")
+		return 1
+	}
+	return step
+}
+
+func (r *DockerBootstrapCmd) Run(cli *Cli, ctx *context.Context) error {
+	unlock, err := cli.lock(ctx, r.Config, "bootstrap")
+	if err != nil {
 		return err
 	}
-	if err := configureStep.Run(cli, ctx); err != nil {
+	defer unlock()
+
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+	if err != nil {
+		return configLoadError(err)
+	}
+
+	stateFile := bootstrapStateFile(cli, r.Config)
+	state := readBootstrapState(stateFile)
+
+	start := 0
+	if r.FromStep != "" {
+		start = slices.Index(bootstrapSteps, r.FromStep)
+		if start < 0 {
+			return errors.New("unknown step " + r.FromStep + ", expected one of: " + strings.Join(bootstrapSteps, ", "))
+		}
+	} else if r.Resume {
+		start = state.resumeStep(conf)
+	}
+	if start > 0 {
+		utils.LogInfo("Skipping " + strings.Join(bootstrapSteps[:start], ", ") + ", starting from " + bootstrapSteps[start])
+	}
+
+	if err := r.preflight(cli, conf); err != nil {
 		return err
 	}
+	if start > 0 {
+		// later steps run from the built image
+		if err := r.preflightImage(cli, imageName(cli, r.Config)); err != nil {
+			return err
+		}
+	}
+
+	state = &bootstrapState{
+		Completed: slices.Clone(bootstrapSteps[:start]),
+		BuildHash: conf.BuildHash(),
+		EnvHash:   conf.EnvHash(),
+	}
+	if !cli.DryRun {
+		if err := state.write(stateFile); err != nil {
+			return err
+		}
+	}
+
+	buildStep := DockerBuildCmd{Config: r.Config, BakeEnv: false, RetryFlags: r.RetryFlags}
+	migrateStep := DockerMigrateCmd{Config: r.Config, RetryFlags: r.RetryFlags}
+	configureStep := DockerConfigureCmd{Config: r.Config, RetryFlags: r.RetryFlags}
+	steps := []func() error{
+		func() error { return buildStep.Run(cli, ctx) },
+		func() error { return migrateStep.Run(cli, ctx) },
+		func() error { return configureStep.Run(cli, ctx) },
+	}
+	for i := start; i < len(steps); i++ {
+		if err := steps[i](); err != nil {
+			if !cli.DryRun {
+				utils.LogInfo("Bootstrap failed during " + bootstrapSteps[i] + ". To retry without repeating completed steps, run: ./launcher bootstrap " + r.Config + " --resume")
+			}
+			return err
+		}
+		if cli.DryRun {
+			continue
+		}
+		state.Completed = append(state.Completed, bootstrapSteps[i])
+		if err := state.write(stateFile); err != nil {
+			return err
+		}
+	}
+	if !cli.DryRun {
+		os.Remove(stateFile)
+	}
 	return nil
 }
 
@@ -171,6 +429,9 @@ type CleanCmd struct {
 }
 
 func (r *CleanCmd) Run(cli *Cli) error {
+	if cli.DryRun {
+		return nil
+	}
 	dir := cli.BuildDir + "/" + r.Config
 	os.Remove(dir + "/config.yaml")
 	if err := os.Remove(dir); err != nil {
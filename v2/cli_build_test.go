@@ -6,16 +6,32 @@ import (
 
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	ddocker "github.com/discourse/launcher/v2"
 	. "github.com/discourse/launcher/v2/test_utils"
 	"github.com/discourse/launcher/v2/utils"
 )
 
+type failingCmdRunner struct {
+	utils.ICmdRunner
+	err    error
+	output string
+}
+
+func (r *failingCmdRunner) Run() error {
+	r.ICmdRunner.Run()
+	fmt.Fprintln(utils.Stderr, r.output)
+	return r.err
+}
+
 var _ = Describe("Build", func() {
 	var testDir string
 	var out *bytes.Buffer
@@ -36,7 +52,8 @@ var _ = Describe("Build", func() {
 			BuildDir:     testDir,
 		}
 
-		utils.CmdRunner = CreateNewFakeCmdRunner()
+		utils.CmdRunner = withLinkedData(CreateNewFakeCmdRunner())
+		linkQueries = 0
 	})
 
 	AfterEach(func() {
@@ -100,7 +117,7 @@ var _ = Describe("Build", func() {
 					"--env SKIP_EMBER_CLI_COMPILE=1 " +
 					"--volume /var/discourse/shared/web-only:/shared " +
 					"--volume /var/discourse/shared/web-only/log/var-log:/var/log " +
-					"--link data:data " +
+					"--network discourse " +
 					"--shm-size=512m " +
 					"--restart=no " +
 					"--interactive " +
@@ -147,6 +164,7 @@ var _ = Describe("Build", func() {
 			Expect(cmd.String()).To(MatchRegexp(
 				"docker commit " +
 					`--change LABEL org\.opencontainers\.image\.created="[\d\-T:Z]+" ` +
+					`--change LABEL org\.discourse\.launcher\.env-hash=[0-9a-f]{64} ` +
 					`--change CMD \["/sbin/boot"\] ` +
 					"discourse-build-test local_discourse/test",
 			))
@@ -198,6 +216,7 @@ var _ = Describe("Build", func() {
 				Expect(RanCmds[1].String()).To(MatchRegexp(
 					"docker commit " +
 						`--change LABEL org\.opencontainers\.image\.created="[\d\-T:Z]+" ` +
+						`--change LABEL org\.discourse\.launcher\.env-hash=[0-9a-f]{64} ` +
 						`--change CMD \["/sbin/boot"\] ` +
 						"discourse-build-test testnamespace/test:configure",
 				))
@@ -234,6 +253,8 @@ var _ = Describe("Build", func() {
 			runner := ddocker.DockerConfigureCmd{Config: "test"}
 			runner.Run(cli, &ctx)
 			Expect(len(RanCmds)).To(Equal(3))
+			// links run as aliases on the discourse network, the linked container is checked to be on it
+			Expect(linkQueries).To(Equal(2))
 
 			checkConfigureCmd(RanCmds[0])
 			checkConfigureCommit(RanCmds[1])
@@ -250,5 +271,254 @@ var _ = Describe("Build", func() {
 			checkConfigureCommit(RanCmds[3])
 			checkConfigureClean(RanCmds[4])
 		})
+
+		It("reports failed stages and configs by kind", func() {
+			CmdRunErrors["docker build"] = exec.Command("sh", "-c", "exit 2").Run()
+			runner := ddocker.DockerBootstrapCmd{Config: "test"}
+			err := runner.Run(cli, &ctx)
+			Expect(err.Error()).To(Equal("build failed with exit code 2"))
+			Expect(utils.ExitStatus(err)).To(Equal(utils.ExitBuild))
+
+			CmdRunErrors = map[string]error{"--tags=db,migrate": exec.Command("sh", "-c", "exit 77").Run()}
+			migrate := ddocker.DockerMigrateCmd{Config: "test"}
+			err = migrate.Run(cli, &ctx)
+			kind, _ := utils.ErrorKindOf(err)
+			Expect(kind).To(Equal(utils.ErrMigrate))
+			// pups retry requests are passed through
+			Expect(utils.ExitStatus(err)).To(Equal(utils.ExitRetry))
+
+			missing := ddocker.DockerBuildCmd{Config: "does-not-exist"}
+			err = missing.Run(cli, &ctx)
+			Expect(utils.ExitStatus(err)).To(Equal(utils.ExitConfig))
+		})
+
+		Context("with retries", func() {
+			var failures int
+			var failWith error
+			var failOutput string
+
+			// fails commands matching the migrate step the given number of times, then runs them
+			BeforeEach(func() {
+				failures = 1
+				failWith = exec.Command("sh", "-c", "exit 77").Run()
+				failOutput = ""
+				utils.Stderr = &bytes.Buffer{}
+				fake := utils.CmdRunner
+				utils.CmdRunner = func(cmd *exec.Cmd) utils.ICmdRunner {
+					runner := fake(cmd)
+					if strings.Contains(cmd.String(), "--tags=db,migrate") && failures > 0 {
+						failures--
+						return &failingCmdRunner{ICmdRunner: runner, err: failWith, output: failOutput}
+					}
+					return runner
+				}
+			})
+
+			AfterEach(func() {
+				utils.Stderr = os.Stderr
+			})
+
+			It("retries stages when pups requests a retry", func() {
+				runner := ddocker.DockerBootstrapCmd{Config: "test", RetryFlags: ddocker.RetryFlags{Retries: 2}}
+				err := runner.Run(cli, &ctx)
+				Expect(err).To(BeNil())
+				Expect(out.String()).To(ContainSubstring("migrate failed, pups requested a retry. Retrying in 0s (retry 1 of 2)"))
+				// build, both migrate runs, and configure
+				Expect(len(RanCmds)).To(Equal(6))
+				checkMigrateCmd(RanCmds[1])
+				checkMigrateCmd(RanCmds[2])
+			})
+
+			It("gives up after the given number of retries", func() {
+				failures = 3
+				runner := ddocker.DockerMigrateCmd{Config: "test", RetryFlags: ddocker.RetryFlags{Retries: 2}}
+				err := runner.Run(cli, &ctx)
+				Expect(utils.ExitStatus(err)).To(Equal(utils.ExitRetry))
+				Expect(len(RanCmds)).To(Equal(3))
+			})
+
+			It("does not retry without retries", func() {
+				runner := ddocker.DockerMigrateCmd{Config: "test"}
+				err := runner.Run(cli, &ctx)
+				Expect(err).ToNot(BeNil())
+				Expect(len(RanCmds)).To(Equal(1))
+			})
+
+			It("retries on transient errors in the output", func() {
+				failWith = exec.Command("sh", "-c", "exit 125").Run()
+				failOutput = "docker: Error response from daemon: toomanyrequests: You have reached your pull rate limit."
+				runner := ddocker.DockerMigrateCmd{Config: "test", RetryFlags: ddocker.RetryFlags{Retries: 1}}
+				err := runner.Run(cli, &ctx)
+				Expect(err).To(BeNil())
+				Expect(out.String()).To(ContainSubstring("transient error: toomanyrequests"))
+				Expect(len(RanCmds)).To(Equal(2))
+			})
+
+			It("retries on configured errors only", func() {
+				failWith = exec.Command("sh", "-c", "exit 1").Run()
+				failOutput = "toomanyrequests"
+				runner := ddocker.DockerMigrateCmd{Config: "test", RetryFlags: ddocker.RetryFlags{Retries: 1, RetryOn: []string{"deadlock detected"}}}
+				err := runner.Run(cli, &ctx)
+				Expect(err).ToNot(BeNil())
+				Expect(len(RanCmds)).To(Equal(1))
+
+				failures = 1
+				failOutput = "PG::TRDeadlockDetected: ERROR:  deadlock detected"
+				err = runner.Run(cli, &ctx)
+				Expect(err).To(BeNil())
+				Expect(len(RanCmds)).To(Equal(3))
+			})
+		})
+
+		It("reports timed stages for bootstrap", func() {
+			cli.ReportFile = testDir + "/report.json"
+			started := time.Now()
+			runner := ddocker.DockerBootstrapCmd{Config: "test"}
+			err := runner.Run(cli, &ctx)
+			Expect(cli.FinishReport("bootstrap test", started, err)).To(Succeed())
+
+			Expect(out.String()).To(MatchRegexp(`build\s+\S+\s+ok\s+local_discourse/test:latest`))
+			Expect(out.String()).To(MatchRegexp(`migrate\s+\S+\s+ok`))
+			Expect(out.String()).To(MatchRegexp(`configure\s+\S+\s+ok\s+local_discourse/test`))
+			Expect(out.String()).To(MatchRegexp(`total\s+\S+\s+ok`))
+
+			content, err := os.ReadFile(cli.ReportFile)
+			Expect(err).To(BeNil())
+			report := utils.Report{}
+			Expect(json.Unmarshal(content, &report)).To(Succeed())
+			Expect(report.Command).To(Equal("bootstrap test"))
+			Expect(report.Stages).To(HaveLen(3))
+			Expect(report.Stages[2].Image).To(Equal("local_discourse/test"))
+		})
+
+		It("emits events for bootstrap", func() {
+			events := &bytes.Buffer{}
+			utils.Events = events
+			defer func() { utils.Events = nil }()
+			utils.CmdRunner = utils.WithEvents(utils.CmdRunner)
+
+			runner := ddocker.DockerBootstrapCmd{Config: "test"}
+			err := runner.Run(cli, &ctx)
+			Expect(cli.FinishReport("bootstrap test", time.Now(), err)).To(Succeed())
+
+			types := []string{}
+			for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+				event := utils.Event{}
+				Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+				types = append(types, event.Type)
+				if event.Type == utils.EventContainer {
+					Expect(event.Container).To(HavePrefix("discourse-build-"))
+				}
+			}
+			Expect(types).To(Equal([]string{
+				"stage_started", "docker_command", "stage_finished", "image_produced",
+				"stage_started", "container", "docker_command", "stage_finished",
+				"stage_started", "container", "docker_command", "docker_command", "docker_command", "stage_finished", "image_produced",
+				"command_finished",
+			}))
+		})
+
+		Context("when resuming bootstrap", func() {
+			var failConfigure = func() {
+				CmdRunErrors["--name discourse-build-test"] = errors.New("configure failed")
+			}
+
+			It("records completed steps and resumes from the failed step", func() {
+				failConfigure()
+				runner := ddocker.DockerBootstrapCmd{Config: "test"}
+				err := runner.Run(cli, &ctx)
+				Expect(err).ToNot(BeNil())
+				Expect(out.String()).To(ContainSubstring("./launcher bootstrap test --resume"))
+				// build, migrate, the failed configure run, and removing its container
+				Expect(len(RanCmds)).To(Equal(4))
+				checkConfigureCmd(RanCmds[2])
+
+				state, err := os.ReadFile(testDir + "/test.bootstrap.json")
+				Expect(err).To(BeNil())
+				Expect(string(state)).To(ContainSubstring(`"completed":["build","migrate"]`))
+
+				utils.CmdRunner = withLinkedData(CreateNewFakeCmdRunner())
+				runner = ddocker.DockerBootstrapCmd{Config: "test", Resume: true}
+				err = runner.Run(cli, &ctx)
+				Expect(err).To(BeNil())
+				Expect(out.String()).To(ContainSubstring("Skipping build, migrate, starting from configure"))
+				Expect(len(RanCmds)).To(Equal(3))
+				checkConfigureCmd(RanCmds[0])
+				checkConfigureCommit(RanCmds[1])
+				checkConfigureClean(RanCmds[2])
+
+				_, err = os.Stat(testDir + "/test.bootstrap.json")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+
+			It("runs all steps when resuming without a previous bootstrap", func() {
+				runner := ddocker.DockerBootstrapCmd{Config: "test", Resume: true}
+				err := runner.Run(cli, &ctx)
+				Expect(err).To(BeNil())
+				Expect(len(RanCmds)).To(Equal(5))
+				checkBuildCmd(RanCmds[0])
+			})
+
+			It("starts over when the build config changed since", func() {
+				state := `{"completed":["build","migrate"],"build_hash":"outdated","env_hash":"outdated"}`
+				Expect(os.WriteFile(testDir+"/test.bootstrap.json", []byte(state), 0644)).To(Succeed())
+				runner := ddocker.DockerBootstrapCmd{Config: "test", Resume: true}
+				err := runner.Run(cli, &ctx)
+				Expect(err).To(BeNil())
+				Expect(out.String()).To(ContainSubstring("Build config changed since the last bootstrap"))
+				Expect(len(RanCmds)).To(Equal(5))
+			})
+
+			It("starts from a given step", func() {
+				runner := ddocker.DockerBootstrapCmd{Config: "test", FromStep: "migrate"}
+				err := runner.Run(cli, &ctx)
+				Expect(err).To(BeNil())
+				Expect(len(RanCmds)).To(Equal(4))
+				checkMigrateCmd(RanCmds[0])
+				checkConfigureCmd(RanCmds[1])
+
+				runner = ddocker.DockerBootstrapCmd{Config: "test", FromStep: "deploy"}
+				err = runner.Run(cli, &ctx)
+				Expect(err).ToNot(BeNil())
+				Expect(err.Error()).To(ContainSubstring("unknown step deploy"))
+			})
+		})
+
+		Context("on a dry run", func() {
+			BeforeEach(func() {
+				cli.DryRun = true
+				utils.DryRun = true
+				utils.CmdRunner = withLinkedData(utils.NewDryRunCmdRunner)
+			})
+
+			AfterEach(func() {
+				utils.DryRun = false
+			})
+
+			It("prints all docker commands for full bootstrap without running them", func() {
+				runner := ddocker.DockerBootstrapCmd{Config: "test"}
+				err := runner.Run(cli, &ctx)
+				Expect(err).To(BeNil())
+
+				lines := []string{}
+				for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+					// the test config's links are deprecated
+					if !strings.HasPrefix(line, "WARNING: links are deprecated") {
+						lines = append(lines, line)
+					}
+				}
+				Expect(lines).To(HaveLen(5))
+				Expect(lines[0]).To(HavePrefix("docker build"))
+				Expect(lines[1]).To(HavePrefix("docker run"))
+				Expect(lines[1]).To(ContainSubstring("--rm"))
+				Expect(lines[2]).To(HavePrefix("docker run"))
+				Expect(lines[2]).To(ContainSubstring("--name"))
+				Expect(lines[3]).To(HavePrefix("docker commit"))
+				Expect(lines[4]).To(HavePrefix("docker rm"))
+
+				_, err = os.Stat(testDir + "/test")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
 	})
 })
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * config show
+ * config set
+ * config unset
+ * config add-template
+ * config add-volume
+ * config add-expose
+ * config migrate-links
+ * diff
+ */
+type ConfigCmd struct {
+	Show         ConfigShowCmd         `cmd:"" name:"show" help:"Print the merged config, along with the templates and configs it was merged from."`
+	Set          ConfigSetCmd          `cmd:"" name:"set" help:"Set a value in a config file, such as env.DISCOURSE_HOSTNAME."`
+	Unset        ConfigUnsetCmd        `cmd:"" name:"unset" help:"Remove a value from a config file."`
+	AddTemplate  ConfigAddTemplateCmd  `cmd:"" name:"add-template" help:"Add a template to a config file."`
+	AddVolume    ConfigAddVolumeCmd    `cmd:"" name:"add-volume" help:"Add a volume to a config file."`
+	AddExpose    ConfigAddExposeCmd    `cmd:"" name:"add-expose" help:"Add an exposed port to a config file."`
+	MigrateLinks ConfigMigrateLinksCmd `cmd:"" name:"migrate-links" help:"Replace links with a shared network, where linked containers are reached by their link alias."`
+}
+
+func configFilename(cli *Cli, configName string) string {
+	return strings.TrimRight(cli.ConfDir, "/") + "/" + configName + ".yml"
+}
+
+// Writes an edited config file, once it loads along with its templates.
+// Dry runs print the edited config instead.
+func writeConfig(cli *Cli, editor *config.Editor) error {
+	filename := configFilename(cli, editor.Name)
+	if cli.DryRun {
+		utils.LogInfo("Dry run, not writing " + filename + ":")
+		fmt.Fprint(utils.Out, string(editor.Redacted().Bytes()))
+		return nil
+	}
+	if err := editor.Save(cli.TemplatesDir, cli.Namespace); err != nil {
+		return utils.NewError(utils.ErrConfig, "Config would not load after editing, not writing "+filename+": "+err.Error(), err)
+	}
+	return nil
+}
+
+// Edits a config file in place, keeping its comments and ordering.
+func editConfig(cli *Cli, configName string, edit func(editor *config.Editor) (bool, error)) error {
+	editor, err := config.LoadEditor(cli.ConfDir, configName)
+	if err != nil {
+		return utils.NewError(utils.ErrConfig, "Unable to read config "+configName+": "+err.Error(), err)
+	}
+	changed, err := edit(editor)
+	if err != nil {
+		return utils.NewError(utils.ErrConfig, err.Error(), err)
+	}
+	if !changed {
+		return nil
+	}
+	if err := writeConfig(cli, editor); err != nil || cli.DryRun {
+		return err
+	}
+	utils.LogInfo("Updated " + configFilename(cli, configName) + ". Run ./launcher rebuild " + configName + " to apply it.")
+	return nil
+}
+
+type ConfigShowCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+}
+
+func (r *ConfigShowCmd) Run(cli *Cli, ctx *context.Context) error {
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+	if err != nil {
+		return configLoadError(err)
+	}
+
+	fmt.Fprintln(utils.Out, "# merged from:")
+	for _, file := range config.MergeChain() {
+		fmt.Fprintln(utils.Out, "#   "+file)
+	}
+
+	encoder := yaml.NewEncoder(utils.Out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+type ConfigSetCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Key    string `arg:"" name:"key" help:"Dotted path of the value to set, such as env.DISCOURSE_HOSTNAME."`
+	Value  string `arg:"" name:"value" help:"Value to set."`
+}
+
+func (r *ConfigSetCmd) Run(cli *Cli, ctx *context.Context) error {
+	return editConfig(cli, r.Config, func(editor *config.Editor) (bool, error) {
+		if current, ok := editor.Get(r.Key); ok && current == r.Value {
+			utils.LogInfo(r.Config + " already has " + r.Key + " set to this value")
+			return false, nil
+		}
+		return true, editor.Set(r.Key, r.Value)
+	})
+}
+
+type ConfigUnsetCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Key    string `arg:"" name:"key" help:"Dotted path of the value to remove, such as env.UNICORN_WORKERS."`
+}
+
+func (r *ConfigUnsetCmd) Run(cli *Cli, ctx *context.Context) error {
+	return editConfig(cli, r.Config, func(editor *config.Editor) (bool, error) {
+		return true, editor.Unset(r.Key)
+	})
+}
+
+type ConfigAddTemplateCmd struct {
+	Config   string `arg:"" name:"config" help:"config" predictor:"config"`
+	Template string `arg:"" name:"template" help:"Template to add, such as templates/web.ssl.template.yml." predictor:"file"`
+}
+
+func (r *ConfigAddTemplateCmd) Run(cli *Cli, ctx *context.Context) error {
+	return editConfig(cli, r.Config, func(editor *config.Editor) (bool, error) {
+		added, err := editor.AddToList("templates", r.Template)
+		if err == nil && !added {
+			utils.LogInfo(r.Config + " already has template " + r.Template)
+		}
+		return added, err
+	})
+}
+
+type ConfigAddVolumeCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Host   string `arg:"" name:"host" help:"Host directory." predictor:"dir"`
+	Guest  string `arg:"" name:"guest" help:"Directory in the container."`
+}
+
+func (r *ConfigAddVolumeCmd) Run(cli *Cli, ctx *context.Context) error {
+	return editConfig(cli, r.Config, func(editor *config.Editor) (bool, error) {
+		added, err := editor.AddVolume(r.Host, r.Guest)
+		if err == nil && !added {
+			utils.LogInfo(r.Config + " already has volume " + r.Host + ":" + r.Guest)
+		}
+		return added, err
+	})
+}
+
+type ConfigAddExposeCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Port   string `arg:"" name:"port" help:"Port to expose, as host:container, or a container port."`
+}
+
+func (r *ConfigAddExposeCmd) Run(cli *Cli, ctx *context.Context) error {
+	return editConfig(cli, r.Config, func(editor *config.Editor) (bool, error) {
+		added, err := editor.AddToList("expose", r.Port)
+		if err == nil && !added {
+			utils.LogInfo(r.Config + " already exposes " + r.Port)
+		}
+		return added, err
+	})
+}
+
+type ConfigMigrateLinksCmd struct {
+	Configs []string `arg:"" optional:"" name:"config" help:"configs to migrate. Migrates all configs with links when not set." predictor:"config"`
+	Network string   `name:"network" default:"discourse" help:"Network to attach linking and linked containers to."`
+}
+
+// Replaces a config's links with a network. Each linked config joins the network with the link alias,
+// and becomes a dependency, so it still starts first.
+func (r *ConfigMigrateLinksCmd) Run(cli *Cli, ctx *context.Context) error {
+	names := r.Configs
+	if len(names) == 0 {
+		all, err := allConfigNames(cli)
+		if err != nil {
+			return err
+		}
+		names = all
+	}
+	for _, name := range names {
+		links := []config.LinkEntry{}
+		err := editConfig(cli, name, func(editor *config.Editor) (bool, error) {
+			removed, err := editor.RemoveLinks()
+			if err != nil || len(removed) == 0 {
+				return false, err
+			}
+			links = removed
+			if _, err := editor.AddNetwork(r.Network, ""); err != nil {
+				return false, err
+			}
+			for _, link := range links {
+				if _, err := os.Stat(configFilename(cli, link.Link.Name)); err != nil {
+					continue
+				}
+				if _, err := editor.AddToList("depends_on", link.Link.Name); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			if conf, err := config.LoadConfig(cli.ConfDir, name, true, cli.TemplatesDir, cli.Namespace); err == nil && len(conf.Links) > 0 {
+				utils.LogWarn(name + " has links from a template or extended config, migrate them there")
+			}
+			continue
+		}
+
+		for _, link := range links {
+			target, alias := link.Link.Name, link.Link.Alias
+			if alias == target {
+				// containers are reachable by name on their networks
+				alias = ""
+			}
+			if _, err := os.Stat(configFilename(cli, target)); err != nil {
+				connect := "docker network connect " + r.Network + " " + target
+				if alias != "" {
+					connect = "docker network connect --alias " + alias + " " + r.Network + " " + target
+				}
+				utils.LogWarn(target + " has no config to migrate. Attach it to the network with: " + connect)
+				continue
+			}
+			if err := editConfig(cli, target, func(editor *config.Editor) (bool, error) {
+				return editor.AddNetwork(r.Network, alias)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type DiffCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Other  string `arg:"" optional:"" name:"other" help:"Config to compare against. Compares against the running container when not set." predictor:"config"`
+}
+
+func (r *DiffCmd) Run(cli *Cli, ctx *context.Context) error {
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+	if err != nil {
+		return configLoadError(err)
+	}
+
+	if r.Other == "" {
+		return r.diffRunning(conf)
+	}
+
+	other, err := config.LoadConfig(cli.ConfDir, r.Other, true, cli.TemplatesDir, cli.Namespace)
+	if err != nil {
+		return configLoadError(err)
+	}
+	fmt.Fprintln(utils.Out, "--- "+r.Config)
+	fmt.Fprintln(utils.Out, "+++ "+r.Other)
+	diffs := config.Diff(conf, other)
+
+	for _, d := range diffs {
+		fmt.Fprintln(utils.Out, d.Redacted())
+	}
+
+	if len(diffs) == 0 {
+		fmt.Fprintln(utils.Out, "No differences found.")
+	} else if config.NeedsRebuild(diffs) {
+		fmt.Fprintln(utils.Out, "A rebuild is required to apply these changes: ./launcher rebuild "+r.Config)
+	} else {
+		fmt.Fprintln(utils.Out, "A rebuild is not required. Recreate the container to apply these changes: ./launcher destroy "+r.Config+" && ./launcher start "+r.Config)
+	}
+	return nil
+}
+
+// diffRunning prints what differs between a config and its running container, and what apply would do about it.
+func (r *DiffCmd) diffRunning(conf *config.Config) error {
+	exists, _ := docker.ContainerExists(r.Config)
+	if !exists {
+		return utils.NewError(utils.ErrNotFound, r.Config+" was not found, start it to compare against its config", nil)
+	}
+	action, reasons, err := planApply(r.Config, conf)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(utils.Out, "--- "+r.Config+" (container)")
+	fmt.Fprintln(utils.Out, "+++ "+r.Config+" (config)")
+	for _, reason := range reasons {
+		fmt.Fprintln(utils.Out, reason)
+	}
+
+	if action == applyNothing {
+		fmt.Fprintln(utils.Out, "No differences found.")
+	} else {
+		fmt.Fprintln(utils.Out, "Plan: "+applyActionNames[action]+". Run ./launcher apply "+r.Config+" to apply it.")
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+
+	ddocker "github.com/discourse/launcher/v2"
+	"github.com/discourse/launcher/v2/config"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Config", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+
+		cli = &ddocker.Cli{
+			ConfDir:      "./test/containers",
+			TemplatesDir: "./test",
+			BuildDir:     testDir,
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	Context("When showing configs", func() {
+		It("prints the merge chain and merged config", func() {
+			runner := ddocker.ConfigShowCmd{Config: "web_only_extended"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring(
+				"# merged from:\n" +
+					"#   ./test/templates/web.template.yml\n" +
+					"#   ./test/containers/web_only.yml\n" +
+					"#   ./test/containers/web_only_extended.yml\n",
+			))
+			Expect(out.String()).To(ContainSubstring("extends: web_only\n"))
+			Expect(out.String()).To(ContainSubstring("  DISCOURSE_HOSTNAME: '[REDACTED]'\n"))
+			Expect(out.String()).To(ContainSubstring("  UNICORN_WORKERS: \"8\"\n"))
+			Expect(len(RanCmds)).To(Equal(0))
+		})
+
+		It("prints secrets when asked to", func() {
+			utils.ShowSecrets = true
+			defer func() { utils.ShowSecrets = false }()
+			runner := ddocker.ConfigShowCmd{Config: "web_only_extended"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("  DISCOURSE_HOSTNAME: extended.example.com\n"))
+		})
+
+		It("errors on missing configs", func() {
+			runner := ddocker.ConfigShowCmd{Config: "does-not-exist"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("When diffing configs", func() {
+		It("compares two configs", func() {
+			runner := ddocker.DiffCmd{Config: "web_only", Other: "web_only_extended"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("--- web_only\n+++ web_only_extended\n"))
+			Expect(out.String()).To(ContainSubstring("~ env DISCOURSE_HOSTNAME: [REDACTED] -> [REDACTED]\n"))
+			Expect(out.String()).To(ContainSubstring("~ env UNICORN_WORKERS: 3 -> 8\n"))
+			Expect(out.String()).To(ContainSubstring("A rebuild is required"))
+			Expect(len(RanCmds)).To(Equal(0))
+		})
+
+		It("reports identical configs", func() {
+			runner := ddocker.DiffCmd{Config: "web_only", Other: "web_only"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("No differences found."))
+		})
+
+		It("errors when comparing against a missing container", func() {
+			runner := ddocker.DiffCmd{Config: "web_only"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).ToNot(BeNil())
+			Expect(len(RanCmds)).To(Equal(1))
+		})
+
+		It("compares against the running container", func() {
+			CmdOutputResponse = []byte{123}
+			CmdOutputResponses["docker inspect --type container"] = []byte(`[{
+				"Image": "sha256:old",
+				"Config": {
+					"Image": "local_discourse/web_only",
+					"Env": ["DISCOURSE_HOSTNAME=discourse.example.com"],
+					"ExposedPorts": {"80/tcp": {}, "443/tcp": {}}
+				},
+				"HostConfig": {
+					"Binds": ["/var/discourse/shared/web-only:/shared", "/var/discourse/shared/web-only/log/var-log:/var/log"],
+					"Links": ["/data:/web_only/data"],
+					"PortBindings": {"80/tcp": [{"HostIp": "", "HostPort": "80"}], "443/tcp": [{"HostIp": "", "HostPort": "443"}]}
+				}
+			}]`)
+			CmdOutputResponses["docker image inspect"] = []byte("sha256:old\n")
+			runner := ddocker.DiffCmd{Config: "web_only"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("--- web_only (container)\n+++ web_only (config)\n"))
+			Expect(out.String()).To(ContainSubstring("+ env DISCOURSE_DB_HOST: [REDACTED]\n"))
+			Expect(out.String()).ToNot(ContainSubstring("expose"))
+			Expect(out.String()).ToNot(ContainSubstring("latest"))
+			Expect(out.String()).To(ContainSubstring("running image was not built with a config hash\n"))
+			Expect(out.String()).To(ContainSubstring("Plan: full rebuild. Run ./launcher apply web_only to apply it.\n"))
+		})
+
+		It("plans as apply does", func() {
+			os.WriteFile(testDir+"/app.yml", []byte("base_image: discourse/base\nenv:\n  UNICORN_WORKERS: 3\n"), 0644)
+			cli.ConfDir = testDir
+			conf, _ := config.LoadConfig(testDir, "app", true, cli.TemplatesDir, "")
+			inspect := func(labels map[string]string) {
+				content, _ := json.Marshal([]map[string]any{{
+					"Image":      "sha256:old",
+					"Config":     map[string]any{"Image": "local_discourse/app", "Env": []string{"PATH=/usr/bin", "UNICORN_WORKERS=2"}, "Labels": labels},
+					"HostConfig": map[string]any{},
+				}})
+				CmdOutputResponses["docker inspect --type container"] = content
+			}
+			CmdOutputResponse = []byte{123}
+			CmdOutputResponses["docker image inspect"] = []byte("sha256:new\n")
+
+			// env is passed to new containers, and assets precompiled after a reconfigure
+			inspect(map[string]string{config.BuildHashLabel: conf.BuildHash(), config.EnvHashLabel: "outdated"})
+			runner := ddocker.DiffCmd{Config: "app"}
+			Expect(runner.Run(cli, &ctx)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("configured env changed\ncontainer is not running the latest local_discourse/app image\n"))
+			Expect(out.String()).To(ContainSubstring("Plan: reconfigure (configure, destroy, start). Run ./launcher apply app to apply it.\n"))
+			Expect(out.String()).ToNot(ContainSubstring("UNICORN_WORKERS"))
+
+			out.Reset()
+			inspect(map[string]string{config.BuildHashLabel: conf.BuildHash(), config.EnvHashLabel: conf.EnvHash()})
+			Expect(runner.Run(cli, &ctx)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("~ env UNICORN_WORKERS: 2 -> 3\n"))
+			Expect(out.String()).To(ContainSubstring("Plan: restart with new container settings (destroy, start). Run ./launcher apply app to apply it.\n"))
+
+			// templates and pups config are only compared by the image's build hash
+			out.Reset()
+			inspect(map[string]string{config.BuildHashLabel: "outdated", config.EnvHashLabel: conf.EnvHash()})
+			Expect(runner.Run(cli, &ctx)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("base image, templates, or pups config changed\n"))
+			Expect(out.String()).To(ContainSubstring("Plan: full rebuild. Run ./launcher apply app to apply it.\n"))
+
+			out.Reset()
+			os.WriteFile(testDir+"/app.yml", []byte("base_image: discourse/base\nenv:\n  UNICORN_WORKERS: 2\n"), 0644)
+			conf, _ = config.LoadConfig(testDir, "app", true, cli.TemplatesDir, "")
+			inspect(map[string]string{config.BuildHashLabel: conf.BuildHash(), config.EnvHashLabel: conf.EnvHash()})
+			CmdOutputResponses["docker image inspect"] = []byte("sha256:old\n")
+			Expect(runner.Run(cli, &ctx)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("No differences found."))
+		})
+	})
+
+	Context("When editing configs", func() {
+		const app = `# my forum
+templates:
+  - "templates/web.template.yml"
+
+expose:
+  - "80:80" # http
+
+env:
+  ## the hostname
+  DISCOURSE_HOSTNAME: discourse.example.com
+  UNICORN_WORKERS: 3
+`
+
+		readConfig := func() string {
+			content, err := os.ReadFile(testDir + "/app.yml")
+			Expect(err).To(BeNil())
+			return string(content)
+		}
+
+		BeforeEach(func() {
+			os.WriteFile(testDir+"/app.yml", []byte(app), 0644)
+			cli.ConfDir = testDir
+		})
+
+		It("sets and unsets values, keeping comments", func() {
+			set := ddocker.ConfigSetCmd{Config: "app", Key: "env.DISCOURSE_HOSTNAME", Value: "forum.example.com"}
+			Expect(set.Run(cli, &ctx)).To(Succeed())
+			unset := ddocker.ConfigUnsetCmd{Config: "app", Key: "env.UNICORN_WORKERS"}
+			Expect(unset.Run(cli, &ctx)).To(Succeed())
+			Expect(readConfig()).To(Equal(`# my forum
+templates:
+  - "templates/web.template.yml"
+
+expose:
+  - "80:80" # http
+
+env:
+  ## the hostname
+  DISCOURSE_HOSTNAME: forum.example.com
+`))
+			Expect(out.String()).To(ContainSubstring("Updated " + testDir + "/app.yml. Run ./launcher rebuild app to apply it."))
+		})
+
+		It("adds volumes, ports, and templates once", func() {
+			volume := ddocker.ConfigAddVolumeCmd{Config: "app", Host: "/var/discourse/shared/standalone", Guest: "/shared"}
+			Expect(volume.Run(cli, &ctx)).To(Succeed())
+			Expect(volume.Run(cli, &ctx)).To(Succeed())
+			expose := ddocker.ConfigAddExposeCmd{Config: "app", Port: "443:443"}
+			Expect(expose.Run(cli, &ctx)).To(Succeed())
+			template := ddocker.ConfigAddTemplateCmd{Config: "app", Template: "templates/web.template.yml"}
+			Expect(template.Run(cli, &ctx)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("app already has template templates/web.template.yml"))
+			Expect(out.String()).To(ContainSubstring("app already has volume /var/discourse/shared/standalone:/shared"))
+			Expect(readConfig()).To(ContainSubstring("expose:\n  - \"80:80\" # http\n  - \"443:443\"\n\nenv:\n"))
+			Expect(readConfig()).To(HaveSuffix("  UNICORN_WORKERS: 3\nvolumes:\n  - volume:\n      host: /var/discourse/shared/standalone\n      guest: /shared\n"))
+		})
+
+		It("does not write configs that fail to load", func() {
+			template := ddocker.ConfigAddTemplateCmd{Config: "app", Template: "templates/missing.template.yml"}
+			err := template.Run(cli, &ctx)
+			Expect(err).ToNot(BeNil())
+			Expect(utils.ExitStatus(err)).To(Equal(utils.ExitConfig))
+			Expect(readConfig()).To(Equal(app))
+		})
+
+		It("migrates links to a network", func() {
+			os.WriteFile(testDir+"/data.yml", []byte("templates:\n  - \"templates/web.template.yml\"\n"), 0644)
+			os.WriteFile(testDir+"/app.yml", []byte(app+`
+# links to other containers
+links:
+  - link:
+      name: data
+      alias: db
+  - link:
+      name: mail
+      alias: smtp
+`), 0644)
+			migrate := ddocker.ConfigMigrateLinksCmd{Configs: []string{"app"}, Network: "discourse"}
+			Expect(migrate.Run(cli, &ctx)).To(Succeed())
+			Expect(readConfig()).To(HaveSuffix("  UNICORN_WORKERS: 3\n" +
+				"networks:\n  - network:\n      name: discourse\n" +
+				"depends_on:\n  - data\n"))
+			data, _ := os.ReadFile(testDir + "/data.yml")
+			Expect(string(data)).To(HaveSuffix("networks:\n  - network:\n      name: discourse\n      alias: db\n"))
+			Expect(out.String()).To(ContainSubstring("mail has no config to migrate. Attach it to the network with: docker network connect --alias smtp discourse mail"))
+
+			// nothing left to migrate
+			Expect(migrate.Run(cli, &ctx)).To(Succeed())
+			Expect(readConfig()).To(ContainSubstring("depends_on:\n  - data\n"))
+		})
+
+		It("prints the edited config on dry runs", func() {
+			cli.DryRun = true
+			set := ddocker.ConfigSetCmd{Config: "app", Key: "env.UNICORN_WORKERS", Value: "4"}
+			Expect(set.Run(cli, &ctx)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("  UNICORN_WORKERS: \"4\"\n"))
+			Expect(readConfig()).To(Equal(app))
+		})
+
+		It("masks secrets in the edited config printed on dry runs", func() {
+			cli.DryRun = true
+			set := ddocker.ConfigSetCmd{Config: "app", Key: "env.DISCOURSE_SMTP_PASSWORD", Value: "hunter2"}
+			Expect(set.Run(cli, &ctx)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("  DISCOURSE_SMTP_PASSWORD: '[REDACTED]'\n"))
+			Expect(out.String()).ToNot(ContainSubstring("hunter2"))
+			Expect(readConfig()).To(Equal(app))
+		})
+	})
+})
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+const gigabyte = 1024 * 1024 * 1024
+
+// Docker versions launcher supports, and recommends
+const (
+	minimumDockerVersion     = "17.03.1"
+	recommendedDockerVersion = "17.06.2"
+)
+
+// Free disk space below which checks warn, and fail
+const (
+	recommendedDiskFree = 5 * gigabyte
+	minimumDiskFree     = 1 * gigabyte
+)
+
+// Outcomes of a check
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+type checkResult struct {
+	name    string
+	status  string
+	message string
+}
+
+/*
+ * doctor
+ */
+type DoctorCmd struct {
+	Config string `arg:"" optional:"" name:"config" help:"config. Also checks the config's volumes, ports, and hostname when set." predictor:"config"`
+}
+
+func (r *DoctorCmd) Run(cli *Cli, ctx *context.Context) error {
+	results := []checkResult{}
+	info, err := docker.Info()
+	results = append(results, checkDocker(info, err)...)
+	if info != nil {
+		results = append(results, checkDisk("disk "+info.DockerRootDir, info.DockerRootDir, minimumDiskFree, recommendedDiskFree))
+	}
+	results = append(results, checkMemory())
+
+	if r.Config != "" {
+		conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+		if err != nil {
+			results = append(results, checkResult{"config", checkFail, "config " + r.Config + " did not load: " + err.Error()})
+		} else {
+			results = append(results, checkResult{"config", checkPass, "config " + r.Config + " loads"})
+			for _, path := range volumeHostPaths(conf) {
+				results = append(results, checkVolume(r.Config, path))
+				results = append(results, checkDisk("disk "+path, path, minimumDiskFree, recommendedDiskFree))
+			}
+			running := false
+			if info != nil {
+				running, _ = docker.ContainerRunning(r.Config)
+			}
+			for _, port := range hostPorts(conf) {
+				results = append(results, checkPort(port, running))
+			}
+			results = append(results, checkDNS(conf.Env["DISCOURSE_HOSTNAME"]))
+			if len(conf.Links) > 0 {
+				results = append(results, checkResult{"links", checkWarn, "links are deprecated, and run as aliases on the " + config.LinkNetwork + " network, run ./launcher config migrate-links " + r.Config + " to use the network instead"})
+			}
+		}
+	}
+
+	failed := printChecks(results)
+	if failed > 0 {
+		return utils.NewError(utils.ErrPreflight, strconv.Itoa(failed)+" checks failed", nil)
+	}
+	return nil
+}
+
+// printChecks writes a table of check results, and counts failures.
+func printChecks(results []checkResult) int {
+	table := tabwriter.NewWriter(utils.Out, 0, 0, 2, ' ', 0)
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.status]++
+		fmt.Fprintf(table, "%s\t%s\t%s\n", strings.ToUpper(result.status), result.name, result.message)
+	}
+	table.Flush()
+	fmt.Fprintf(utils.Out, "\n%d passed, %d warnings, %d failed\n", counts[checkPass], counts[checkWarn], counts[checkFail])
+	return counts[checkFail]
+}
+
+func checkDocker(info *docker.DaemonInfo, err error) []checkResult {
+	if err != nil {
+		return []checkResult{{"docker", checkFail, "docker is not available, check docker is installed and the docker daemon is running: " + err.Error()}}
+	}
+	results := []checkResult{}
+	switch {
+	case compareVersions(info.ServerVersion, minimumDockerVersion) < 0:
+		results = append(results, checkResult{"docker", checkFail, "docker " + info.ServerVersion + " is too old, " + minimumDockerVersion + " or newer is required"})
+	case compareVersions(info.ServerVersion, recommendedDockerVersion) < 0:
+		results = append(results, checkResult{"docker", checkWarn, "docker " + info.ServerVersion + " is old, " + recommendedDockerVersion + " or newer is recommended"})
+	default:
+		results = append(results, checkResult{"docker", checkPass, "docker " + info.ServerVersion + " is running"})
+	}
+	switch info.Driver {
+	case "aufs", "devicemapper", "vfs":
+		results = append(results, checkResult{"storage driver", checkWarn, info.Driver + " is deprecated or slow, overlay2 is recommended"})
+	default:
+		results = append(results, checkResult{"storage driver", checkPass, info.Driver})
+	}
+	return results
+}
+
+// checkDisk fails when a path has less free space than the minimum, and warns when it has less than recommended.
+// Missing paths are checked where docker would create them.
+func checkDisk(name string, path string, minimum uint64, recommended uint64) checkResult {
+	missing := ""
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		missing = path + " does not exist, "
+	}
+	free, err := utils.DiskFree(path)
+	switch {
+	case err != nil:
+		return checkResult{name, checkWarn, missing + "unable to check free space: " + err.Error()}
+	case free < minimum:
+		return checkResult{name, checkFail, missing + formatBytes(free) + " free, at least " + formatBytes(minimum) + " is needed"}
+	case free < recommended:
+		return checkResult{name, checkWarn, missing + formatBytes(free) + " free, at least " + formatBytes(recommended) + " is recommended"}
+	}
+	return checkResult{name, checkPass, missing + formatBytes(free) + " free"}
+}
+
+func checkMemory() checkResult {
+	mem, err := utils.MemTotal()
+	if err != nil {
+		return checkResult{"memory", checkWarn, "unable to check memory: " + err.Error()}
+	}
+	swap, _ := utils.SwapTotal()
+	message := formatBytes(mem) + " memory, " + formatBytes(swap) + " swap"
+	switch {
+	case mem < gigabyte:
+		return checkResult{"memory", checkFail, message + ", Discourse needs at least 1GB of memory"}
+	case mem+swap < 2*gigabyte:
+		return checkResult{"memory", checkWarn, message + ", Discourse needs at least 2GB of memory and swap. See https://meta.discourse.org/t/14947 to add swap"}
+	}
+	return checkResult{"memory", checkPass, message}
+}
+
+// checkPort checks a port the container publishes is not used by another process.
+// A running container is expected to use its ports.
+func checkPort(port string, containerRunning bool) checkResult {
+	name := "port " + port
+	if containerRunning {
+		return checkResult{name, checkPass, "published by the running container"}
+	}
+	if utils.PortInUse(port) {
+		return checkResult{name, checkFail, "in use by another process. Stop it, or see https://meta.discourse.org/t/17247 to share the port with another web server"}
+	}
+	return checkResult{name, checkPass, "available"}
+}
+
+func checkDNS(hostname string) checkResult {
+	if hostname == "" {
+		return checkResult{"dns", checkWarn, "DISCOURSE_HOSTNAME is not set"}
+	}
+	addrs, err := utils.LookupHost(hostname)
+	if err != nil || len(addrs) == 0 {
+		return checkResult{"dns", checkFail, hostname + " does not resolve, check its DNS records"}
+	}
+	return checkResult{"dns", checkPass, hostname + " resolves to " + strings.Join(addrs, ", ")}
+}
+
+// volumeHostPaths lists the host directories of a config's volumes, leaving out directories within another volume.
+func volumeHostPaths(conf *config.Config) []string {
+	paths := []string{}
+	for _, v := range conf.Volumes {
+		if v.Volume.Kind() == config.VolumeBind {
+			paths = append(paths, strings.TrimRight(v.Volume.Host, "/"))
+		}
+	}
+	result := []string{}
+	for _, path := range paths {
+		nested := false
+		for _, other := range paths {
+			if other != path && strings.HasPrefix(path, other+"/") {
+				nested = true
+			}
+		}
+		if !nested && !slices.Contains(result, path) {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
+// hostPorts lists the host ports a config publishes, from expose entries such as 80:80 or 127.0.0.1:8080:80.
+func hostPorts(conf *config.Config) []string {
+	ports := []string{}
+	for _, p := range conf.Expose {
+		parts := strings.Split(p, ":")
+		if len(parts) >= 2 {
+			ports = append(ports, parts[len(parts)-2])
+		}
+	}
+	return ports
+}
+
+// compareVersions compares dotted version numbers, ignoring suffixes such as -ce or +dfsg1.
+func compareVersions(a string, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := versionPart(as, i), versionPart(bs, i)
+		if x != y {
+			return x - y
+		}
+	}
+	return 0
+}
+
+func versionPart(parts []string, i int) int {
+	if i >= len(parts) {
+		return 0
+	}
+	part := parts[i]
+	if digits := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' }); digits >= 0 {
+		part = part[:digits]
+	}
+	n, _ := strconv.Atoi(part)
+	return n
+}
+
+func formatBytes(bytes uint64) string {
+	if bytes >= gigabyte {
+		return strconv.FormatFloat(float64(bytes)/gigabyte, 'f', 1, 64) + "GB"
+	}
+	return strconv.FormatUint(bytes/1024/1024, 10) + "MB"
+}
@@ -0,0 +1,126 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Doctor", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+
+		cli = &ddocker.Cli{
+			ConfDir:      testDir,
+			TemplatesDir: "./test",
+			BuildDir:     testDir,
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponses["docker info"] = []byte(`{"ServerVersion": "27.1.1", "Driver": "overlay2", "DockerRootDir": "` + testDir + `"}`)
+		utils.LookupHost = func(host string) ([]string, error) {
+			if host == "forum.example.com" {
+				return []string{"203.0.113.10"}, nil
+			}
+			return nil, errors.New("no such host")
+		}
+	})
+
+	AfterEach(func() {
+		utils.LookupHost = net.LookupHost
+		os.RemoveAll(testDir)
+	})
+
+	It("checks docker and the host", func() {
+		runner := ddocker.DoctorCmd{}
+		runner.Run(cli, &ctx)
+		Expect(out.String()).To(MatchRegexp(`PASS +docker +docker 27.1.1 is running\n`))
+		Expect(out.String()).To(MatchRegexp(`PASS +storage driver +overlay2\n`))
+		Expect(out.String()).To(MatchRegexp(`(PASS|WARN|FAIL) +disk ` + testDir + ` +`))
+		Expect(out.String()).To(MatchRegexp(`(PASS|WARN|FAIL) +memory +`))
+		Expect(out.String()).ToNot(ContainSubstring("dns"))
+	})
+
+	It("fails when docker is not available", func() {
+		CmdOutputError = errors.New("Cannot connect to the Docker daemon")
+		runner := ddocker.DoctorCmd{}
+		err := runner.Run(cli, &ctx)
+		Expect(err).ToNot(BeNil())
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitPreflight))
+		Expect(out.String()).To(MatchRegexp(`FAIL +docker +docker is not available`))
+		Expect(out.String()).ToNot(ContainSubstring("storage driver"))
+	})
+
+	It("warns about old docker versions and deprecated storage drivers", func() {
+		CmdOutputResponses["docker info"] = []byte(`{"ServerVersion": "17.05.0-ce", "Driver": "aufs", "DockerRootDir": "/var/lib/docker"}`)
+		runner := ddocker.DoctorCmd{}
+		runner.Run(cli, &ctx)
+		Expect(out.String()).To(MatchRegexp(`WARN +docker +docker 17.05.0-ce is old, 17.06.2 or newer is recommended`))
+		Expect(out.String()).To(MatchRegexp(`WARN +storage driver +aufs is deprecated`))
+	})
+
+	It("checks a config's volumes, ports, and hostname", func() {
+		listener, err := net.Listen("tcp", ":0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		os.WriteFile(testDir+"/app.yml", []byte(`templates:
+  - templates/web.template.yml
+expose:
+  - "`+port+`:80"
+  - "5432"
+volumes:
+  - volume:
+      host: `+testDir+`/shared
+      guest: /shared
+  - volume:
+      host: `+testDir+`/shared/log
+      guest: /var/log
+env:
+  DISCOURSE_HOSTNAME: forum.example.com
+`), 0644)
+		runner := ddocker.DoctorCmd{Config: "app"}
+		err = runner.Run(cli, &ctx)
+		Expect(err).ToNot(BeNil())
+		Expect(out.String()).To(MatchRegexp(`PASS +config +config app loads`))
+		Expect(out.String()).To(MatchRegexp(`WARN +volume ` + testDir + `/shared +does not exist, docker creates it owned by root`))
+		Expect(out.String()).To(MatchRegexp(`disk ` + testDir + `/shared +` + testDir + `/shared does not exist, [0-9.]+ ?[KMGT]?B free`))
+		Expect(out.String()).ToNot(ContainSubstring("unable to check free space"))
+		Expect(out.String()).ToNot(ContainSubstring("disk " + testDir + "/shared/log"))
+		Expect(out.String()).To(MatchRegexp(`FAIL +port ` + port + ` +in use by another process`))
+		Expect(out.String()).ToNot(ContainSubstring("port 5432"))
+		Expect(out.String()).To(MatchRegexp(`PASS +dns +forum.example.com resolves to 203.0.113.10`))
+		Expect(out.String()).To(MatchRegexp(`\d+ passed, \d+ warnings, [1-9]\d* failed`))
+	})
+
+	It("does not check ports published by the running container", func() {
+		listener, _ := net.Listen("tcp", ":0")
+		defer listener.Close()
+		port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		os.WriteFile(testDir+"/app.yml", []byte("templates:\n  - templates/web.template.yml\nexpose:\n  - \""+port+":80\"\nenv:\n  DISCOURSE_HOSTNAME: missing.example.com\n"), 0644)
+		CmdOutputResponses["docker ps"] = []byte("abc123\n")
+		runner := ddocker.DoctorCmd{Config: "app"}
+		runner.Run(cli, &ctx)
+		Expect(out.String()).To(MatchRegexp(`PASS +port ` + port + ` +published by the running container`))
+		Expect(out.String()).To(MatchRegexp(`FAIL +dns +missing.example.com does not resolve`))
+	})
+})
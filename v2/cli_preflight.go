@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// Flags for checks run before commands that stop or replace a running container.
+type PreflightFlags struct {
+	Preflight   bool `name:"preflight" default:"true" negatable:"" help:"Check free disk space, volume host paths, and that no other launcher operation is in progress before starting, and that the new image exists before stopping the running container."`
+	MinDiskFree int  `name:"min-disk-free" default:"5" placeholder:"GB" help:"Free disk space needed in the docker root directory and volume host paths, in GB. 0 skips the check."`
+}
+
+// preflight checks the host before changing anything, so a rebuild or bootstrap that is bound to fail
+// aborts before the running container is stopped.
+func (p PreflightFlags) preflight(cli *Cli, conf *config.Config) error {
+	if !p.Preflight {
+		return nil
+	}
+	results := []checkResult{}
+	paths := volumeHostPaths(conf)
+	if p.MinDiskFree > 0 {
+		info, err := docker.Info()
+		if err != nil {
+			return err
+		}
+		// --min-disk-free only fails, doctor warns below the recommended free space
+		minimum := uint64(p.MinDiskFree) * gigabyte
+		for _, path := range append([]string{info.DockerRootDir}, paths...) {
+			results = append(results, checkDisk("disk "+path, path, minimum, 0))
+		}
+	}
+	for _, path := range paths {
+		results = append(results, checkVolume(conf.Name, path))
+	}
+	image := imageName(cli, conf.Name)
+	running, err := docker.BuildContainers(image)
+	if err != nil {
+		return err
+	}
+	if len(running) > 0 {
+		results = append(results, checkResult{"in progress", checkFail, "another launcher operation is running from " + image + " in container " + strings.Join(running, ", ")})
+	}
+	return preflightError(results)
+}
+
+// preflightImage checks an image exists before the running container is replaced with it.
+func (p PreflightFlags) preflightImage(cli *Cli, image string) error {
+	if !p.Preflight || cli.DryRun {
+		return nil
+	}
+	id, err := docker.ImageId(image)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return preflightError([]checkResult{{"image", checkFail, image + " was not found"}})
+	}
+	return nil
+}
+
+func preflightError(results []checkResult) error {
+	failed := false
+	for _, result := range results {
+		switch result.status {
+		case checkFail:
+			utils.LogError(result.name + ": " + result.message)
+			failed = true
+		case checkWarn:
+			utils.LogWarn(result.name + ": " + result.message)
+		}
+	}
+	if !failed {
+		return nil
+	}
+	return utils.NewError(utils.ErrPreflight, "Pre-flight checks failed, nothing was changed. Run with --no-preflight to skip them.", nil)
+}
+
+// checkVolume checks a volume's host path can be written to. Docker creates missing paths, owned by root,
+// which is a warning, as the container may expect another owner.
+func checkVolume(configName string, path string) checkResult {
+	name := "volume " + path
+	if err := utils.Writable(path); err != nil {
+		return checkResult{name, checkFail, err.Error()}
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return checkResult{name, checkWarn, "does not exist, docker creates it owned by root when the container starts. Run ./launcher volumes " + configName + " --create to create it now"}
+	}
+	return checkResult{name, checkPass, "writable"}
+}
+
+func imageName(cli *Cli, configName string) string {
+	namespace := cli.Namespace
+	if namespace == "" {
+		namespace = utils.DefaultNamespace
+	}
+	return namespace + "/" + configName
+}
@@ -0,0 +1,153 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"os"
+	"strings"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Preflight", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	ran := func(command string) bool {
+		for _, cmd := range RanCmds {
+			if strings.Contains(cmd.String(), command) {
+				return true
+			}
+		}
+		return false
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		utils.CommitWait = 0
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+		os.WriteFile(testDir+"/app.yml", []byte(`templates:
+  - templates/web.template.yml
+volumes:
+  - volume:
+      host: `+testDir+`/shared
+      guest: /shared
+`), 0644)
+
+		cli = &ddocker.Cli{
+			ConfDir:      testDir,
+			TemplatesDir: "./test",
+			BuildDir:     testDir + "/tmp",
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponses["docker info"] = []byte(`{"ServerVersion": "27.1.1", "Driver": "overlay2", "DockerRootDir": "` + testDir + `"}`)
+		CmdOutputResponses["docker image inspect"] = []byte("sha256:abc\n")
+		// the site is running
+		CmdOutputResponses["--filter name=app"] = []byte("def456\n")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("rebuilds when checks pass", func() {
+		runner := ddocker.RebuildCmd{Config: "app", PreflightFlags: ddocker.PreflightFlags{Preflight: true}}
+		err := runner.Run(cli, &ctx)
+		Expect(err).To(BeNil())
+		Expect(ran("docker ps --quiet --filter name=discourse-build- --filter ancestor=local_discourse/app")).To(BeTrue())
+		Expect(ran("docker build")).To(BeTrue())
+		Expect(ran("docker image inspect --format {{.Id}} local_discourse/app")).To(BeTrue())
+		Expect(ran("docker stop")).To(BeTrue())
+	})
+
+	It("warns about missing volume host paths, and fails on ones it cannot create", func() {
+		runner := ddocker.RebuildCmd{Config: "app", PreflightFlags: ddocker.PreflightFlags{Preflight: true}}
+		err := runner.Run(cli, &ctx)
+		Expect(err).To(BeNil())
+		Expect(out.String()).To(ContainSubstring("WARNING: volume " + testDir + "/shared: does not exist, docker creates it owned by root when the container starts. Run ./launcher volumes app --create to create it now"))
+
+		os.MkdirAll(testDir+"/shared", 0755)
+		out.Reset()
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(out.String()).ToNot(ContainSubstring("volume " + testDir + "/shared"))
+
+		if os.Geteuid() == 0 {
+			Skip("root can write to read-only directories")
+		}
+		os.Remove(testDir + "/shared")
+		os.Chmod(testDir, 0500)
+		defer os.Chmod(testDir, 0700)
+		err = runner.Run(cli, &ctx)
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitPreflight))
+		Expect(out.String()).To(ContainSubstring("ERROR: volume " + testDir + "/shared: " + testDir + " is not writable"))
+	})
+
+	It("aborts before building without enough free disk space", func() {
+		runner := ddocker.RebuildCmd{Config: "app", PreflightFlags: ddocker.PreflightFlags{Preflight: true, MinDiskFree: 1000000}}
+		err := runner.Run(cli, &ctx)
+		Expect(err).ToNot(BeNil())
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitPreflight))
+		Expect(out.String()).To(ContainSubstring("ERROR: disk " + testDir + ": "))
+		Expect(out.String()).To(ContainSubstring("ERROR: disk " + testDir + "/shared: "))
+		Expect(ran("docker build")).To(BeFalse())
+		Expect(ran("docker stop")).To(BeFalse())
+	})
+
+	It("passes with enough free disk space, without warning", func() {
+		if free, _ := utils.DiskFree(testDir); free < 1024*1024*1024 {
+			Skip("less than 1GB free in " + testDir)
+		}
+		os.MkdirAll(testDir+"/shared", 0755)
+		runner := ddocker.RebuildCmd{Config: "app", PreflightFlags: ddocker.PreflightFlags{Preflight: true, MinDiskFree: 1}}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(out.String()).ToNot(ContainSubstring("disk " + testDir))
+	})
+
+	It("aborts while another launcher operation is running", func() {
+		CmdOutputResponses["name=discourse-build-"] = []byte("abc123\n")
+		runner := ddocker.RebuildCmd{Config: "app", PreflightFlags: ddocker.PreflightFlags{Preflight: true}}
+		err := runner.Run(cli, &ctx)
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitPreflight))
+		Expect(out.String()).To(ContainSubstring("another launcher operation is running from local_discourse/app in container abc123"))
+		Expect(ran("docker build")).To(BeFalse())
+	})
+
+	It("does not stop the running container when the new image is missing", func() {
+		CmdOutputResponses["docker image inspect"] = []byte("")
+		runner := ddocker.RebuildCmd{Config: "app", PreflightFlags: ddocker.PreflightFlags{Preflight: true}}
+		err := runner.Run(cli, &ctx)
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitPreflight))
+		Expect(out.String()).To(ContainSubstring("ERROR: image: local_discourse/app was not found"))
+		Expect(ran("docker build")).To(BeTrue())
+		Expect(ran("docker stop")).To(BeFalse())
+	})
+
+	It("checks the built image exists when bootstrap skips the build", func() {
+		CmdOutputResponses["docker image inspect"] = []byte("")
+		runner := ddocker.DockerBootstrapCmd{Config: "app", FromStep: "migrate", PreflightFlags: ddocker.PreflightFlags{Preflight: true}}
+		err := runner.Run(cli, &ctx)
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitPreflight))
+		Expect(ran("docker run")).To(BeFalse())
+	})
+
+	It("skips checks with --no-preflight", func() {
+		CmdOutputResponses["name=discourse-build-"] = []byte("abc123\n")
+		runner := ddocker.RebuildCmd{Config: "app", PreflightFlags: ddocker.PreflightFlags{Preflight: false, MinDiskFree: 1000000}}
+		err := runner.Run(cli, &ctx)
+		Expect(err).To(BeNil())
+		Expect(ran("docker info")).To(BeFalse())
+		Expect(ran("name=discourse-build-")).To(BeFalse())
+		Expect(ran("docker stop")).To(BeTrue())
+	})
+})
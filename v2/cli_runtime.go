@@ -8,7 +8,6 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
-	"strings"
 	"syscall"
 	"time"
 
@@ -29,11 +28,11 @@ import (
  * enter
  * rebuild
  * restart
+ * apply
  */
 
 type StartCmd struct {
 	Config     string `arg:"" name:"config" help:"config" predictor:"config"`
-	DryRun     bool   `name:"dry-run" short:"n" help:"Do not start, print docker start command and exit."`
 	DockerArgs string `name:"docker-args" help:"Extra arguments to pass when running docker."`
 	RunImage   string `name:"run-image" help:"Start with a custom image."`
 	Supervised bool   `name:"supervised" env:"SUPERVISED" help:"Attach the running container on start."`
@@ -42,18 +41,32 @@ type StartCmd struct {
 }
 
 func (r *StartCmd) Run(cli *Cli, ctx *context.Context) error {
+	extraFlags, err := config.ParseDockerArgs(r.DockerArgs)
+	if err != nil {
+		return utils.NewError(utils.ErrConfig, "--docker-args: "+err.Error(), err)
+	}
+
+	// a supervised container stays attached until it stops, too long to hold the lock
+	if !r.Supervised {
+		unlock, err := cli.lock(ctx, r.Config, "start")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
 	//start stopped container first if exists
 	running, _ := docker.ContainerRunning(r.Config)
 
-	if running && !r.DryRun {
-		fmt.Fprintln(utils.Out, "Nothing to do, your container has already started!")
+	if running && !cli.DryRun {
+		utils.LogInfo("Nothing to do, your container has already started!")
 		return nil
 	}
 
 	exists, _ := docker.ContainerExists(r.Config)
 
-	if exists && !r.DryRun {
-		fmt.Fprintln(utils.Out, "starting up existing container")
+	if exists && !cli.DryRun {
+		utils.LogInfo("starting up existing container")
 		cmd := exec.CommandContext(*ctx, utils.DockerPath, "start", r.Config)
 
 		if r.Supervised {
@@ -75,7 +88,7 @@ func (r *StartCmd) Run(cli *Cli, ctx *context.Context) error {
 			cmd.Stderr = os.Stderr
 		}
 
-		fmt.Fprintln(utils.Out, cmd)
+		utils.EchoCmd(cmd)
 
 		if err := utils.CmdRunner(cmd).Run(); err != nil {
 			return err
@@ -84,10 +97,10 @@ func (r *StartCmd) Run(cli *Cli, ctx *context.Context) error {
 		return nil
 	}
 
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
 
 	if err != nil {
-		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+		return configLoadError(err)
 	}
 
 	defaultHostname, _ := os.Hostname()
@@ -102,14 +115,13 @@ func (r *StartCmd) Run(cli *Cli, ctx *context.Context) error {
 		detatch = false
 	}
 
-	extraFlags := strings.Fields(r.DockerArgs)
 	bootCmd := config.BootCommand()
 
 	runner := docker.DockerRunner{
 		Config:      config,
 		Ctx:         ctx,
 		ContainerId: r.Config,
-		DryRun:      r.DryRun,
+		DryRun:      cli.DryRun,
 		CustomImage: r.RunImage,
 		Restart:     restart,
 		Detatch:     detatch,
@@ -119,7 +131,7 @@ func (r *StartCmd) Run(cli *Cli, ctx *context.Context) error {
 		Cmd:         []string{bootCmd},
 	}
 
-	fmt.Fprintln(utils.Out, "starting new container...")
+	utils.LogInfo("starting new container...")
 	return runner.Run()
 }
 
@@ -131,11 +143,14 @@ type RunCmd struct {
 }
 
 func (r *RunCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	extraFlags, err := config.ParseDockerArgs(r.DockerArgs)
 	if err != nil {
-		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+		return utils.NewError(utils.ErrConfig, "--docker-args: "+err.Error(), err)
+	}
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+	if err != nil {
+		return configLoadError(err)
 	}
-	extraFlags := strings.Fields(r.DockerArgs)
 	runner := docker.DockerRunner{
 		Config:      config,
 		Ctx:         ctx,
@@ -146,7 +161,6 @@ func (r *RunCmd) Run(cli *Cli, ctx *context.Context) error {
 		ExtraFlags:  extraFlags,
 	}
 	return runner.Run()
-	return nil
 }
 
 type StopCmd struct {
@@ -154,14 +168,20 @@ type StopCmd struct {
 }
 
 func (r *StopCmd) Run(cli *Cli, ctx *context.Context) error {
+	unlock, err := cli.lock(ctx, r.Config, "stop")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	exists, _ := docker.ContainerExists(r.Config)
 	if !exists {
-		fmt.Fprintln(utils.Out, r.Config+" was not found")
+		utils.LogWarn(r.Config + " was not found")
 		return nil
 	}
 	cmd := exec.CommandContext(*ctx, utils.DockerPath, "stop", "--time", "600", r.Config)
 
-	fmt.Fprintln(utils.Out, cmd)
+	utils.EchoCmd(cmd)
 	if err := utils.CmdRunner(cmd).Run(); err != nil {
 		return err
 	}
@@ -175,6 +195,12 @@ type RestartCmd struct {
 }
 
 func (r *RestartCmd) Run(cli *Cli, ctx *context.Context) error {
+	unlock, err := cli.lock(ctx, r.Config, "restart")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	start := StartCmd{Config: r.Config, DockerArgs: r.DockerArgs, RunImage: r.RunImage}
 	stop := StopCmd{Config: r.Config}
 
@@ -194,22 +220,28 @@ type DestroyCmd struct {
 }
 
 func (r *DestroyCmd) Run(cli *Cli, ctx *context.Context) error {
+	unlock, err := cli.lock(ctx, r.Config, "destroy")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	exists, _ := docker.ContainerExists(r.Config)
 
 	if !exists {
-		fmt.Fprintln(utils.Out, r.Config+" was not found")
+		utils.LogWarn(r.Config + " was not found")
 		return nil
 	}
 
 	cmd := exec.CommandContext(*ctx, utils.DockerPath, "stop", "--time", "600", r.Config)
-	fmt.Fprintln(utils.Out, cmd)
+	utils.EchoCmd(cmd)
 
 	if err := utils.CmdRunner(cmd).Run(); err != nil {
 		return err
 	}
 
 	cmd = exec.CommandContext(*ctx, utils.DockerPath, "rm", r.Config)
-	fmt.Fprintln(utils.Out, cmd)
+	utils.EchoCmd(cmd)
 
 	if err := utils.CmdRunner(cmd).Run(); err != nil {
 		return err
@@ -223,6 +255,13 @@ type EnterCmd struct {
 }
 
 func (r *EnterCmd) Run(cli *Cli, ctx *context.Context) error {
+	running, err := docker.ContainerRunning(r.Config)
+	if err != nil {
+		return err
+	}
+	if !running {
+		return utils.NewError(utils.ErrNotFound, r.Config+" is not running", nil)
+	}
 	cmd := exec.CommandContext(*ctx, utils.DockerPath, "exec", "-it", r.Config, "/bin/bash", "--login")
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -240,6 +279,13 @@ type LogsCmd struct {
 }
 
 func (r *LogsCmd) Run(cli *Cli, ctx *context.Context) error {
+	exists, err := docker.ContainerExists(r.Config)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return utils.NewError(utils.ErrNotFound, r.Config+" was not found", nil)
+	}
 	cmd := exec.CommandContext(*ctx, utils.DockerPath, "logs", r.Config)
 	output, err := utils.CmdRunner(cmd).Output()
 
@@ -252,34 +298,63 @@ func (r *LogsCmd) Run(cli *Cli, ctx *context.Context) error {
 }
 
 type RebuildCmd struct {
-	Config    string `arg:"" name:"config" help:"config" predictor:"config"`
+	Config    string `arg:"" optional:"" name:"config" help:"config" predictor:"config"`
+	All       bool   `name:"all" help:"Rebuild all configs in the config directory, configs they depend on first."`
 	FullBuild bool   `name:"full-build" help:"Run a full build image even when migrate on boot and precompile on boot are present in the config. Saves a fully built image with environment baked in. Without this flag, if MIGRATE_ON_BOOT is set in config it will defer migration until container start, and if PRECOMPILE_ON_BOOT is set in the config, it will defer configure step until container start."`
 	Clean     bool   `help:"also runs clean"`
+
+	WaitTimeout time.Duration `name:"wait-timeout" default:"5m" help:"With --all, how long to wait for a rebuilt container to be running, and healthy if it has a healthcheck, before rebuilding the containers that depend on it."`
+
+	RetryFlags     `embed:""`
+	PreflightFlags `embed:""`
 }
 
 func (r *RebuildCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	if r.All {
+		if r.Config != "" {
+			return errors.New("name a config, or use --all, but not both")
+		}
+		return r.rebuildAll(cli, ctx)
+	}
+	if r.Config == "" {
+		return errors.New("name the config to rebuild, or use --all")
+	}
 
+	unlock, err := cli.lock(ctx, r.Config, "rebuild")
 	if err != nil {
-		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+		return err
+	}
+	defer unlock()
+
+	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+
+	if err != nil {
+		return configLoadError(err)
 	}
 
 	// if we're not in an all-in-one setup, we can run migrations while the app is running
 	externalDb := config.Env["DISCOURSE_DB_SOCKET"] == "" && config.Env["DISCOURSE_DB_HOST"] != ""
 
-	build := DockerBuildCmd{Config: r.Config}
-	configure := DockerConfigureCmd{Config: r.Config}
+	build := DockerBuildCmd{Config: r.Config, RetryFlags: r.RetryFlags}
+	configure := DockerConfigureCmd{Config: r.Config, RetryFlags: r.RetryFlags}
 	stop := StopCmd{Config: r.Config}
 	destroy := DestroyCmd{Config: r.Config}
 	clean := CleanupCmd{}
-	extraEnv := []string{}
+
+	if err := r.preflight(cli, config); err != nil {
+		return err
+	}
 
 	if err := build.Run(cli, ctx); err != nil {
 		return err
 	}
 
+	if err := r.preflightImage(cli, imageName(cli, r.Config)); err != nil {
+		return err
+	}
+
 	if !externalDb {
-		if err := stop.Run(cli, ctx); err != nil {
+		if err := cli.stage("stop", "", func() error { return stop.Run(cli, ctx) }); err != nil {
 			return err
 		}
 	}
@@ -287,7 +362,7 @@ func (r *RebuildCmd) Run(cli *Cli, ctx *context.Context) error {
 	_, migrateOnBoot := config.Env["MIGRATE_ON_BOOT"]
 
 	if !migrateOnBoot || r.FullBuild {
-		migrate := DockerMigrateCmd{Config: r.Config}
+		migrate := DockerMigrateCmd{Config: r.Config, RetryFlags: r.RetryFlags}
 
 		if externalDb {
 			// defer post deploy migrations until after reboot
@@ -297,8 +372,6 @@ func (r *RebuildCmd) Run(cli *Cli, ctx *context.Context) error {
 		if err := migrate.Run(cli, ctx); err != nil {
 			return err
 		}
-
-		extraEnv = append(extraEnv, "MIGRATE_ON_BOOT=0")
 	}
 
 	_, precompileOnBoot := config.Env["PRECOMPILE_ON_BOOT"]
@@ -307,29 +380,29 @@ func (r *RebuildCmd) Run(cli *Cli, ctx *context.Context) error {
 		if err := configure.Run(cli, ctx); err != nil {
 			return err
 		}
-
-		extraEnv = append(extraEnv, "PRECOMPILE_ON_BOOT=0")
 	}
 
-	if err := destroy.Run(cli, ctx); err != nil {
+	if err := cli.stage("destroy", "", func() error { return destroy.Run(cli, ctx) }); err != nil {
 		return err
 	}
 
-	start := StartCmd{Config: r.Config, extraEnv: extraEnv}
+	start := StartCmd{Config: r.Config, extraEnv: bootEnv(config, r.FullBuild)}
 
-	if err := start.Run(cli, ctx); err != nil {
+	if err := cli.stage("start", "", func() error { return start.Run(cli, ctx) }); err != nil {
 		return err
 	}
 
 	// run post deploy migrations since we've rebooted
 	if externalDb {
-		migrate := DockerMigrateCmd{Config: r.Config}
+		migrate := DockerMigrateCmd{Config: r.Config, RetryFlags: r.RetryFlags}
 		if err := migrate.Run(cli, ctx); err != nil {
 			return err
 		}
 	}
 
 	if r.Clean {
+		// cleanup locks the whole build dir, so release this config's lock first
+		unlock()
 		if err := clean.Run(cli, ctx); err != nil {
 			return err
 		}
@@ -338,9 +411,163 @@ func (r *RebuildCmd) Run(cli *Cli, ctx *context.Context) error {
 	return nil
 }
 
+type ApplyCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Plan   bool   `name:"plan" help:"Print the plan and exit without applying it."`
+
+	PreflightFlags `embed:""`
+}
+
+// Actions apply can take, from least to most disruptive.
+const (
+	applyNothing = iota
+	applyRecreate
+	applyReconfigure
+	applyRebuild
+)
+
+var applyActionNames = []string{
+	"nothing to do",
+	"restart with new container settings (destroy, start)",
+	"reconfigure (configure, destroy, start)",
+	"full rebuild",
+}
+
+func (r *ApplyCmd) Run(cli *Cli, ctx *context.Context) error {
+	// lock before planning, so the container does not change between planning and acting on the plan
+	if !r.Plan {
+		unlock, err := cli.lock(ctx, r.Config, "apply")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+
+	if err != nil {
+		return configLoadError(err)
+	}
+
+	action, reasons, err := planApply(r.Config, conf)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(utils.Out, "Plan for "+r.Config+": "+applyActionNames[action])
+	for _, reason := range reasons {
+		fmt.Fprintln(utils.Out, "  - "+reason)
+	}
+
+	if r.Plan {
+		return nil
+	}
+
+	switch action {
+	case applyRebuild:
+		rebuild := RebuildCmd{Config: r.Config, PreflightFlags: r.PreflightFlags}
+		return rebuild.Run(cli, ctx)
+	case applyReconfigure:
+		configure := DockerConfigureCmd{Config: r.Config}
+		if err := configure.Run(cli, ctx); err != nil {
+			return err
+		}
+		fallthrough
+	case applyRecreate:
+		destroy := DestroyCmd{Config: r.Config}
+		if err := cli.stage("destroy", "", func() error { return destroy.Run(cli, ctx) }); err != nil {
+			return err
+		}
+		// the image was migrated and configured as a rebuild does
+		start := StartCmd{Config: r.Config, extraEnv: bootEnv(conf, false)}
+		return cli.stage("start", "", func() error { return start.Run(cli, ctx) })
+	}
+	return nil
+}
+
+// bootEnv overrides MIGRATE_ON_BOOT and PRECOMPILE_ON_BOOT for containers started from an image rebuilt
+// with migrations and precompiled assets, so the container does not run them again on boot.
+// Without a full build, images of configs setting them are left to migrate or precompile on boot.
+func bootEnv(conf *config.Config, fullBuild bool) []string {
+	env := []string{}
+	if _, migrateOnBoot := conf.Env["MIGRATE_ON_BOOT"]; !migrateOnBoot || fullBuild {
+		env = append(env, "MIGRATE_ON_BOOT=0")
+	}
+	if _, precompileOnBoot := conf.Env["PRECOMPILE_ON_BOOT"]; !precompileOnBoot || fullBuild {
+		env = append(env, "PRECOMPILE_ON_BOOT=0")
+	}
+	return env
+}
+
+// planApply chooses the least disruptive action that brings a config's running container in line with it.
+// apply acts on the plan, and diff prints it.
+func planApply(name string, conf *config.Config) (int, []string, error) {
+	exists, _ := docker.ContainerExists(name)
+	if !exists {
+		return applyRebuild, []string{"container " + name + " was not found"}, nil
+	}
+
+	running, err := docker.InspectContainer(name)
+	if err != nil {
+		return applyNothing, nil, err
+	}
+
+	action := applyNothing
+	reasons := []string{}
+
+	buildHash := running.Labels[config.BuildHashLabel]
+	if buildHash == "" {
+		action = applyRebuild
+		reasons = append(reasons, "running image was not built with a config hash")
+	} else if buildHash != conf.BuildHash() {
+		action = applyRebuild
+		reasons = append(reasons, "base image, templates, or pups config changed")
+	}
+
+	// images configured before start have their env baked in, and need to be reconfigured for env changes.
+	// Otherwise assets are precompiled on boot, so a new container is enough.
+	envHash := running.Labels[config.EnvHashLabel]
+	_, precompileOnBoot := conf.Env["PRECOMPILE_ON_BOOT"]
+	reconfigure := envHash != "" && envHash != conf.EnvHash() && !precompileOnBoot
+	if reconfigure {
+		action = max(action, applyReconfigure)
+		reasons = append(reasons, "configured env changed")
+	}
+
+	for _, d := range config.DiffRunning(conf, running) {
+		if d.Field == "env" && reconfigure {
+			continue
+		}
+		action = max(action, applyRecreate)
+		reasons = append(reasons, d.Redacted().String())
+	}
+
+	// the image may have been rebuilt since the container started
+	containerImage, err := docker.ContainerImageId(name)
+	if err != nil {
+		return applyNothing, nil, err
+	}
+	image, err := docker.ImageId(conf.RunImage())
+	if err != nil {
+		return applyNothing, nil, err
+	}
+	if image != "" && image != containerImage {
+		action = max(action, applyRecreate)
+		reasons = append(reasons, "container is not running the latest "+conf.RunImage()+" image")
+	}
+
+	return action, reasons, nil
+}
+
 type CleanupCmd struct{}
 
 func (r *CleanupCmd) Run(cli *Cli, ctx *context.Context) error {
+	unlock, err := cli.lockBuildDir(ctx, "cleanup")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	cmd := exec.CommandContext(*ctx, utils.DockerPath, "container", "prune", "--filter", "until=1h")
 
 	if err := utils.CmdRunner(cmd).Run(); err != nil {
@@ -353,16 +580,18 @@ func (r *CleanupCmd) Run(cli *Cli, ctx *context.Context) error {
 		return err
 	}
 
-	_, err := os.Stat("/var/discourse/shared/standalone/postgres_data_old")
+	_, err = os.Stat("/var/discourse/shared/standalone/postgres_data_old")
 
-	if !os.IsNotExist(err) {
+	if !os.IsNotExist(err) && cli.DryRun {
+		utils.LogInfo("Old PostgreSQL backup data cluster detected at /var/discourse/shared/standalone/postgres_data_old, skipping removal on dry run")
+	} else if !os.IsNotExist(err) {
 		fmt.Fprintln(utils.Out, "Old PostgreSQL backup data cluster detected")
 		fmt.Fprintln(utils.Out, "Would you like to remove it? (y/N)")
 		scanner := bufio.NewScanner(os.Stdin)
 		scanner.Scan()
 		reply := scanner.Text()
 		if reply == "y" || reply == "Y" {
-			fmt.Fprintln(utils.Out, "removing old PostgreSQL data cluster at /var/discourse/shared/standalone/postgres_data_old...")
+			utils.LogInfo("removing old PostgreSQL data cluster at /var/discourse/shared/standalone/postgres_data_old...")
 			os.RemoveAll("/var/discourse/shared/standalone/postgres_data_old")
 		} else {
 			return errors.New("Cancelled")
@@ -6,9 +6,13 @@ import (
 
 	"bytes"
 	"context"
+	"encoding/json"
 	"os"
+	"os/exec"
+	"strings"
 
 	ddocker "github.com/discourse/launcher/v2"
+	"github.com/discourse/launcher/v2/config"
 	. "github.com/discourse/launcher/v2/test_utils"
 	"github.com/discourse/launcher/v2/utils"
 )
@@ -32,7 +36,7 @@ var _ = Describe("Runtime", func() {
 			BuildDir:     testDir,
 		}
 
-		utils.CmdRunner = CreateNewFakeCmdRunner()
+		utils.CmdRunner = withLinkedData(CreateNewFakeCmdRunner())
 	})
 
 	AfterEach(func() {
@@ -86,6 +90,68 @@ var _ = Describe("Runtime", func() {
 				checkStartCmd()
 			})
 
+			It("should mask secrets when printing start commands on dry runs", func() {
+				cli.DryRun = true
+				runner := ddocker.StartCmd{Config: "test"}
+				err := runner.Run(cli, &ctx)
+				Expect(err).To(BeNil())
+				Expect(out.String()).To(ContainSubstring("--env DISCOURSE_DB_PASSWORD=[REDACTED]"))
+				Expect(out.String()).ToNot(ContainSubstring("SOME_SECRET"))
+			})
+
+			It("should pass quoted docker args as single arguments", func() {
+				runner := ddocker.StartCmd{Config: "test", DockerArgs: `--log-opt tag="discourse app"`}
+				Expect(runner.Run(cli, &ctx)).To(Succeed())
+				GetLastCommand()
+				GetLastCommand()
+				cmd := GetLastCommand()
+				Expect(cmd.String()).To(ContainSubstring("docker run"))
+				Expect(cmd.Args).To(ContainElements("--log-opt", "tag=discourse app"))
+			})
+
+			It("should refuse docker args launcher sets itself", func() {
+				runner := ddocker.StartCmd{Config: "test", DockerArgs: "--restart=unless-stopped"}
+				err := runner.Run(cli, &ctx)
+				Expect(err).ToNot(BeNil())
+				Expect(err.Error()).To(Equal("--docker-args: --restart is set by launcher, and cannot be passed as a docker arg"))
+				Expect(utils.ExitStatus(err)).To(Equal(utils.ExitConfig))
+				Expect(RanCmds).To(BeEmpty())
+
+				run := ddocker.RunCmd{Config: "test", DockerArgs: `--label "unterminated`, Cmd: []string{"true"}}
+				Expect(utils.ExitStatus(run.Run(cli, &ctx))).To(Equal(utils.ExitConfig))
+				Expect(RanCmds).To(BeEmpty())
+			})
+
+			It("should refuse configs setting limits in both resources and docker args", func() {
+				content, _ := os.ReadFile("./test/containers/test.yml")
+				os.WriteFile(testDir+"/test.yml", bytes.Replace(content, []byte(`docker_args: "--expose 100"`), []byte("docker_args: --memory 2g\nresources:\n  memory: 4g"), 1), 0644)
+				cli.ConfDir = testDir
+				runner := ddocker.StartCmd{Config: "test"}
+				err := runner.Run(cli, &ctx)
+				Expect(utils.ExitStatus(err)).To(Equal(utils.ExitConfig))
+				Expect(out.String()).To(ContainSubstring("docker_args: --memory conflicts with resources, set resources memory instead"))
+			})
+
+			It("should report interpolation errors as such, rather than as YAML syntax errors", func() {
+				content, _ := os.ReadFile("./test/containers/test.yml")
+				os.WriteFile(testDir+"/test.yml", bytes.Replace(content, []byte(`docker_args: "--expose 100"`), []byte(`docker_args: '--log-opt tag={{env "LAUNCHER_TEST_UNSET"}}'`), 1), 0644)
+				cli.ConfDir = testDir
+				runner := ddocker.StartCmd{Config: "test"}
+				err := runner.Run(cli, &ctx)
+				Expect(utils.ExitStatus(err)).To(Equal(utils.ExitConfig))
+				Expect(err.Error()).To(Equal("undefined variable in docker_args: env LAUNCHER_TEST_UNSET"))
+			})
+
+			It("should report logs and enter as not found", func() {
+				logs := ddocker.LogsCmd{Config: "test"}
+				err := logs.Run(cli, &ctx)
+				Expect(utils.ExitStatus(err)).To(Equal(utils.ExitNotFound))
+
+				enter := ddocker.EnterCmd{Config: "test"}
+				err = enter.Run(cli, &ctx)
+				Expect(utils.ExitStatus(err)).To(Equal(utils.ExitNotFound))
+			})
+
 			It("should not run stop commands", func() {
 				runner := ddocker.StopCmd{Config: "test"}
 				runner.Run(cli, &ctx)
@@ -113,6 +179,21 @@ var _ = Describe("Runtime", func() {
 			})
 
 			It("should keep running during commits, and be post-deploy migration aware when using a web only container", func() {
+				// record the link queries, rather than answering them as already connected
+				utils.CmdRunner = CreateNewFakeCmdRunner()
+				CmdOutputResponse = []byte{123}
+				CmdOutputResponses["docker network ls"] = []byte("discourse\n")
+				// the linked container is not on the network yet
+				CmdOutputResponses["docker inspect --type container data"] = []byte(`[{"NetworkSettings": {"Networks": {"bridge": {}}}}]`)
+				// links run as aliases on the discourse network, rather than with --link
+				checkLinkCmds := func() {
+					cmd := GetLastCommand()
+					Expect(cmd.String()).To(ContainSubstring("docker network ls"))
+					cmd = GetLastCommand()
+					Expect(cmd.String()).To(ContainSubstring("docker inspect --type container data"))
+					cmd = GetLastCommand()
+					Expect(cmd.String()).To(ContainSubstring("docker network connect --alias data discourse data"))
+				}
 				runner := ddocker.RebuildCmd{Config: "web_only"}
 				runner.Run(cli, &ctx)
 
@@ -121,12 +202,16 @@ var _ = Describe("Runtime", func() {
 				Expect(cmd.String()).To(ContainSubstring("docker build"))
 
 				//migrate, skipping post deployment migrations
+				checkLinkCmds()
 				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker run"))
+				Expect(cmd.String()).To(ContainSubstring("--network discourse"))
+				Expect(cmd.String()).ToNot(ContainSubstring("--link"))
 				Expect(cmd.String()).To(ContainSubstring("--tags=db,migrate"))
 				Expect(cmd.String()).To(ContainSubstring("--env SKIP_POST_DEPLOYMENT_MIGRATIONS=1"))
 
 				// precompile
+				checkLinkCmds()
 				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker run"))
 				Expect(cmd.String()).To(ContainSubstring("--tags=db,precompile"))
@@ -149,12 +234,53 @@ var _ = Describe("Runtime", func() {
 				Expect(cmd.String()).To(ContainSubstring("docker ps --quiet"))
 
 				// run post-deploy migrations
+				checkLinkCmds()
 				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker run"))
 				Expect(cmd.String()).To(ContainSubstring("--tags=db,migrate"))
 				Expect(len(RanCmds)).To(Equal(0))
 			})
 
+			It("should not rebuild while another launcher holds the config's lock", func() {
+				lock, err := utils.AcquireLock(ctx, testDir+"/standalone.lock", "rebuild standalone", false)
+				Expect(err).To(BeNil())
+				defer lock.Release()
+
+				runner := ddocker.RebuildCmd{Config: "standalone"}
+				err = runner.Run(cli, &ctx)
+				Expect(utils.ExitStatus(err)).To(Equal(utils.ExitLocked))
+				Expect(err.Error()).To(ContainSubstring("rebuild standalone already in progress by PID"))
+				Expect(len(RanCmds)).To(Equal(0))
+
+				stop := ddocker.StopCmd{Config: "standalone"}
+				Expect(utils.ExitStatus(stop.Run(cli, &ctx))).To(Equal(utils.ExitLocked))
+			})
+
+			It("should not clean up while another launcher rebuilds, nor rebuild during cleanup", func() {
+				// rebuilds hold the build dir lock shared, along with their config's lock
+				rebuilding, err := utils.AcquireSharedLock(ctx, testDir+"/launcher.lock", "rebuild standalone", false)
+				Expect(err).To(BeNil())
+				cleanup := ddocker.CleanupCmd{}
+				err = cleanup.Run(cli, &ctx)
+				Expect(utils.ExitStatus(err)).To(Equal(utils.ExitLocked))
+				Expect(RanCmds).To(BeEmpty())
+
+				// other configs can still be rebuilt meanwhile
+				stop := ddocker.StopCmd{Config: "web_only"}
+				Expect(stop.Run(cli, &ctx)).To(Succeed())
+				rebuilding.Release()
+				RanCmds = nil
+
+				cleaning, err := utils.AcquireLock(ctx, testDir+"/launcher.lock", "cleanup", false)
+				Expect(err).To(BeNil())
+				defer cleaning.Release()
+				runner := ddocker.RebuildCmd{Config: "standalone"}
+				err = runner.Run(cli, &ctx)
+				Expect(utils.ExitStatus(err)).To(Equal(utils.ExitLocked))
+				Expect(err.Error()).To(ContainSubstring("cleanup already in progress by PID"))
+				Expect(RanCmds).To(BeEmpty())
+			})
+
 			It("should stop with standalone", func() {
 				runner := ddocker.RebuildCmd{Config: "standalone"}
 
@@ -201,4 +327,182 @@ var _ = Describe("Runtime", func() {
 		})
 
 	})
+
+	Context("When applying configs", func() {
+		var conf *config.Config
+		var labels map[string]string
+		var env []string
+		var ports map[string]any
+
+		// fake docker inspect output for a container started from conf
+		var setRunningContainer = func() {
+			inspect, _ := json.Marshal([]map[string]any{{
+				"Image": "sha256:current",
+				"Config": map[string]any{
+					"Image":  "local_discourse/standalone",
+					"Env":    env,
+					"Labels": labels,
+				},
+				"HostConfig": map[string]any{
+					"Binds":        []string{"/var/discourse/shared/standalone:/shared", "/var/discourse/shared/standalone/log/var-log:/var/log"},
+					"PortBindings": ports,
+				},
+			}})
+			CmdOutputResponse = []byte{123}
+			CmdOutputResponses["docker inspect --type container"] = inspect
+			CmdOutputResponses["docker image inspect"] = []byte("sha256:current\n")
+		}
+
+		BeforeEach(func() {
+			conf, _ = config.LoadConfig("./test/containers", "standalone", true, "./test", "")
+			labels = map[string]string{
+				config.BuildHashLabel: conf.BuildHash(),
+				config.EnvHashLabel:   conf.EnvHash(),
+			}
+			env = append(conf.EnvArray(true), "PATH=/usr/bin")
+			ports = map[string]any{
+				"80/tcp":  []map[string]string{{"HostIp": "", "HostPort": "80"}},
+				"443/tcp": []map[string]string{{"HostIp": "", "HostPort": "443"}},
+			}
+		})
+
+		It("plans a full rebuild without a container", func() {
+			runner := ddocker.ApplyCmd{Config: "standalone", Plan: true}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("Plan for standalone: full rebuild\n  - container standalone was not found"))
+			Expect(len(RanCmds)).To(Equal(1))
+		})
+
+		It("locks the config before inspecting the container", func() {
+			setRunningContainer()
+			lock, err := utils.AcquireLock(ctx, testDir+"/standalone.lock", "rebuild standalone", false)
+			Expect(err).To(BeNil())
+			defer lock.Release()
+
+			runner := ddocker.ApplyCmd{Config: "standalone"}
+			err = runner.Run(cli, &ctx)
+			Expect(utils.ExitStatus(err)).To(Equal(utils.ExitLocked))
+			Expect(RanCmds).To(BeEmpty())
+
+			// plans only read, so do not wait for the lock
+			runner.Plan = true
+			Expect(runner.Run(cli, &ctx)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("Plan for standalone: nothing to do"))
+		})
+
+		It("does nothing when the container is up to date", func() {
+			setRunningContainer()
+			runner := ddocker.ApplyCmd{Config: "standalone"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("Plan for standalone: nothing to do"))
+			for _, cmd := range RanCmds {
+				Expect(cmd.String()).ToNot(ContainSubstring("docker stop"))
+				Expect(cmd.String()).ToNot(ContainSubstring("docker run"))
+			}
+		})
+
+		It("ignores env launcher overrides after a rebuild", func() {
+			conf.Env["MIGRATE_ON_BOOT"] = "1"
+			env = append(env, "MIGRATE_ON_BOOT=0")
+			setRunningContainer()
+			runner := ddocker.ApplyCmd{Config: "standalone", Plan: true}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("Plan for standalone: nothing to do"))
+		})
+
+		It("recreates the container when container settings change", func() {
+			ports["443/tcp"] = []map[string]string{{"HostIp": "", "HostPort": "8443"}}
+			setRunningContainer()
+			// the container is gone once removed
+			fake := utils.CmdRunner
+			utils.CmdRunner = func(cmd *exec.Cmd) utils.ICmdRunner {
+				if strings.Contains(cmd.String(), "docker rm standalone") {
+					CmdOutputResponse = []byte{}
+				}
+				return fake(cmd)
+			}
+			runner := ddocker.ApplyCmd{Config: "standalone"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("Plan for standalone: restart with new container settings (destroy, start)\n" +
+				"  - - expose: 8443:443\n" +
+				"  - + expose: 443:443\n"))
+
+			// ps, inspect, inspect, image inspect
+			RanCmds = RanCmds[4:]
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker ps --all --quiet --filter name=standalone"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker stop --time 600 standalone"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker rm standalone"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker ps --quiet --filter name=standalone"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker ps --all --quiet --filter name=standalone"))
+
+			// the new container skips migrating and precompiling on boot, as after a rebuild
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker run"))
+			Expect(cmd.String()).To(ContainSubstring("--env MIGRATE_ON_BOOT=0 --env PRECOMPILE_ON_BOOT=0"))
+		})
+
+		It("recreates the container when running an outdated image", func() {
+			setRunningContainer()
+			CmdOutputResponses["docker image inspect"] = []byte("sha256:new\n")
+			runner := ddocker.ApplyCmd{Config: "standalone", Plan: true}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("Plan for standalone: restart with new container settings (destroy, start)\n" +
+				"  - container is not running the latest local_discourse/standalone image"))
+		})
+
+		It("reconfigures when configured env changes", func() {
+			labels[config.EnvHashLabel] = "outdated"
+			env = []string{"DISCOURSE_HOSTNAME=old.example.com"}
+			setRunningContainer()
+			runner := ddocker.ApplyCmd{Config: "standalone"}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("Plan for standalone: reconfigure (configure, destroy, start)\n  - configured env changed\n"))
+			Expect(out.String()).ToNot(ContainSubstring("DISCOURSE_HOSTNAME"))
+
+			RanCmds = RanCmds[4:]
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker run"))
+			Expect(cmd.String()).To(ContainSubstring("--tags=db,precompile"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker commit"))
+		})
+
+		It("restarts with new env when assets are precompiled on boot", func() {
+			labels[config.EnvHashLabel] = "outdated"
+			env = []string{"DISCOURSE_HOSTNAME=old.example.com", "PRECOMPILE_ON_BOOT=1"}
+			content, _ := os.ReadFile("./test/containers/standalone.yml")
+			os.WriteFile(testDir+"/standalone.yml", bytes.Replace(content, []byte("env:\n"), []byte("env:\n  PRECOMPILE_ON_BOOT: 1\n"), 1), 0644)
+			cli.ConfDir = testDir
+			setRunningContainer()
+			runner := ddocker.ApplyCmd{Config: "standalone", Plan: true}
+			err := runner.Run(cli, &ctx)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(ContainSubstring("Plan for standalone: restart with new container settings (destroy, start)\n"))
+			Expect(out.String()).To(ContainSubstring("~ env DISCOURSE_HOSTNAME: [REDACTED] -> [REDACTED]"))
+		})
+
+		It("rebuilds when the build changes", func() {
+			labels[config.BuildHashLabel] = "outdated"
+			setRunningContainer()
+			runner := ddocker.ApplyCmd{Config: "standalone"}
+			runner.Run(cli, &ctx)
+			Expect(out.String()).To(ContainSubstring("Plan for standalone: full rebuild\n  - base image, templates, or pups config changed"))
+
+			// ps, inspect, inspect, image inspect
+			RanCmds = RanCmds[4:]
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker build"))
+		})
+	})
 })
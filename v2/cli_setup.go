@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+	"golang.org/x/term"
+)
+
+// Config written by setup when there is none yet, based on samples/standalone.yml.
+const newSetupConfig = `## this is the all-in-one, standalone Discourse Docker container template
+##
+## After making changes to this file, you MUST rebuild
+## /var/discourse/launcher rebuild app
+##
+## BE *VERY* CAREFUL WHEN EDITING!
+## YAML FILES ARE SUPER SUPER SENSITIVE TO MISTAKES IN WHITESPACE OR ALIGNMENT!
+## visit http://www.yamllint.com/ to validate this file as needed
+
+templates:
+  - "templates/postgres.template.yml"
+  - "templates/redis.template.yml"
+  - "templates/web.template.yml"
+  ## Uncomment the next line to enable the IPv6 listener
+  #- "templates/web.ipv6.template.yml"
+  - "templates/web.ratelimited.template.yml"
+  ## Uncomment these two lines if you wish to add Lets Encrypt (https)
+  #- "templates/web.ssl.template.yml"
+  #- "templates/web.letsencrypt.ssl.template.yml"
+
+## which TCP/IP ports should this container expose?
+## If you want Discourse to share a port with another webserver like Apache or nginx,
+## see https://meta.discourse.org/t/17247 for details
+expose:
+  - "80:80"   # http
+  - "443:443" # https
+
+params:
+  db_default_text_search_config: "pg_catalog.english"
+
+  ## Set db_shared_buffers to a max of 25% of the total memory.
+  ## will be set automatically by bootstrap based on detected RAM, or you can override
+  #db_shared_buffers: "256MB"
+
+  ## can improve sorting performance, but adds memory usage per-connection
+  #db_work_mem: "40MB"
+
+  ## Which Git revision should this container use? (default: tests-passed)
+  #version: tests-passed
+
+env:
+  LC_ALL: en_US.UTF-8
+  LANG: en_US.UTF-8
+  LANGUAGE: en_US.UTF-8
+  # DISCOURSE_DEFAULT_LOCALE: en
+
+  ## How many concurrent web requests are supported? Depends on memory and CPU cores.
+  ## will be set automatically by bootstrap based on detected CPUs, or you can override
+  #UNICORN_WORKERS: 3
+
+  ## TODO: The domain name this Discourse instance will respond to
+  ## Required. Discourse will not work with a bare IP number.
+  DISCOURSE_HOSTNAME: 'discourse.example.com'
+
+  ## Uncomment if you want the container to be started with the same
+  ## hostname (-h option) as specified above (default "$hostname-$config")
+  #DOCKER_USE_HOSTNAME: true
+
+  ## TODO: List of comma delimited emails that will be made admin and developer
+  ## on initial signup example 'user1@example.com,user2@example.com'
+  DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'
+
+  ## TODO: The SMTP mail server used to validate new accounts and send notifications
+  # SMTP ADDRESS, username, and password are required
+  # WARNING the char '#' in SMTP password can cause problems!
+  DISCOURSE_SMTP_ADDRESS: smtp.example.com
+  #DISCOURSE_SMTP_PORT: 587
+  DISCOURSE_SMTP_USER_NAME: user@example.com
+  DISCOURSE_SMTP_PASSWORD: pa$$word
+  #DISCOURSE_SMTP_ENABLE_START_TLS: true           # (optional, default true)
+  #DISCOURSE_SMTP_DOMAIN: discourse.example.com    # (required by some providers)
+  #DISCOURSE_NOTIFICATION_EMAIL: noreply@discourse.example.com    # (address to send notifications from)
+
+  ## If you added the Lets Encrypt template, uncomment below to get a free SSL certificate
+  #LETSENCRYPT_ACCOUNT_EMAIL: me@example.com
+
+## The Docker container is stateless; all data is stored in /shared
+volumes:
+  - volume:
+      host: /var/discourse/shared/standalone
+      guest: /shared
+  - volume:
+      host: /var/discourse/shared/standalone/log/var-log
+      guest: /var/log
+
+## Plugins go here
+## see https://meta.discourse.org/t/19157 for details
+hooks:
+  after_code:
+    - exec:
+        cd: $home/plugins
+        cmd:
+          - git clone https://github.com/discourse/docker_manager.git
+`
+
+/*
+ * setup
+ */
+type SetupCmd struct {
+	Config            string `arg:"" optional:"" default:"app" name:"config" help:"config" predictor:"config"`
+	Hostname          string `name:"hostname" help:"Domain name this Discourse instance responds to."`
+	DeveloperEmails   string `name:"developer-emails" help:"Comma delimited emails of admin accounts."`
+	SmtpAddress       string `name:"smtp-address" help:"SMTP server used to send email."`
+	SmtpPort          string `name:"smtp-port" help:"SMTP server port."`
+	SmtpUserName      string `name:"smtp-user-name" help:"SMTP user name."`
+	SmtpPassword      string `name:"smtp-password" help:"SMTP password."`
+	NotificationEmail string `name:"notification-email" help:"Email address notifications are sent from."`
+	LetsencryptEmail  string `name:"letsencrypt-email" help:"Email address for Let's Encrypt warnings. Enables https with a free Let's Encrypt certificate. OFF to skip."`
+	NonInteractive    bool   `name:"non-interactive" help:"Do not prompt. Settings not passed as flags keep their current values."`
+	SkipChecks        bool   `name:"skip-checks" help:"Skip checking free ports and memory."`
+}
+
+type setupQuestion struct {
+	env      string
+	prompt   string
+	answer   *string
+	fallback string
+	validate func(string) error
+	secret   bool
+}
+
+func (r *SetupCmd) Run(cli *Cli, ctx *context.Context) error {
+	editor, err := config.LoadEditor(cli.ConfDir, r.Config)
+	if os.IsNotExist(err) {
+		editor, err = config.NewEditor(cli.ConfDir, r.Config, []byte(newSetupConfig))
+	}
+	if err != nil {
+		return configLoadError(err)
+	}
+
+	if !r.SkipChecks {
+		r.checkHost()
+	}
+
+	questions := []setupQuestion{
+		{"DISCOURSE_HOSTNAME", "Hostname for your Discourse?", &r.Hostname, "", validateHostname, false},
+		{"DISCOURSE_DEVELOPER_EMAILS", "Email address for admin account(s)?", &r.DeveloperEmails, "", validateDeveloperEmails, false},
+		{"DISCOURSE_SMTP_ADDRESS", "SMTP server address?", &r.SmtpAddress, "", validateSmtpAddress, false},
+		{"DISCOURSE_SMTP_PORT", "SMTP port?", &r.SmtpPort, "587", validatePort, false},
+		{"DISCOURSE_SMTP_USER_NAME", "SMTP user name?", &r.SmtpUserName, "", nil, false},
+		{"DISCOURSE_SMTP_PASSWORD", "SMTP password?", &r.SmtpPassword, "", nil, true},
+		{"DISCOURSE_NOTIFICATION_EMAIL", "Notification email address?", &r.NotificationEmail, "", validateOptionalEmail, false},
+		{"LETSENCRYPT_ACCOUNT_EMAIL", "Optional email address for Let's Encrypt warnings? (ENTER to skip, OFF to turn off)", &r.LetsencryptEmail, "", validateLetsencryptEmail, false},
+	}
+
+	input := bufio.NewReader(utils.Stdin)
+	for _, q := range questions {
+		existing, ok := editor.Get("env." + q.env)
+		current := existing
+		if !ok {
+			current = q.fallback
+		}
+		if q.env == "DISCOURSE_NOTIFICATION_EMAIL" && !ok {
+			current = "noreply@" + r.Hostname
+		}
+		answer, err := r.ask(input, q, current)
+		if err != nil {
+			return err
+		}
+		*q.answer = answer
+		if answer == "" || (ok && answer == existing) || (q.env == "LETSENCRYPT_ACCOUNT_EMAIL" && strings.EqualFold(answer, "OFF")) {
+			continue
+		}
+		if err := editor.Set("env."+q.env, answer); err != nil {
+			return utils.NewError(utils.ErrConfig, "Unable to update config: "+err.Error(), err)
+		}
+	}
+
+	letsencryptTemplates := []string{"templates/web.ssl.template.yml", "templates/web.letsencrypt.ssl.template.yml"}
+	switch {
+	case strings.EqualFold(r.LetsencryptEmail, "OFF"):
+		// turning Let's Encrypt off removes what turning it on added, other than the https port
+		if _, ok := editor.Get("env.LETSENCRYPT_ACCOUNT_EMAIL"); ok {
+			if err := editor.Unset("env.LETSENCRYPT_ACCOUNT_EMAIL"); err != nil {
+				return utils.NewError(utils.ErrConfig, "Unable to update config: "+err.Error(), err)
+			}
+		}
+		for _, template := range letsencryptTemplates {
+			if _, err := editor.RemoveFromList("templates", template); err != nil {
+				return utils.NewError(utils.ErrConfig, "Unable to update config: "+err.Error(), err)
+			}
+		}
+	case r.LetsencryptEmail != "":
+		for _, template := range letsencryptTemplates {
+			if _, err := editor.AddToList("templates", template); err != nil {
+				return utils.NewError(utils.ErrConfig, "Unable to update config: "+err.Error(), err)
+			}
+		}
+		if _, err := editor.AddToList("expose", "443:443"); err != nil {
+			return utils.NewError(utils.ErrConfig, "Unable to update config: "+err.Error(), err)
+		}
+	}
+
+	if err := os.MkdirAll(cli.ConfDir, 0755); err != nil {
+		return err
+	}
+	if err := writeConfig(cli, editor); err != nil || cli.DryRun {
+		return err
+	}
+	fmt.Fprintln(utils.Out, "Configuration file at "+configFilename(cli, r.Config)+" updated successfully!")
+	fmt.Fprintln(utils.Out, "Run ./launcher rebuild "+r.Config+" to apply it.")
+	return nil
+}
+
+// ask prompts for a setting not passed as a flag, until the answer is valid.
+// Without prompts, the flag or current value must be valid.
+func (r *SetupCmd) ask(input *bufio.Reader, q setupQuestion, current string) (string, error) {
+	answer := *q.answer
+	prompt := answer == "" && !r.NonInteractive
+	if answer == "" {
+		answer = current
+	}
+	for {
+		if prompt {
+			shown := current
+			if q.secret && current != "" && !utils.ShowSecrets {
+				shown = utils.RedactedValue
+			}
+			fmt.Fprintf(utils.Out, "%s [%s]: ", q.prompt, shown)
+			var line string
+			var err error
+			if q.secret {
+				line, err = readSecret(input)
+			} else {
+				line, err = input.ReadString('\n')
+			}
+			if err != nil && (err != io.EOF || line == "") {
+				return "", errors.New("setup cancelled, no answer for " + q.env)
+			}
+			answer = strings.TrimSpace(line)
+			if answer == "" {
+				answer = current
+			}
+		}
+		if q.validate == nil {
+			return answer, nil
+		}
+		err := q.validate(answer)
+		if err == nil {
+			return answer, nil
+		}
+		if !prompt {
+			return "", utils.NewError(utils.ErrConfig, q.env+": "+err.Error(), err)
+		}
+		utils.LogError(err)
+	}
+}
+
+// readSecret reads an answer without echoing it, when reading from a terminal.
+func readSecret(input *bufio.Reader) (string, error) {
+	stdin, ok := utils.Stdin.(*os.File)
+	if !ok || !term.IsTerminal(int(stdin.Fd())) {
+		return input.ReadString('\n')
+	}
+	answer, err := term.ReadPassword(int(stdin.Fd()))
+	fmt.Fprintln(utils.Out)
+	return string(answer), err
+}
+
+// checkHost warns about ports in use by another web server, and too little memory.
+func (r *SetupCmd) checkHost() {
+	running, _ := docker.ContainerRunning(r.Config)
+	for _, result := range []checkResult{checkMemory(), checkPort("80", running), checkPort("443", running)} {
+		if result.status != checkPass {
+			utils.LogWarn(result.name + ": " + result.message)
+		}
+	}
+}
+
+func validateHostname(hostname string) error {
+	if hostname == "" || hostname == "discourse.example.com" {
+		return errors.New("a hostname is required, such as discourse.example.org")
+	}
+	if strings.ContainsAny(hostname, " /:") || !strings.Contains(hostname, ".") {
+		return errors.New("hostname should be a domain name, such as discourse.example.org, without http:// or a path")
+	}
+	if net.ParseIP(hostname) != nil {
+		return errors.New("Discourse will not work with a bare IP address, use a domain name")
+	}
+	return nil
+}
+
+func validateDeveloperEmails(emails string) error {
+	if emails == "" || emails == "me@example.com,you@example.com" {
+		return errors.New("at least one admin email address is required")
+	}
+	for _, email := range strings.Split(emails, ",") {
+		if err := validateOptionalEmail(strings.TrimSpace(email)); err != nil || strings.TrimSpace(email) == "" {
+			return errors.New(email + " is not an email address")
+		}
+	}
+	return nil
+}
+
+func validateSmtpAddress(address string) error {
+	if address == "" || address == "smtp.example.com" {
+		return errors.New("an SMTP server is required to send account confirmation emails")
+	}
+	return nil
+}
+
+func validatePort(port string) error {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return errors.New(port + " is not a port number")
+	}
+	return nil
+}
+
+func validateOptionalEmail(email string) error {
+	if email != "" && (!strings.Contains(email, "@") || strings.ContainsAny(email, " ,")) {
+		return errors.New(email + " is not an email address")
+	}
+	return nil
+}
+
+func validateLetsencryptEmail(email string) error {
+	if strings.EqualFold(email, "OFF") {
+		return nil
+	}
+	return validateOptionalEmail(email)
+}
@@ -0,0 +1,197 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"os"
+	"strings"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Setup", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+		os.MkdirAll(testDir+"/templates", 0755)
+		for _, t := range []string{"postgres", "redis", "web.ratelimited", "web.ssl", "web.letsencrypt.ssl"} {
+			os.WriteFile(testDir+"/templates/"+t+".template.yml", []byte("params:\n  x: y\n"), 0644)
+		}
+		os.WriteFile(testDir+"/templates/web.template.yml", []byte("base_image: discourse/base\n"), 0644)
+
+		cli = &ddocker.Cli{
+			ConfDir:      testDir + "/containers",
+			TemplatesDir: testDir,
+			BuildDir:     testDir + "/tmp",
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+
+	AfterEach(func() {
+		utils.Stdin = os.Stdin
+		os.RemoveAll(testDir)
+	})
+
+	readConfig := func() string {
+		content, err := os.ReadFile(testDir + "/containers/app.yml")
+		Expect(err).To(BeNil())
+		return string(content)
+	}
+
+	It("writes a new config from flags", func() {
+		runner := ddocker.SetupCmd{
+			Config:          "app",
+			Hostname:        "forum.example.org",
+			DeveloperEmails: "admin@example.org",
+			SmtpAddress:     "smtp.example.org",
+			SmtpUserName:    "mailer",
+			SmtpPassword:    "hunter2",
+			NonInteractive:  true,
+			SkipChecks:      true,
+		}
+		err := runner.Run(cli, &ctx)
+		Expect(err).To(BeNil())
+		config := readConfig()
+		Expect(config).To(ContainSubstring("  ## Required. Discourse will not work with a bare IP number.\n  DISCOURSE_HOSTNAME: 'forum.example.org'\n"))
+		Expect(config).To(ContainSubstring("  DISCOURSE_DEVELOPER_EMAILS: 'admin@example.org'\n"))
+		Expect(config).To(ContainSubstring("  DISCOURSE_SMTP_ADDRESS: smtp.example.org\n  DISCOURSE_SMTP_PORT: \"587\"\n"))
+		Expect(config).To(ContainSubstring("  DISCOURSE_SMTP_PASSWORD: hunter2\n"))
+		Expect(config).To(ContainSubstring("  DISCOURSE_NOTIFICATION_EMAIL: noreply@forum.example.org\n"))
+		Expect(config).To(ContainSubstring("  #LETSENCRYPT_ACCOUNT_EMAIL: me@example.com\n"))
+		Expect(config).To(ContainSubstring("  #- \"templates/web.ssl.template.yml\"\n"))
+		Expect(out.String()).To(ContainSubstring("Run ./launcher rebuild app to apply it."))
+	})
+
+	It("writes passwords containing {{ as is", func() {
+		runner := ddocker.SetupCmd{
+			Config:          "app",
+			Hostname:        "forum.example.org",
+			DeveloperEmails: "admin@example.org",
+			SmtpAddress:     "smtp.example.org",
+			SmtpUserName:    "mailer",
+			SmtpPassword:    "se{{cret",
+			NonInteractive:  true,
+			SkipChecks:      true,
+		}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(readConfig()).To(ContainSubstring("  DISCOURSE_SMTP_PASSWORD: se{{cret\n"))
+	})
+
+	It("masks secrets in the config printed on dry runs", func() {
+		cli.DryRun = true
+		runner := ddocker.SetupCmd{
+			Config:          "app",
+			Hostname:        "forum.example.org",
+			DeveloperEmails: "admin@example.org",
+			SmtpAddress:     "smtp.example.org",
+			SmtpUserName:    "mailer",
+			SmtpPassword:    "hunter2",
+			NonInteractive:  true,
+			SkipChecks:      true,
+		}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("DISCOURSE_SMTP_PASSWORD: '[REDACTED]'"))
+		Expect(out.String()).ToNot(ContainSubstring("hunter2"))
+		_, err := os.Stat(testDir + "/containers/app.yml")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("prompts for settings, keeping current values by default", func() {
+		os.MkdirAll(testDir+"/containers", 0755)
+		os.WriteFile(testDir+"/containers/app.yml", []byte(`# my forum
+templates:
+  - "templates/web.template.yml"
+expose:
+  - "80:80"
+env:
+  DISCOURSE_HOSTNAME: forum.example.org # current
+  DISCOURSE_DEVELOPER_EMAILS: admin@example.org
+  DISCOURSE_SMTP_ADDRESS: smtp.example.org
+  DISCOURSE_SMTP_PASSWORD: hunter2
+`), 0600)
+		utils.Stdin = strings.NewReader("http://new.example.org\nnew.example.org\n\n\n\n\n\n\nadmin@example.org\n")
+		runner := ddocker.SetupCmd{Config: "app", SkipChecks: true}
+		err := runner.Run(cli, &ctx)
+		Expect(err).To(BeNil())
+		Expect(out.String()).To(ContainSubstring("Hostname for your Discourse? [forum.example.org]: "))
+		Expect(out.String()).To(ContainSubstring("ERROR: hostname should be a domain name"))
+		Expect(out.String()).To(ContainSubstring("SMTP password? [[REDACTED]]: "))
+		Expect(readConfig()).To(Equal(`# my forum
+templates:
+  - "templates/web.template.yml"
+  - "templates/web.ssl.template.yml"
+  - "templates/web.letsencrypt.ssl.template.yml"
+expose:
+  - "80:80"
+  - "443:443"
+env:
+  DISCOURSE_HOSTNAME: new.example.org # current
+  DISCOURSE_DEVELOPER_EMAILS: admin@example.org
+  DISCOURSE_SMTP_ADDRESS: smtp.example.org
+  DISCOURSE_SMTP_PASSWORD: hunter2
+  DISCOURSE_SMTP_PORT: "587"
+  DISCOURSE_NOTIFICATION_EMAIL: noreply@new.example.org
+  LETSENCRYPT_ACCOUNT_EMAIL: admin@example.org
+`))
+		info, _ := os.Stat(testDir + "/containers/app.yml")
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("turns Let's Encrypt off again", func() {
+		os.MkdirAll(testDir+"/containers", 0755)
+		os.WriteFile(testDir+"/containers/app.yml", []byte(`templates:
+  - "templates/web.template.yml"
+  - "templates/web.ssl.template.yml"
+  - "templates/web.letsencrypt.ssl.template.yml"
+expose:
+  - "80:80"
+  - "443:443"
+env:
+  DISCOURSE_HOSTNAME: forum.example.org
+  DISCOURSE_DEVELOPER_EMAILS: admin@example.org
+  DISCOURSE_SMTP_ADDRESS: smtp.example.org
+  DISCOURSE_NOTIFICATION_EMAIL: noreply@forum.example.org
+  LETSENCRYPT_ACCOUNT_EMAIL: admin@example.org
+`), 0644)
+		runner := ddocker.SetupCmd{Config: "app", LetsencryptEmail: "off", NonInteractive: true, SkipChecks: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(readConfig()).To(Equal(`templates:
+  - "templates/web.template.yml"
+  #- "templates/web.ssl.template.yml"
+  #- "templates/web.letsencrypt.ssl.template.yml"
+expose:
+  - "80:80"
+  - "443:443"
+env:
+  DISCOURSE_HOSTNAME: forum.example.org
+  DISCOURSE_DEVELOPER_EMAILS: admin@example.org
+  DISCOURSE_SMTP_ADDRESS: smtp.example.org
+  DISCOURSE_NOTIFICATION_EMAIL: noreply@forum.example.org
+  DISCOURSE_SMTP_PORT: "587"
+`))
+	})
+
+	It("errors on invalid settings without prompting", func() {
+		runner := ddocker.SetupCmd{Config: "app", NonInteractive: true, SkipChecks: true}
+		err := runner.Run(cli, &ctx)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("DISCOURSE_HOSTNAME: a hostname is required"))
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitConfig))
+		_, err = os.Stat(testDir + "/containers/app.yml")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
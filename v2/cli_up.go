@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * up
+ * down
+ * rebuild --all
+ */
+type UpCmd struct {
+	Configs     []string      `arg:"" optional:"" name:"config" help:"configs to start. Configs they depend on are started first." predictor:"config"`
+	All         bool          `name:"all" help:"Start all configs in the config directory."`
+	WaitTimeout time.Duration `name:"wait-timeout" default:"5m" help:"How long to wait for a container to be running, and healthy if it has a healthcheck, before starting the containers that depend on it."`
+}
+
+func (r *UpCmd) Run(cli *Cli, ctx *context.Context) error {
+	names, err := selectConfigs(cli, r.Configs, r.All)
+	if err != nil {
+		return err
+	}
+	order, err := startOrder(cli, names)
+	if err != nil {
+		return err
+	}
+	for i, conf := range order {
+		start := StartCmd{Config: conf.Name}
+		if err := start.Run(cli, ctx); err != nil {
+			return err
+		}
+		if err := waitForDependents(cli, ctx, conf.Name, order[i+1:], r.WaitTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type DownCmd struct {
+	Configs []string `arg:"" optional:"" name:"config" help:"configs to stop. Configs depending on each other are stopped dependents first." predictor:"config"`
+	All     bool     `name:"all" help:"Stop all configs in the config directory."`
+}
+
+func (r *DownCmd) Run(cli *Cli, ctx *context.Context) error {
+	names, err := selectConfigs(cli, r.Configs, r.All)
+	if err != nil {
+		return err
+	}
+	order, err := startOrder(cli, names)
+	if err != nil {
+		return err
+	}
+	slices.Reverse(order)
+	for _, conf := range order {
+		// only the configs asked for, not what they depend on
+		if !slices.Contains(names, conf.Name) {
+			continue
+		}
+		stop := StopCmd{Config: conf.Name}
+		if err := stop.Run(cli, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildAll rebuilds every config in the config directory, dependencies first,
+// waiting for each rebuilt container before rebuilding the containers that depend on it.
+// With --clean, cleanup runs once all configs are rebuilt.
+func (r *RebuildCmd) rebuildAll(cli *Cli, ctx *context.Context) error {
+	names, err := allConfigNames(cli)
+	if err != nil {
+		return err
+	}
+	order, err := startOrder(cli, names)
+	if err != nil {
+		return err
+	}
+	for i, conf := range order {
+		utils.LogInfo("Rebuilding " + conf.Name)
+		rebuild := *r
+		rebuild.Config = conf.Name
+		rebuild.All = false
+		rebuild.Clean = false
+		if err := rebuild.Run(cli, ctx); err != nil {
+			return err
+		}
+		if err := waitForDependents(cli, ctx, conf.Name, order[i+1:], r.WaitTimeout); err != nil {
+			return err
+		}
+	}
+	if r.Clean {
+		clean := CleanupCmd{}
+		return clean.Run(cli, ctx)
+	}
+	return nil
+}
+
+func selectConfigs(cli *Cli, configs []string, all bool) ([]string, error) {
+	switch {
+	case all && len(configs) > 0:
+		return nil, errors.New("name configs, or use --all, but not both")
+	case all:
+		return allConfigNames(cli)
+	case len(configs) == 0:
+		return nil, errors.New("name the configs to use, or use --all")
+	}
+	return configs, nil
+}
+
+// allConfigNames lists the configs in the config directory, leaving out configs only used as a base for others to extend.
+func allConfigNames(cli *Cli) ([]string, error) {
+	files, err := os.ReadDir(cli.ConfDir)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrConfig, "Unable to read config directory "+cli.ConfDir+": "+err.Error(), err)
+	}
+	names := []string{}
+	extended := []string{}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".yml")
+		if file.IsDir() || !ok {
+			continue
+		}
+		names = append(names, name)
+		content, err := os.ReadFile(configFilename(cli, name))
+		if err != nil {
+			return nil, err
+		}
+		parsed := struct{ Extends string }{}
+		if err := yaml.Unmarshal(content, &parsed); err != nil {
+			return nil, configLoadError(err)
+		}
+		if parsed.Extends != "" {
+			extended = append(extended, strings.TrimSuffix(parsed.Extends, ".yml"))
+		}
+	}
+	names = slices.DeleteFunc(names, func(name string) bool { return slices.Contains(extended, name) })
+	if len(names) == 0 {
+		return nil, utils.NewError(utils.ErrNotFound, "No configs found in "+cli.ConfDir, nil)
+	}
+	return names, nil
+}
+
+// startOrder loads configs, along with the configs they depend on, ordered so dependencies start first.
+// Linked containers without a config in the config directory are left out, as launcher does not manage them.
+func startOrder(cli *Cli, names []string) ([]*config.Config, error) {
+	order := []*config.Config{}
+	loaded := map[string]bool{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		path = append(path, name)
+		if slices.Contains(path[:len(path)-1], name) {
+			return utils.NewError(utils.ErrConfig, "Config dependencies form a cycle: "+strings.Join(path, " -> "), nil)
+		}
+		if loaded[name] {
+			return nil
+		}
+		conf, err := config.LoadConfig(cli.ConfDir, name, true, cli.TemplatesDir, cli.Namespace)
+		if err != nil {
+			return configLoadError(err)
+		}
+		for _, dep := range conf.Dependencies() {
+			if _, err := os.Stat(configFilename(cli, dep)); err != nil && !slices.Contains(conf.Depends_On, dep) {
+				utils.LogDebug(name + " links to " + dep + ", which has no config, not starting it")
+				continue
+			}
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		loaded[name] = true
+		order = append(order, conf)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// waitForDependents waits for a container to be ready when later containers depend on it.
+func waitForDependents(cli *Cli, ctx *context.Context, name string, later []*config.Config, timeout time.Duration) error {
+	if cli.DryRun || !slices.ContainsFunc(later, func(c *config.Config) bool { return slices.Contains(c.Dependencies(), name) }) {
+		return nil
+	}
+	utils.LogInfo("Waiting for " + name + " to be ready")
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := docker.InspectState(name)
+		if err != nil {
+			return err
+		}
+		if state.Ready() {
+			return nil
+		}
+		if state.Status == "exited" || state.Status == "dead" {
+			return errors.New(name + " stopped before it was ready. Check ./launcher logs " + name)
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out after " + timeout.String() + " waiting for " + name + " to be ready (" + state.String() + ")")
+		}
+		select {
+		case <-time.After(utils.ReadyPollInterval):
+		case <-(*ctx).Done():
+			return (*ctx).Err()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Up", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	// index of the first command ran containing all the given substrings, or -1
+	ranAt := func(substrings ...string) int {
+		return slices.IndexFunc(RanCmds, func(cmd exec.Cmd) bool {
+			for _, s := range substrings {
+				if !strings.Contains(cmd.String(), s) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		utils.CommitWait = 0
+		utils.ReadyPollInterval = 0
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+		os.WriteFile(testDir+"/base.yml", []byte("base_image: discourse/base:test\n"), 0644)
+		os.WriteFile(testDir+"/data.yml", []byte("extends: base\n"), 0644)
+		os.WriteFile(testDir+"/web_only.yml", []byte(`extends: base
+links:
+  - link:
+      name: data
+      alias: data
+  - link:
+      name: mail
+      alias: mail
+`), 0644)
+		os.WriteFile(testDir+"/sidekiq.yml", []byte("extends: base\ndepends_on:\n  - web_only\n"), 0644)
+
+		cli = &ddocker.Cli{
+			ConfDir:      testDir,
+			TemplatesDir: "./test",
+			BuildDir:     testDir + "/tmp",
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponses["docker inspect --type container"] = []byte(`[{"State": {"Status": "running"}}]`)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("starts dependencies first, waiting for them", func() {
+		runner := ddocker.UpCmd{All: true}
+		err := runner.Run(cli, &ctx)
+		Expect(err).To(BeNil())
+		Expect(ranAt("docker run", "--name base")).To(Equal(-1))
+		data := ranAt("docker run", "--name data")
+		web := ranAt("docker run", "--name web_only")
+		sidekiq := ranAt("docker run", "--name sidekiq")
+		Expect(data).To(BeNumerically(">=", 0))
+		Expect(ranAt("docker inspect --type container data")).To(BeNumerically(">", data))
+		Expect(web).To(BeNumerically(">", ranAt("docker inspect --type container data")))
+		Expect(sidekiq).To(BeNumerically(">", ranAt("docker inspect --type container web_only")))
+		Expect(ranAt("docker inspect --type container sidekiq")).To(Equal(-1))
+	})
+
+	It("starts the configs a config depends on", func() {
+		runner := ddocker.UpCmd{Configs: []string{"web_only"}}
+		err := runner.Run(cli, &ctx)
+		Expect(err).To(BeNil())
+		Expect(ranAt("docker run", "--name data")).To(BeNumerically(">=", 0))
+		Expect(ranAt("docker run", "--name sidekiq")).To(Equal(-1))
+	})
+
+	It("does not start dependents when a dependency is not ready in time", func() {
+		CmdOutputResponses["docker inspect --type container"] = []byte(`[{"State": {"Status": "running", "Health": {"Status": "starting"}}}]`)
+		runner := ddocker.UpCmd{Configs: []string{"web_only"}}
+		err := runner.Run(cli, &ctx)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("timed out after 0s waiting for data to be ready (running, starting)"))
+		Expect(ranAt("docker run", "--name web_only")).To(Equal(-1))
+	})
+
+	It("fails on dependency cycles", func() {
+		os.WriteFile(testDir+"/data.yml", []byte("extends: base\ndepends_on:\n  - sidekiq\n"), 0644)
+		runner := ddocker.UpCmd{All: true}
+		err := runner.Run(cli, &ctx)
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitConfig))
+		Expect(err.Error()).To(ContainSubstring("data -> sidekiq -> web_only -> data"))
+		Expect(RanCmds).To(BeEmpty())
+	})
+
+	It("stops dependents first, and only the configs named", func() {
+		// containers exist
+		CmdOutputResponse = []byte("abc123\n")
+		runner := ddocker.DownCmd{All: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		sidekiq := ranAt("docker stop --time 600 sidekiq")
+		web := ranAt("docker stop --time 600 web_only")
+		data := ranAt("docker stop --time 600 data")
+		Expect(sidekiq).To(BeNumerically(">=", 0))
+		Expect(web).To(BeNumerically(">", sidekiq))
+		Expect(data).To(BeNumerically(">", web))
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponse = []byte("abc123\n")
+		runner = ddocker.DownCmd{Configs: []string{"web_only"}}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(ranAt("docker stop --time 600 web_only")).To(BeNumerically(">=", 0))
+		Expect(ranAt("docker stop --time 600 data")).To(Equal(-1))
+	})
+
+	It("rebuilds all configs, dependencies first", func() {
+		runner := ddocker.RebuildCmd{All: true}
+		err := runner.Run(cli, &ctx)
+		Expect(err).To(BeNil())
+		data := ranAt("docker build", "local_discourse/data")
+		web := ranAt("docker build", "local_discourse/web_only")
+		Expect(data).To(BeNumerically(">=", 0))
+		Expect(web).To(BeNumerically(">", ranAt("docker inspect --type container data")))
+		Expect(ranAt("docker build", "local_discourse/sidekiq")).To(BeNumerically(">", web))
+	})
+
+	It("cleans up once, after rebuilding all configs", func() {
+		runner := ddocker.RebuildCmd{All: true, Clean: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		prune := ranAt("docker image prune")
+		Expect(prune).To(BeNumerically(">", ranAt("docker build", "local_discourse/sidekiq")))
+		Expect(slices.IndexFunc(RanCmds[prune+1:], func(cmd exec.Cmd) bool {
+			return strings.Contains(cmd.String(), "docker image prune")
+		})).To(Equal(-1))
+	})
+})
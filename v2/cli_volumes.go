@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+/*
+ * volumes
+ */
+type VolumesCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Create bool   `name:"create" help:"Create missing host directories and named volumes."`
+}
+
+func (r *VolumesCmd) Run(cli *Cli, ctx *context.Context) error {
+	conf, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir, cli.Namespace)
+	if err != nil {
+		return configLoadError(err)
+	}
+	table := tabwriter.NewWriter(utils.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TYPE\tSOURCE\tGUEST\tOPTIONS\tSTATUS")
+	for _, v := range conf.Volumes {
+		status, err := r.volumeStatus(cli, v.Volume)
+		if err != nil {
+			table.Flush()
+			return err
+		}
+		options := strings.Join(v.Volume.MountOptions(), ",")
+		if options == "" {
+			options = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", v.Volume.Kind(), v.Volume.Source(), v.Volume.Guest, options, status)
+	}
+	return table.Flush()
+}
+
+// volumeStatus reports whether a volume's host directory or named volume exists, creating it with --create.
+func (r *VolumesCmd) volumeStatus(cli *Cli, v config.Volume) (string, error) {
+	switch v.Kind() {
+	case config.VolumeTmpfs:
+		return "in memory, emptied when the container stops", nil
+	case config.VolumeNamed:
+		info, err := docker.InspectVolume(v.Name)
+		if err != nil {
+			return "", err
+		}
+		if info != nil {
+			return "exists, " + info.Driver + " driver at " + info.Mountpoint, nil
+		}
+		if !r.Create {
+			return "missing, created when the container starts", nil
+		}
+		if err := docker.CreateVolume(v.Name); err != nil {
+			return "", err
+		}
+		return "created", nil
+	}
+	stat, err := os.Stat(v.Host)
+	switch {
+	case err == nil && stat.IsDir():
+		return "exists", nil
+	case err == nil:
+		return "not a directory", nil
+	case !os.IsNotExist(err):
+		return "", err
+	case !r.Create:
+		return "missing", nil
+	case cli.DryRun:
+		return "missing, not created on dry runs", nil
+	}
+	if err := os.MkdirAll(v.Host, 0755); err != nil {
+		return "", err
+	}
+	return "created", nil
+}
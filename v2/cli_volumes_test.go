@@ -0,0 +1,90 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"os"
+
+	ddocker "github.com/discourse/launcher/v2"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Volumes", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+		os.Mkdir(testDir+"/shared", 0755)
+		os.WriteFile(testDir+"/app.yml", []byte(`base_image: discourse/base
+volumes:
+  - volume:
+      host: `+testDir+`/shared
+      guest: /shared
+  - volume:
+      host: `+testDir+`/log
+      guest: /var/log
+      read_only: true
+  - volume:
+      name: uploads
+      guest: /uploads
+  - volume:
+      name: backups
+      guest: /backups
+  - volume:
+      tmpfs: true
+      guest: /tmp
+`), 0644)
+
+		cli = &ddocker.Cli{
+			ConfDir:      testDir,
+			TemplatesDir: testDir,
+			BuildDir:     testDir + "/tmp",
+		}
+
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputResponse = []byte(`{"Driver": "local", "Mountpoint": "/var/lib/docker/volumes/uploads/_data", "Name": "uploads"}
+{"Driver": "local", "Mountpoint": "/var/lib/docker/volumes/uploads-old/_data", "Name": "uploads-old"}
+`)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("lists volumes and whether they exist", func() {
+		runner := ddocker.VolumesCmd{Config: "app"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`TYPE +SOURCE +GUEST +OPTIONS +STATUS\n`))
+		Expect(out.String()).To(MatchRegexp(`bind +` + testDir + `/shared +/shared +- +exists\n`))
+		Expect(out.String()).To(MatchRegexp(`bind +` + testDir + `/log +/var/log +ro +missing\n`))
+		Expect(out.String()).To(MatchRegexp(`volume +uploads +/uploads +- +exists, local driver at /var/lib/docker/volumes/uploads/_data\n`))
+		Expect(out.String()).To(MatchRegexp(`volume +backups +/backups +- +missing, created when the container starts\n`))
+		Expect(out.String()).To(MatchRegexp(`tmpfs +tmpfs +/tmp +- +in memory`))
+		_, err := os.Stat(testDir + "/log")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("creates missing volumes", func() {
+		runner := ddocker.VolumesCmd{Config: "app", Create: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`bind +` + testDir + `/log +/var/log +ro +created\n`))
+		Expect(out.String()).To(MatchRegexp(`volume +backups +/backups +- +created\n`))
+		Expect(testDir + "/log").To(BeADirectory())
+		GetLastCommand()
+		cmd := GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker volume ls --format {{json .}} --filter name=backups"))
+		cmd = GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker volume create backups"))
+	})
+})
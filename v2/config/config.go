@@ -2,140 +2,352 @@ package config
 
 import (
 	"errors"
-	"fmt"
 	"os"
 	"regexp"
 	"slices"
 	"strings"
 
-	"dario.cat/mergo"
+	"github.com/Wing924/shellwords"
 	"github.com/discourse/launcher/v2/utils"
-
 	"gopkg.in/yaml.v3"
 )
 
 const defaultBootCommand = "/sbin/boot"
 
 type Config struct {
-	Name            string `yaml:-`
+	Name            string `yaml:"-"`
 	rawYaml         []string
-	Base_Image      string            `yaml:,omitempty`
-	Update_Pups     bool              `yaml:,omitempty`
-	Run_Image       string            `yaml:,omitempty`
-	Boot_Command    string            `yaml:,omitempty`
-	No_Boot_Command bool              `yaml:,omitempty`
-	Docker_Args     string            `yaml:,omitempty`
-	Templates       []string          `yaml:templates,omitempty`
-	Expose          []string          `yaml:expose,omitempty`
-	Env             map[string]string `yaml:env,omitempty`
-	Labels          map[string]string `yaml:labels,omitempty`
-	Volumes         []struct {
-		Volume struct {
-			Host  string `yaml:host`
-			Guest string `yaml:guest`
-		} `yaml:volume`
-	} `yaml:volumes,omitempty`
-	Links []struct {
-		Link struct {
-			Name  string `yaml:name`
-			Alias string `yaml:alias`
-		} `yaml:link`
-	} `yaml:links,omitempty`
+	chain           []string
+	Extends         string            `yaml:",omitempty"`
+	Base_Image      string            `yaml:",omitempty"`
+	Update_Pups     bool              `yaml:",omitempty"`
+	Run_Image       string            `yaml:",omitempty"`
+	Boot_Command    string            `yaml:",omitempty"`
+	No_Boot_Command bool              `yaml:",omitempty"`
+	Docker_Args     string            `yaml:",omitempty"`
+	Templates       []string          `yaml:"templates,omitempty"`
+	Expose          []string          `yaml:"expose,omitempty"`
+	Env             map[string]string `yaml:"env,omitempty"`
+	Labels          map[string]string `yaml:"labels,omitempty"`
+	Volumes         []VolumeEntry     `yaml:"volumes,omitempty"`
+	Links           []LinkEntry       `yaml:"links,omitempty"`
+	Networks        []NetworkEntry    `yaml:"networks,omitempty"`
+	// Configs whose containers must be running before this one starts, in addition to linked containers.
+	Depends_On []string `yaml:",omitempty"`
+	// Memory, CPU, and other limits for the container
+	Resources Resources `yaml:"resources,omitempty"`
+	// Env keys with secret values, in addition to utils.KnownSecrets.
+	// They are masked when printed, and not passed to image builds.
+	Secrets []string `yaml:"secrets,omitempty"`
+	// Content loaded for the named config instead of its file, for edits not saved yet
+	unsaved []byte
+}
+
+type VolumeEntry struct {
+	Volume Volume `yaml:"volume"`
+}
+
+// A volume is a host directory, a named docker volume, or a tmpfs mounted in the container.
+type Volume struct {
+	Host  string `yaml:"host,omitempty"`
+	Guest string `yaml:"guest"`
+	// Name of a docker managed volume, mounted instead of a host directory
+	Name  string `yaml:"name,omitempty"`
+	Tmpfs bool   `yaml:"tmpfs,omitempty"`
+	// Mounts the volume read-only, the same as the ro option
+	Read_Only bool `yaml:",omitempty"`
+	// Comma separated mount options, such as z for SELinux labels, or size=64m for a tmpfs
+	Options string `yaml:"options,omitempty"`
+}
+
+// Kinds of volumes
+const (
+	VolumeBind  = "bind"
+	VolumeNamed = "volume"
+	VolumeTmpfs = "tmpfs"
+)
+
+func (v Volume) Kind() string {
+	switch {
+	case v.Tmpfs:
+		return VolumeTmpfs
+	case v.Name != "":
+		return VolumeNamed
+	}
+	return VolumeBind
+}
+
+// Source is the host directory or volume name, or tmpfs.
+func (v Volume) Source() string {
+	switch v.Kind() {
+	case VolumeTmpfs:
+		return "tmpfs"
+	case VolumeNamed:
+		return v.Name
+	}
+	return v.Host
+}
+
+// MountOptions lists the volume's mount options sorted, including ro for read-only volumes.
+func (v Volume) MountOptions() []string {
+	options := []string{}
+	for _, o := range strings.Split(v.Options, ",") {
+		if o = strings.TrimSpace(o); o != "" && !slices.Contains(options, o) {
+			options = append(options, o)
+		}
+	}
+	if v.Read_Only && !slices.Contains(options, "ro") {
+		options = append(options, "ro")
+	}
+	slices.Sort(options)
+	return options
+}
+
+// String is the volume in docker's source:guest[:options] form, with tmpfs as the source of tmpfs mounts.
+func (v Volume) String() string {
+	spec := v.Source() + ":" + v.Guest
+	if options := v.MountOptions(); len(options) > 0 {
+		spec += ":" + strings.Join(options, ",")
+	}
+	return spec
+}
+
+func (v Volume) validate() error {
+	sources := 0
+	for _, set := range []bool{v.Host != "", v.Name != "", v.Tmpfs} {
+		if set {
+			sources++
+		}
+	}
+	switch {
+	case v.Guest == "":
+		return errors.New("volume " + v.Source() + " has no guest path to mount it at")
+	case sources != 1:
+		return errors.New("volume " + v.Guest + " needs exactly one of host, name, or tmpfs")
+	case v.Name != "" && strings.ContainsAny(v.Name, "/:"):
+		return errors.New("volume " + v.Guest + " has an invalid name " + v.Name + ", use host for host directories")
+	}
+	return nil
+}
+
+type LinkEntry struct {
+	Link Link `yaml:"link"`
+}
+
+type Link struct {
+	Name  string `yaml:"name"`
+	Alias string `yaml:"alias"`
+}
+
+type NetworkEntry struct {
+	Network Network `yaml:"network"`
+}
+
+// A user-defined bridge network the container is attached to.
+// Other containers on the network reach it by its name, or by its alias when set.
+type Network struct {
+	Name  string `yaml:"name"`
+	Alias string `yaml:"alias,omitempty"`
 }
 
 func (config *Config) loadTemplate(templateDir string, template string) error {
-	template_filename := strings.TrimRight(templateDir, "/") + "/" + string(template)
-	content, err := os.ReadFile(template_filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("template file does not exist: " + template_filename)
+	var content []byte
+	var err error
+	template_filename := template
+	if isRemoteTemplate(template) {
+		content, err = fetchRemoteTemplate(template)
+		if err != nil {
+			utils.LogError(err.Error())
+			return err
+		}
+	} else {
+		template_filename = strings.TrimRight(templateDir, "/") + "/" + string(template)
+		content, err = os.ReadFile(template_filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				utils.LogError("template file does not exist: " + template_filename)
+			}
+			return err
 		}
-		return err
 	}
-	templateConfig := &Config{}
-	if err := yaml.Unmarshal(content, templateConfig); err != nil {
+	templateConfig, opts, raw, err := parseConfigFile(content)
+	if err != nil {
 		return err
 	}
-	if err := mergo.Merge(config, templateConfig, mergo.WithOverride); err != nil {
+	if err := config.merge(templateConfig, opts); err != nil {
 		return err
 	}
-	config.rawYaml = append(config.rawYaml, string(content[:]))
+	config.rawYaml = append(config.rawYaml, raw)
+	config.chain = append(config.chain, template_filename)
 	return nil
 }
 
-func LoadConfig(dir string, configName string, includeTemplates bool, templatesDir string) (*Config, error) {
-	config := &Config{
-		Name:         configName,
-		Boot_Command: defaultBootCommand,
-	}
-
+// loadConfigFile merges a config file, along with any config it extends and
+// its templates, on top of the current config.
+// Extended configs are merged first, so the extending config takes precedence.
+func (config *Config) loadConfigFile(dir string, configName string, includeTemplates bool, templatesDir string, seen []string) error {
 	matched, _ := regexp.MatchString("[[:upper:]/ !@#$%^&*()+~`=]", configName)
 
 	if matched {
-		msg := "ERROR: Config name '" + configName + "' must not contain upper case characters, spaces or special characters. Correct config name and rerun."
-		fmt.Println(msg)
-		return nil, errors.New(msg)
+		msg := "Config name '" + configName + "' must not contain upper case characters, spaces or special characters. Correct config name and rerun."
+		utils.LogError(msg)
+		return errors.New("ERROR: " + msg)
+	}
+
+	if slices.Contains(seen, configName) {
+		msg := "Config '" + configName + "' extends itself: " + strings.Join(append(seen, configName), " -> ")
+		utils.LogError(msg)
+		return errors.New("ERROR: " + msg)
 	}
+	seen = append(seen, configName)
 
-	config_filename := string(strings.TrimRight(dir, "/") + "/" + config.Name + ".yml")
-	content, err := os.ReadFile(config_filename)
+	config_filename := string(strings.TrimRight(dir, "/") + "/" + configName + ".yml")
+	var content []byte
+	var err error
+	if configName == config.Name && config.unsaved != nil {
+		content = config.unsaved
+	} else {
+		content, err = os.ReadFile(config_filename)
+	}
 
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Println("config file does not exist: " + config_filename)
+			utils.LogError("config file does not exist: " + config_filename)
 		}
-		return nil, err
+		return err
 	}
 
-	baseConfig := &Config{}
+	baseConfig, opts, raw, err := parseConfigFile(content)
 
-	if err := yaml.Unmarshal(content, baseConfig); err != nil {
-		return nil, err
+	if err != nil {
+		return err
+	}
+
+	if baseConfig.Extends != "" {
+		extends := strings.TrimSuffix(baseConfig.Extends, ".yml")
+		if err := config.loadConfigFile(dir, extends, includeTemplates, templatesDir, seen); err != nil {
+			return err
+		}
 	}
 
 	if includeTemplates {
 		for _, t := range baseConfig.Templates {
 			if err := config.loadTemplate(templatesDir, t); err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
 
-	if err := mergo.Merge(config, baseConfig, mergo.WithOverride); err != nil {
-		return nil, err
+	if err := config.merge(baseConfig, opts); err != nil {
+		return err
 	}
 
-	config.rawYaml = append(config.rawYaml, string(content[:]))
+	config.rawYaml = append(config.rawYaml, raw)
+	config.chain = append(config.chain, config_filename)
+	return nil
+}
 
-	if err != nil {
-		return nil, err
+func LoadConfig(dir string, configName string, includeTemplates bool, templatesDir string, namespace string) (*Config, error) {
+	return loadConfig(dir, configName, includeTemplates, templatesDir, namespace, nil)
+}
+
+// loadConfig loads a config, with content in place of its file when set.
+func loadConfig(dir string, configName string, includeTemplates bool, templatesDir string, namespace string, content []byte) (*Config, error) {
+	config := &Config{
+		Name:         configName,
+		Boot_Command: defaultBootCommand,
+		unsaved:      content,
 	}
 
-	for k, v := range config.Labels {
-		val := strings.ReplaceAll(v, "{{config}}", config.Name)
-		config.Labels[k] = val
+	if err := config.loadConfigFile(dir, configName, includeTemplates, templatesDir, []string{}); err != nil {
+		return nil, err
 	}
 
-	for k, v := range config.Env {
-		val := strings.ReplaceAll(v, "{{config}}", config.Name)
-		config.Env[k] = val
+	if err := config.interpolate(namespace); err != nil {
+		utils.LogError(err.Error())
+		return nil, utils.NewError(utils.ErrConfig, err.Error(), err)
 	}
+	utils.AddSecretKeys(config.Secrets...)
+	utils.LogDebug("loaded config " + config.Name + " from: " + strings.Join(config.chain, ", "))
 
 	if config.Base_Image == "" {
 		return nil, errors.New("No base image specified in config! Set base image with `base_image: {imagename}`")
 	}
 
+	for _, v := range config.Volumes {
+		if err := v.Volume.validate(); err != nil {
+			utils.LogError(err.Error())
+			return nil, err
+		}
+	}
+
+	if _, err := ParseDockerArgs(config.Docker_Args); err != nil {
+		err = errors.New("docker_args: " + err.Error())
+		utils.LogError(err.Error())
+		return nil, err
+	}
+
+	if err := config.Resources.validate(); err != nil {
+		utils.LogError(err.Error())
+		return nil, err
+	}
+
+	if err := config.Resources.checkDockerArgs(config.DockerArgs()); err != nil {
+		utils.LogError(err.Error())
+		return nil, err
+	}
+
 	return config, nil
 }
 
+// MergeChain lists the template and config files merged into this config, in merge order.
+func (config *Config) MergeChain() []string {
+	return config.chain
+}
+
+// Yaml is the config as pups reads it: the pups settings of each merged file, in merge order,
+// followed by launcher's settings as merged and interpolated, so pups sees the same env as launcher.
 func (config *Config) Yaml() string {
-	return strings.Join(config.rawYaml, "_FILE_SEPERATOR_")
+	docs := []string{}
+	for _, raw := range config.rawYaml {
+		docs = append(docs, withoutLauncherKeys(raw))
+	}
+	merged := *config
+	merged.Extends = ""
+	out, _ := yaml.Marshal(&merged)
+	docs = append(docs, string(out[:]))
+	return strings.Join(docs, "_FILE_SEPERATOR_")
+}
+
+// withoutLauncherKeys removes launcher's settings from a file's yaml, keeping the file as is when it has none.
+func withoutLauncherKeys(raw string) string {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(raw), doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return raw
+	}
+	root := doc.Content[0]
+	kept := []*yaml.Node{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if !slices.Contains(launcherKeys, root.Content[i].Value) {
+			kept = append(kept, root.Content[i], root.Content[i+1])
+		}
+	}
+	if len(kept) == len(root.Content) {
+		return raw
+	}
+	root.Content = kept
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return raw
+	}
+	return string(out[:])
 }
 
 func (config *Config) Dockerfile(pupsArgs string, bakeEnv bool) string {
 	builder := strings.Builder{}
 	builder.WriteString("ARG dockerfile_from_image=" + config.Base_Image + "\n")
 	builder.WriteString("FROM ${dockerfile_from_image}\n")
+	builder.WriteString("LABEL " + BuildHashLabel + "=" + config.BuildHash() + "\n")
 	builder.WriteString(config.dockerfileArgs() + "\n")
 	if bakeEnv {
 		builder.WriteString(config.dockerfileEnvs() + "\n")
@@ -167,10 +379,22 @@ func (config *Config) BootCommand() string {
 	}
 }
 
+// Redacted copies the config with secret env values masked, for printing.
+func (config *Config) Redacted() *Config {
+	redacted := *config
+	if config.Env != nil {
+		redacted.Env = map[string]string{}
+		for k, v := range config.Env {
+			redacted.Env[k] = utils.RedactValue(k, v)
+		}
+	}
+	return &redacted
+}
+
 func (config *Config) EnvArray(includeKnownSecrets bool) []string {
 	envs := []string{}
 	for k, v := range config.Env {
-		if !includeKnownSecrets && slices.Contains(utils.KnownSecrets, k) {
+		if !includeKnownSecrets && (slices.Contains(utils.KnownSecrets, k) || slices.Contains(config.Secrets, k)) {
 			continue
 		}
 		envs = append(envs, k+"="+v)
@@ -179,8 +403,108 @@ func (config *Config) EnvArray(includeKnownSecrets bool) []string {
 	return envs
 }
 
+// Dependencies lists the containers this config's container needs running first:
+// its depends_on, and the containers it links to.
+func (config *Config) Dependencies() []string {
+	deps := slices.Clone(config.Depends_On)
+	for _, l := range config.Links {
+		if !slices.Contains(deps, l.Link.Name) {
+			deps = append(deps, l.Link.Name)
+		}
+	}
+	return deps
+}
+
+// Network containers with links join, where linked containers are reached by their link alias.
+// Docker's --link is deprecated, so links are run as network aliases instead.
+const LinkNetwork = "discourse"
+
+// NetworkAliases lists the config's networks in order, each with the aliases the container has on it.
+// A network may be listed several times with different aliases. Configs with links are on LinkNetwork.
+func (config *Config) NetworkAliases() ([]string, map[string][]string) {
+	names := []string{}
+	aliases := map[string][]string{}
+	for _, n := range config.Networks {
+		if !slices.Contains(names, n.Network.Name) {
+			names = append(names, n.Network.Name)
+		}
+		if n.Network.Alias != "" && !slices.Contains(aliases[n.Network.Name], n.Network.Alias) {
+			aliases[n.Network.Name] = append(aliases[n.Network.Name], n.Network.Alias)
+		}
+	}
+	if len(config.Links) > 0 && !slices.Contains(names, LinkNetwork) {
+		names = append(names, LinkNetwork)
+	}
+	return names, aliases
+}
+
+// DockerArgs splits docker_args as a shell would, checked when the config loads.
 func (config *Config) DockerArgs() []string {
-	return strings.Fields(config.Docker_Args)
+	args, _ := ParseDockerArgs(config.Docker_Args)
+	return args
+}
+
+// docker run flags launcher sets itself
+var managedDockerArgs = []string{"--name", "--restart", "--detach", "-d"}
+
+// docker run flags that take no value, any other flag takes the next word unless written as --flag=value
+var booleanDockerArgs = []string{
+	"--disable-content-trust", "--help", "--init", "--interactive", "--no-healthcheck", "--oom-kill-disable",
+	"--privileged", "--publish-all", "--quiet", "--read-only", "--rm", "--sig-proxy", "--tty", "--use-api-socket",
+}
+
+// short docker run flags that take no value, which may be bundled, such as -it
+const booleanShortDockerArgs = "itPqd"
+
+// ParseDockerArgs splits extra docker run arguments as a shell would, keeping quoted spaces.
+// Flags launcher sets itself, such as --name, are an error. Flag values, such as FOO=--rm in
+// -e FOO=--rm, are not flags.
+func ParseDockerArgs(args string) ([]string, error) {
+	words, err := shellwords.Split(args)
+	if err != nil {
+		return nil, errors.New("unable to parse " + args + ": " + err.Error())
+	}
+	for _, flag := range dockerArgFlags(words) {
+		if slices.Contains(managedDockerArgs, flag) {
+			return nil, errors.New(flag + " is set by launcher, and cannot be passed as a docker arg")
+		}
+	}
+	return words, nil
+}
+
+// dockerArgFlags lists the flags in docker run arguments, skipping their values.
+// Bundled short flags are listed one by one, so -itd lists -i, -t, and -d.
+func dockerArgFlags(words []string) []string {
+	flags := []string{}
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if word == "--" {
+			break
+		}
+		if !strings.HasPrefix(word, "-") || word == "-" {
+			continue
+		}
+		flag, _, hasValue := strings.Cut(word, "=")
+		if strings.HasPrefix(flag, "--") {
+			flags = append(flags, flag)
+			if !hasValue && !slices.Contains(booleanDockerArgs, flag) {
+				i++
+			}
+			continue
+		}
+		// short flags, bundled booleans followed by at most one flag taking a value,
+		// which is the rest of the word, such as -p80:80, or the next word
+		for j, c := range word[1:] {
+			flags = append(flags, "-"+string(c))
+			if !strings.ContainsRune(booleanShortDockerArgs, c) {
+				if j+len(string(c)) == len(word)-1 {
+					i++
+				}
+				break
+			}
+		}
+	}
+	return flags
 }
 
 func (config *Config) dockerfileEnvs() string {
@@ -14,16 +14,16 @@ var _ = Describe("Config", func() {
 	var conf *config.Config
 	BeforeEach(func() {
 		testDir, _ = os.MkdirTemp("", "ddocker-test")
-		conf, _ = config.LoadConfig("../test/containers", "test", true, "../test")
+		conf, _ = config.LoadConfig("../test/containers", "test", true, "../test", "")
 	})
 	AfterEach(func() {
 		os.RemoveAll(testDir)
 	})
 	It("should be able to run LoadConfig to load yaml configuration", func() {
-		conf, err := config.LoadConfig("../test/containers", "test", true, "../test")
+		conf, err := config.LoadConfig("../test/containers", "test", true, "../test", "")
 		Expect(err).To(BeNil())
 		result := conf.Yaml()
-		Expect(result).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
+		Expect(result).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: me@example.com,you@example.com"))
 		Expect(result).To(ContainSubstring("_FILE_SEPERATOR_"))
 		Expect(result).To(ContainSubstring("version: tests-passed"))
 	})
@@ -34,7 +34,7 @@ var _ = Describe("Config", func() {
 		out, err := os.ReadFile(testDir + "/config.yaml")
 		Expect(err).To(BeNil())
 		Expect(strings.Contains(string(out[:]), ""))
-		Expect(string(out[:])).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
+		Expect(string(out[:])).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: me@example.com,you@example.com"))
 	})
 
 	It("can convert pups config to dockerfile format", func() {
@@ -42,6 +42,24 @@ var _ = Describe("Config", func() {
 		Expect(dockerfile).To(ContainSubstring("ARG DISCOURSE_DEVELOPER_EMAILS"))
 		Expect(dockerfile).To(ContainSubstring("RUN cat /temp-config.yaml"))
 		Expect(dockerfile).To(ContainSubstring("EXPOSE 80"))
+		Expect(dockerfile).To(ContainSubstring("LABEL org.discourse.launcher.build-hash=" + conf.BuildHash()))
+	})
+
+	It("hashes build and env settings separately", func() {
+		other, _ := config.LoadConfig("../test/containers", "test", true, "../test", "")
+		Expect(other.BuildHash()).To(Equal(conf.BuildHash()))
+		Expect(other.EnvHash()).To(Equal(conf.EnvHash()))
+
+		other.Env["DISCOURSE_HOSTNAME"] = "changed.example.com"
+		Expect(other.BuildHash()).To(Equal(conf.BuildHash()))
+		Expect(other.EnvHash()).ToNot(Equal(conf.EnvHash()))
+
+		other.Base_Image = "discourse/base:changed"
+		Expect(other.BuildHash()).ToNot(Equal(conf.BuildHash()))
+
+		webOnly, _ := config.LoadConfig("../test/containers", "web_only", true, "../test", "")
+		// test adds a custom run command
+		Expect(webOnly.BuildHash()).ToNot(Equal(conf.BuildHash()))
 	})
 
 	Context("hostname tests", func() {
@@ -59,8 +77,185 @@ var _ = Describe("Config", func() {
 		})
 	})
 	It("should error if no base config LoadConfig to load yaml configuration", func() {
-		_, err := config.LoadConfig("../test/containers", "test-no-base-image", true, "../test")
+		_, err := config.LoadConfig("../test/containers", "test-no-base-image", true, "../test", "")
 		Expect(err).ToNot(BeNil())
 		Expect(err.Error()).To(Equal("No base image specified in config! Set base image with `base_image: {imagename}`"))
 	})
+
+	It("loads named, read-only, and tmpfs volumes", func() {
+		os.WriteFile(testDir+"/app.yml", []byte(`base_image: discourse/base
+volumes:
+  - volume:
+      host: /var/discourse/shared/app
+      guest: /shared
+      options: z
+  - volume:
+      name: uploads
+      guest: /uploads
+      read_only: true
+      options: ro,nocopy
+  - volume:
+      tmpfs: true
+      guest: /tmp
+      options: size=64m
+`), 0644)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		specs := []string{}
+		for _, v := range conf.Volumes {
+			specs = append(specs, v.Volume.Kind()+" "+v.Volume.String())
+		}
+		Expect(specs).To(Equal([]string{
+			"bind /var/discourse/shared/app:/shared:z",
+			"volume uploads:/uploads:nocopy,ro",
+			"tmpfs tmpfs:/tmp:size=64m",
+		}))
+	})
+
+	It("errors on volumes without exactly one source", func() {
+		for _, volume := range []string{
+			"host: /var/discourse/shared/app\n      name: shared\n      guest: /shared",
+			"host: /var/discourse/shared/app",
+			"guest: /shared",
+			"name: ../shared\n      guest: /shared",
+		} {
+			os.WriteFile(testDir+"/app.yml", []byte("base_image: discourse/base\nvolumes:\n  - volume:\n      "+volume+"\n"), 0644)
+			_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).ToNot(BeNil(), volume)
+		}
+	})
+
+	It("loads and validates resources", func() {
+		os.WriteFile(testDir+"/app.yml", []byte(`base_image: discourse/base
+resources:
+  memory: 4g
+  memory_swap: 6G
+  cpus: 1.5
+  pids_limit: 500
+  shm_size: 1g
+  ulimits:
+    nofile: 65535
+    memlock: -1
+`), 0644)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Resources.RunArgs()).To(Equal([]string{
+			"--shm-size=1g", "--memory=4g", "--memory-swap=6G", "--cpus=1.5", "--pids-limit=500",
+			"--ulimit=memlock=-1:-1", "--ulimit=nofile=65535:65535",
+		}))
+		Expect(conf.Resources.BuildArgs()).To(Equal([]string{"--shm-size=1g", "--ulimit=memlock=-1:-1", "--ulimit=nofile=65535:65535"}))
+
+		for _, resources := range []string{
+			"memory: 4 gigs",
+			"memory: 1m",
+			"memory_swap: 2g",
+			"memory: 4g\n  memory_swap: 2g",
+			"cpus: 0",
+			"pids_limit: -2",
+			"ulimits:\n    files: 1024",
+			"ulimits:\n    nofile: 2048:1024",
+		} {
+			os.WriteFile(testDir+"/app.yml", []byte("base_image: discourse/base\nresources:\n  "+resources+"\n"), 0644)
+			_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).ToNot(BeNil(), resources)
+		}
+	})
+
+	It("splits docker args as a shell would", func() {
+		args, err := config.ParseDockerArgs(`--log-opt tag="discourse app" --label 'a=b c' --cpus 2`)
+		Expect(err).To(BeNil())
+		Expect(args).To(Equal([]string{"--log-opt", "tag=discourse app", "--label", "a=b c", "--cpus", "2"}))
+
+		for _, args := range []string{"--name other", "--name=other", "--restart always", "--detach", "-d", "-itd", `--label "unterminated`} {
+			_, err := config.ParseDockerArgs(args)
+			Expect(err).ToNot(BeNil(), args)
+		}
+		args, err = config.ParseDockerArgs("-it --log-driver json-file")
+		Expect(err).To(BeNil())
+		Expect(args).To(Equal([]string{"-it", "--log-driver", "json-file"}))
+
+		// values are not flags, even when they look like one
+		for _, args := range []string{"--label x=-d", "-e FOO=--rm", "-e --name", "-it -e -d", "--log-opt=tag", "-p80:80 --rm"} {
+			_, err := config.ParseDockerArgs(args)
+			Expect(err).To(BeNil(), args)
+		}
+		for _, args := range []string{"-p80:80 -d", "-e FOO --detach", "--rm --name x", "--label=a -d", "-ti -d"} {
+			_, err := config.ParseDockerArgs(args)
+			Expect(err).ToNot(BeNil(), args)
+		}
+
+		os.WriteFile(testDir+"/app.yml", []byte("base_image: discourse/base\ndocker_args: --name forum\n"), 0644)
+		_, err = config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("docker_args: --name is set by launcher"))
+	})
+
+	It("refuses docker args setting limits when resources are set", func() {
+		for _, args := range []string{"--memory 2g", "-m=2g", "--cpus=2", "--shm-size 1g", "--ulimit nofile=1024"} {
+			os.WriteFile(testDir+"/app.yml", []byte("base_image: discourse/base\nresources:\n  memory: 4g\ndocker_args: "+args+"\n"), 0644)
+			_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).ToNot(BeNil(), args)
+			Expect(err.Error()).To(ContainSubstring("conflicts with resources"))
+		}
+		os.WriteFile(testDir+"/app.yml", []byte("base_image: discourse/base\nresources:\n  memory: 4g\ndocker_args: --label limit=--memory\n"), 0644)
+		_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+
+		// without resources, docker args still set limits
+		os.WriteFile(testDir+"/app.yml", []byte("base_image: discourse/base\ndocker_args: --shm-size 1g\n"), 0644)
+		_, err = config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+	})
+
+	It("defaults shared memory to 512m", func() {
+		Expect(config.Resources{}.RunArgs()).To(Equal([]string{"--shm-size=512m"}))
+	})
+
+	Context("extending configs", func() {
+		writeConfig := func(name string, content string) {
+			err := os.WriteFile(testDir+"/"+name+".yml", []byte(content), 0644)
+			Expect(err).To(BeNil())
+		}
+
+		It("merges the extended config first", func() {
+			conf, err := config.LoadConfig("../test/containers", "web_only_extended", true, "../test", "")
+			Expect(err).To(BeNil())
+			Expect(conf.Env["DISCOURSE_HOSTNAME"]).To(Equal("extended.example.com"))
+			Expect(conf.Env["UNICORN_WORKERS"]).To(Equal("8"))
+			Expect(conf.Env["DISCOURSE_DB_HOST"]).To(Equal("data"))
+			Expect(conf.Links[0].Link.Name).To(Equal("data"))
+			Expect(conf.MergeChain()).To(Equal([]string{
+				"../test/templates/web.template.yml",
+				"../test/containers/web_only.yml",
+				"../test/containers/web_only_extended.yml",
+			}))
+			Expect(strings.Index(conf.Yaml(), "extended.example.com")).To(BeNumerically(">", strings.Index(conf.Yaml(), "discourse.example.com")))
+		})
+
+		It("errors on extends cycles", func() {
+			writeConfig("a", "base_image: discourse/base\nextends: b\n")
+			writeConfig("b", "extends: c\n")
+			writeConfig("c", "extends: a\n")
+			_, err := config.LoadConfig(testDir, "a", true, testDir, "")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("a -> b -> c -> a"))
+		})
+
+		It("lists dependencies from depends_on and links, merged with the extended config's", func() {
+			writeConfig("base", "base_image: discourse/base\ndepends_on:\n  - redis\n")
+			writeConfig("web", "extends: base\ndepends_on:\n  - data\nlinks:\n  - link:\n      name: data\n      alias: data\n  - link:\n      name: mail\n      alias: mail\n")
+			conf, err := config.LoadConfig(testDir, "web", true, testDir, "")
+			Expect(err).To(BeNil())
+			Expect(conf.Dependencies()).To(Equal([]string{"redis", "data", "mail"}))
+			// not part of the pups config baked into images
+			Expect(conf.BuildHash()).To(Equal((&config.Config{Base_Image: "discourse/base"}).BuildHash()))
+		})
+
+		It("errors when the extended config does not exist", func() {
+			writeConfig("a", "base_image: discourse/base\nextends: missing\n")
+			_, err := config.LoadConfig(testDir, "a", true, testDir, "")
+			Expect(err).ToNot(BeNil())
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
 })
@@ -0,0 +1,264 @@
+package config
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/discourse/launcher/v2/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Keys launcher reads from config yaml, everything else is only used by pups.
+var launcherKeys = []string{
+	"base_image", "update_pups", "run_image", "boot_command", "no_boot_command", "docker_args",
+	"templates", "expose", "env", "labels", "volumes", "links", "networks", "depends_on", "resources", "extends", "merge", "secrets",
+}
+
+// Difference is a single setting that differs between two configs.
+type Difference struct {
+	Field string
+	Key   string
+	Old   string
+	New   string
+	// Rebuild is set when the image must be rebuilt to apply the difference.
+	// Otherwise recreating the container from the current image is enough.
+	Rebuild bool
+}
+
+func (d Difference) String() string {
+	name := d.Field
+	if d.Key != "" {
+		name = d.Field + " " + d.Key
+	}
+	switch {
+	case d.Old == "" && d.New == "":
+		return "~ " + name + ": changed"
+	case d.Old == "":
+		return "+ " + name + ": " + d.New
+	case d.New == "":
+		return "- " + name + ": " + d.Old
+	default:
+		return "~ " + name + ": " + d.Old + " -> " + d.New
+	}
+}
+
+// Redacted masks secret env values.
+func (d Difference) Redacted() Difference {
+	if d.Field != "env" {
+		return d
+	}
+	// set-but-empty values are shown as ""
+	if d.Old != `""` {
+		d.Old = utils.RedactValue(d.Key, d.Old)
+	}
+	if d.New != `""` {
+		d.New = utils.RedactValue(d.Key, d.New)
+	}
+	return d
+}
+
+// Diff compares config a against config b.
+func Diff(a *Config, b *Config) []Difference {
+	diffs := []Difference{}
+	diffs = append(diffs, diffScalar("base_image", a.Base_Image, b.Base_Image, true)...)
+	diffs = append(diffs, diffScalar("boot_command", a.BootCommand(), b.BootCommand(), true)...)
+	diffs = append(diffs, diffList("templates", a.Templates, b.Templates, true, false)...)
+	diffs = append(diffs, diffPups(a, b)...)
+	diffs = append(diffs, diffMap("env", a.Env, b.Env, true, false)...)
+	diffs = append(diffs, diffScalar("run_image", a.RunImage(), b.RunImage(), false)...)
+	diffs = append(diffs, diffScalar("docker_args", a.Docker_Args, b.Docker_Args, false)...)
+	diffs = append(diffs, diffMap("labels", a.Labels, b.Labels, false, false)...)
+	diffs = append(diffs, diffList("expose", a.Expose, b.Expose, false, false)...)
+	diffs = append(diffs, diffList("volumes", a.volumeList(), b.volumeList(), false, false)...)
+	diffs = append(diffs, diffList("links", a.linkList(), b.linkList(), false, false)...)
+	diffs = append(diffs, diffList("networks", a.networkList(), b.networkList(), false, false)...)
+	diffs = append(diffs, diffList("resources", a.resourceList(), b.resourceList(), false, false)...)
+	return diffs
+}
+
+// Env rebuild overrides when starting a container whose image was already migrated or precompiled.
+var rebuildEnv = []string{"MIGRATE_ON_BOOT", "PRECOMPILE_ON_BOOT"}
+
+// DiffRunning compares a config against the settings of a running container.
+// The container's env and labels also include those from its image, so only
+// keys set in the config are compared. Whether an image rebuild is needed is
+// told by its build hash label instead, so no difference is marked Rebuild.
+func DiffRunning(conf *Config, running *Config) []Difference {
+	diffs := []Difference{}
+	for _, d := range diffMap("env", running.Env, conf.Env, false, true) {
+		if slices.Contains(rebuildEnv, d.Key) && running.Env[d.Key] == "0" {
+			continue
+		}
+		diffs = append(diffs, d)
+	}
+	diffs = append(diffs, diffScalar("run_image", running.Run_Image, conf.RunImage(), false)...)
+	diffs = append(diffs, diffMap("labels", running.Labels, conf.Labels, false, true)...)
+	diffs = append(diffs, diffList("expose", running.publishedPorts(), conf.publishedPorts(), false, false)...)
+	diffs = append(diffs, diffList("expose", running.Expose, conf.exposedPorts(), false, true)...)
+	diffs = append(diffs, diffList("volumes", running.volumeList(), conf.volumeList(), false, false)...)
+	// containers no longer run with --link, links are compared as the networks they join
+	diffs = append(diffs, diffList("networks", running.networkList(), conf.networkList(), false, false)...)
+	diffs = append(diffs, diffList("resources", running.resourceList(), conf.resourceList(), false, false)...)
+	return diffs
+}
+
+// NeedsRebuild reports whether any of the differences require an image rebuild.
+func NeedsRebuild(diffs []Difference) bool {
+	return slices.ContainsFunc(diffs, func(d Difference) bool { return d.Rebuild })
+}
+
+func diffScalar(field string, before string, after string, rebuild bool) []Difference {
+	if before == after {
+		return nil
+	}
+	return []Difference{{Field: field, Old: before, New: after, Rebuild: rebuild}}
+}
+
+// diffList reports removed entries followed by added entries.
+// When partial, entries only present in before are not reported.
+func diffList(field string, before []string, after []string, rebuild bool, partial bool) []Difference {
+	diffs := []Difference{}
+	if !partial {
+		for _, v := range before {
+			if !slices.Contains(after, v) {
+				diffs = append(diffs, Difference{Field: field, Old: v, Rebuild: rebuild})
+			}
+		}
+	}
+	for _, v := range after {
+		if !slices.Contains(before, v) {
+			diffs = append(diffs, Difference{Field: field, New: v, Rebuild: rebuild})
+		}
+	}
+	return diffs
+}
+
+// diffMap reports differences sorted by key.
+// When partial, keys only present in before are not reported.
+func diffMap(field string, before map[string]string, after map[string]string, rebuild bool, partial bool) []Difference {
+	keys := []string{}
+	for k := range after {
+		keys = append(keys, k)
+	}
+	if !partial {
+		for k := range before {
+			if _, ok := after[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+	}
+	slices.Sort(keys)
+	diffs := []Difference{}
+	for _, k := range keys {
+		beforeVal, beforeOk := before[k]
+		afterVal, afterOk := after[k]
+		if beforeOk == afterOk && beforeVal == afterVal {
+			continue
+		}
+		d := Difference{Field: field, Key: k, Old: beforeVal, New: afterVal, Rebuild: rebuild}
+		// show set-but-empty values, so they are not mistaken for missing ones
+		if beforeOk && beforeVal == "" {
+			d.Old = `""`
+		}
+		if afterOk && afterVal == "" {
+			d.New = `""`
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+func (config *Config) volumeList() []string {
+	volumes := []string{}
+	for _, v := range config.Volumes {
+		volumes = append(volumes, v.Volume.String())
+	}
+	return volumes
+}
+
+func (config *Config) linkList() []string {
+	links := []string{}
+	for _, v := range config.Links {
+		links = append(links, v.Link.Name+":"+v.Link.Alias)
+	}
+	return links
+}
+
+// networkList lists networks as name:alias, or just the name for networks without aliases.
+func (config *Config) networkList() []string {
+	networks := []string{}
+	names, aliases := config.NetworkAliases()
+	for _, name := range names {
+		if len(aliases[name]) == 0 {
+			networks = append(networks, name)
+		}
+		for _, alias := range aliases[name] {
+			networks = append(networks, name+":"+alias)
+		}
+	}
+	return networks
+}
+
+// publishedPorts lists expose entries published to the host, as [ip:]hostPort:containerPort
+func (config *Config) publishedPorts() []string {
+	ports := []string{}
+	for _, p := range config.Expose {
+		if strings.Contains(p, ":") {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+// exposedPorts lists expose entries only exposed to linked containers
+func (config *Config) exposedPorts() []string {
+	ports := []string{}
+	for _, p := range config.Expose {
+		if !strings.Contains(p, ":") {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+// diffPups reports pups settings, such as hooks, params, or run commands, that differ.
+// Values are not shown as they are often long.
+func diffPups(a *Config, b *Config) []Difference {
+	before, after := a.pupsSettings(), b.pupsSettings()
+	keys := []string{}
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	diffs := []Difference{}
+	for _, k := range keys {
+		if before[k] != after[k] {
+			diffs = append(diffs, Difference{Field: "pups", Key: k, Rebuild: true})
+		}
+	}
+	return diffs
+}
+
+// pupsSettings collects yaml of settings only pups uses, from all merged files, by key.
+func (config *Config) pupsSettings() map[string]string {
+	settings := map[string]string{}
+	for _, raw := range config.rawYaml {
+		doc := map[string]any{}
+		if err := yaml.Unmarshal([]byte(raw), &doc); err != nil {
+			continue
+		}
+		for k, v := range doc {
+			if slices.Contains(launcherKeys, k) {
+				continue
+			}
+			out, _ := yaml.Marshal(v)
+			settings[k] += string(out[:])
+		}
+	}
+	return settings
+}
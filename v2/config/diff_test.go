@@ -0,0 +1,101 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/launcher/v2/config"
+)
+
+var _ = Describe("Diff", func() {
+	var webOnly *config.Config
+
+	BeforeEach(func() {
+		webOnly, _ = config.LoadConfig("../test/containers", "web_only", true, "../test", "")
+	})
+
+	It("finds no differences between identical configs", func() {
+		other, _ := config.LoadConfig("../test/containers", "web_only", true, "../test", "")
+		Expect(config.Diff(webOnly, other)).To(BeEmpty())
+	})
+
+	It("reports container only differences without requiring a rebuild", func() {
+		other, _ := config.LoadConfig("../test/containers", "web_only", true, "../test", "")
+		other.Expose = append(other.Expose, "2222:22")
+		other.Labels = map[string]string{"app": "forum"}
+		other.Networks = []config.NetworkEntry{
+			{Network: config.Network{Name: "discourse"}},
+			{Network: config.Network{Name: "discourse", Alias: "web"}},
+		}
+		diffs := config.Diff(webOnly, other)
+		// web_only joins the discourse network for its links, now with an alias
+		Expect(diffs).To(Equal([]config.Difference{
+			{Field: "labels", Key: "app", New: "forum"},
+			{Field: "expose", New: "2222:22"},
+			{Field: "networks", Old: "discourse"},
+			{Field: "networks", New: "discourse:web"},
+		}))
+		Expect(config.NeedsRebuild(diffs)).To(BeFalse())
+		Expect(diffs[0].String()).To(Equal("+ labels app: forum"))
+	})
+
+	It("compares resources regardless of how sizes are written", func() {
+		other, _ := config.LoadConfig("../test/containers", "web_only", true, "../test", "")
+		webOnly.Resources = config.Resources{Memory: "4096m", Ulimits: map[string]string{"nofile": "1024"}}
+		other.Resources = config.Resources{Memory: "4g", Shm_Size: "1g", Ulimits: map[string]string{"nofile": "1024:1024"}}
+		Expect(config.Diff(webOnly, other)).To(Equal([]config.Difference{
+			{Field: "resources", Old: "shm_size=512m"},
+			{Field: "resources", New: "shm_size=1g"},
+		}))
+	})
+
+	It("requires a rebuild for env, image, and pups changes", func() {
+		test, _ := config.LoadConfig("../test/containers", "test", true, "../test", "")
+		diffs := config.Diff(webOnly, test)
+		Expect(config.NeedsRebuild(diffs)).To(BeTrue())
+		Expect(diffs).To(ContainElement(config.Difference{Field: "pups", Key: "run", Rebuild: true}))
+		Expect(diffs).To(ContainElement(config.Difference{Field: "env", Key: "REPLACED", New: "test/test/test", Rebuild: true}))
+		Expect(diffs).To(ContainElement(config.Difference{Field: "docker_args", New: "--expose 100"}))
+		Expect(diffs).To(ContainElement(config.Difference{Field: "run_image", Old: "local_discourse/web_only", New: "local_discourse/test"}))
+		Expect(diffs).To(ContainElement(config.Difference{Field: "expose", New: "90"}))
+		Expect(config.Difference{Field: "pups", Key: "run", Rebuild: true}.String()).To(Equal("~ pups run: changed"))
+	})
+
+	It("compares a config against a running container", func() {
+		running := &config.Config{
+			Name:      "web_only",
+			Run_Image: "local_discourse/web_only",
+			Env: map[string]string{
+				"PATH":               "/usr/bin",
+				"DISCOURSE_HOSTNAME": "old.example.com",
+			},
+			Labels: map[string]string{"org.opencontainers.image.created": "2025-01-01"},
+			Expose: []string{"80:80", "8443:443", "80", "443"},
+			Volumes: []config.VolumeEntry{
+				{Volume: config.Volume{Host: "/var/discourse/shared/web-only", Guest: "/shared"}},
+				{Volume: config.Volume{Host: "/var/discourse/shared/web-only/log/var-log", Guest: "/var/log"}},
+			},
+			Links: []config.LinkEntry{{Link: config.Link{Name: "data", Alias: "data"}}},
+		}
+		diffs := config.DiffRunning(webOnly, running)
+		Expect(diffs).To(ContainElement(config.Difference{Field: "env", Key: "DISCOURSE_HOSTNAME", Old: "old.example.com", New: "discourse.example.com"}))
+		Expect(config.NeedsRebuild(diffs)).To(BeFalse())
+		Expect(diffs).To(ContainElement(config.Difference{Field: "expose", Old: "8443:443"}))
+		Expect(diffs).To(ContainElement(config.Difference{Field: "expose", New: "443:443"}))
+		// env and labels from the image are not reported
+		Expect(diffs).ToNot(ContainElement(HaveField("Key", "PATH")))
+		Expect(diffs).ToNot(ContainElement(HaveField("Field", "labels")))
+		Expect(diffs).ToNot(ContainElement(HaveField("Field", "volumes")))
+		Expect(diffs).ToNot(ContainElement(HaveField("Field", "links")))
+		Expect(diffs).ToNot(ContainElement(HaveField("Field", "resources")))
+
+		// docker reports sizes in bytes, and swap as twice the memory when unset
+		webOnly.Resources = config.Resources{Memory: "2g", Cpus: "2"}
+		running.Resources = config.Resources{Memory: "2147483648", Memory_Swap: "4294967296", Shm_Size: "536870912", Cpus: "1"}
+		diffs = config.DiffRunning(webOnly, running)
+		Expect(diffs).To(ContainElement(config.Difference{Field: "resources", Old: "cpus=1"}))
+		Expect(diffs).To(ContainElement(config.Difference{Field: "resources", New: "cpus=2"}))
+		Expect(diffs).ToNot(ContainElement(HaveField("Old", "memory=2g")))
+		Expect(diffs).ToNot(ContainElement(HaveField("Old", "shm_size=512m")))
+	})
+})
@@ -0,0 +1,495 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/discourse/launcher/v2/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Editor edits a config file's text in place, using its yaml nodes to find the lines to change.
+// Only the lines of edited entries are rewritten, so comments, blank lines, and ordering are kept.
+type Editor struct {
+	Dir   string
+	Name  string
+	lines []string
+}
+
+func configFilename(dir string, configName string) string {
+	return strings.TrimRight(dir, "/") + "/" + configName + ".yml"
+}
+
+// NewEditor edits config content, to be saved as configName in dir.
+func NewEditor(dir string, configName string, content []byte) (*Editor, error) {
+	editor := &Editor{Dir: dir, Name: configName}
+	if text := strings.TrimRight(string(content), "\n"); text != "" {
+		editor.lines = strings.Split(text, "\n")
+	}
+	if _, err := editor.root(); err != nil {
+		return nil, err
+	}
+	return editor, nil
+}
+
+// LoadEditor edits an existing config file.
+func LoadEditor(dir string, configName string) (*Editor, error) {
+	content, err := os.ReadFile(configFilename(dir, configName))
+	if err != nil {
+		return nil, err
+	}
+	return NewEditor(dir, configName, content)
+}
+
+func (e *Editor) Bytes() []byte {
+	if len(e.lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(e.lines, "\n") + "\n")
+}
+
+// Redacted copies the edited config with secret env values masked, for printing.
+func (e *Editor) Redacted() *Editor {
+	redacted := &Editor{Dir: e.Dir, Name: e.Name, lines: slices.Clone(e.lines)}
+	root, err := e.root()
+	if err != nil || root == nil {
+		return redacted
+	}
+	secrets := []string{}
+	if _, v := lookup(root, "secrets"); v != nil && v.Kind == yaml.SequenceNode {
+		for _, item := range v.Content {
+			secrets = append(secrets, item.Value)
+		}
+	}
+	_, env := lookup(root, "env")
+	if env == nil || env.Kind != yaml.MappingNode {
+		return redacted
+	}
+	for i := 0; i+1 < len(env.Content); i += 2 {
+		key, value := env.Content[i].Value, env.Content[i+1].Value
+		if utils.ShowSecrets || value == "" || !(utils.IsSecret(key) || slices.Contains(secrets, key)) {
+			continue
+		}
+		if redacted.Set("env."+key, utils.RedactedValue) != nil {
+			// a value that can not be masked in place is left out
+			redacted.Unset("env." + key)
+		}
+	}
+	return redacted
+}
+
+// Save checks the edited config loads, along with its templates, then writes it.
+// The config is loaded as edited under its own name, and written to a temporary file that
+// replaces it, so a config that fails to load, or a failed write, leaves the file as is.
+func (e *Editor) Save(templatesDir string, namespace string) error {
+	content := e.Bytes()
+	if _, err := loadConfig(e.Dir, e.Name, true, templatesDir, namespace, content); err != nil {
+		return err
+	}
+	filename := configFilename(e.Dir, e.Name)
+	mode := os.FileMode(0640)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	// not named *.yml, so it is never taken for a config
+	tmp, err := os.CreateTemp(e.Dir, "."+e.Name+".yml.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Get finds the value at a dotted path of keys, such as env.DISCOURSE_HOSTNAME.
+func (e *Editor) Get(path string) (string, bool) {
+	node, err := e.root()
+	if err != nil || node == nil {
+		return "", false
+	}
+	for _, key := range strings.Split(path, ".") {
+		if node.Kind != yaml.MappingNode {
+			return "", false
+		}
+		if _, node = lookup(node, key); node == nil {
+			return "", false
+		}
+	}
+	if node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		return "", false
+	}
+	return node.Value, true
+}
+
+// Set sets the value at a dotted path of keys, such as env.DISCOURSE_HOSTNAME, adding any missing maps.
+// New keys replace a commented out line for the same key, when there is one, as in the sample configs.
+func (e *Editor) Set(path string, value string) error {
+	keys := strings.Split(path, ".")
+	val := &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+	if keys[0] == "env" || keys[0] == "labels" {
+		// container env and labels are always strings
+		val.Tag = "!!str"
+	}
+	root, err := e.root()
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		e.lines, _ = render(0, nested(keys, val))
+		return nil
+	}
+
+	mapping, indent, regionStart, regionEnd := root, 0, 0, len(e.lines)-1
+	for i, key := range keys {
+		k, v := lookup(mapping, key)
+		if k == nil {
+			return e.insertEntry(mapping, indent, regionStart, regionEnd, nested(keys[i:], val))
+		}
+		if i == len(keys)-1 || isNull(v) {
+			if v.Kind != yaml.ScalarNode {
+				return errors.New(strings.Join(keys[:i+1], ".") + " is not a single value")
+			}
+			if i == len(keys)-1 && (v.Style == yaml.DoubleQuotedStyle || v.Style == yaml.SingleQuotedStyle) {
+				val.Style = v.Style
+			}
+			val.LineComment = v.LineComment
+			return e.replaceEntry(k, v, indent, nested(keys[i:], val))
+		}
+		if v.Kind != yaml.MappingNode || v.Style&yaml.FlowStyle != 0 {
+			return errors.New(strings.Join(keys[:i+1], ".") + " is not a map")
+		}
+		regionStart, regionEnd = k.Line, e.entryEnd(k.Line-1, indent, v)
+		mapping, indent = v, e.indentOf(v.Content[0].Line-1)
+	}
+	return nil
+}
+
+// Unset removes the entry at a dotted path of keys, along with any nested values.
+func (e *Editor) Unset(path string) error {
+	root, err := e.root()
+	if err != nil {
+		return err
+	}
+	keys := strings.Split(path, ".")
+	mapping, indent := root, 0
+	for i, key := range keys {
+		if mapping == nil || mapping.Kind != yaml.MappingNode || mapping.Style&yaml.FlowStyle != 0 {
+			return errors.New(strings.Join(keys[:i], ".") + " is not a map")
+		}
+		k, v := lookup(mapping, key)
+		if k == nil {
+			return errors.New(path + " is not set")
+		}
+		if i == len(keys)-1 {
+			start := k.Line - 1
+			end := e.entryEnd(start, indent, v)
+			e.lines = slices.Concat(e.lines[:start], e.lines[end+1:])
+			return nil
+		}
+		mapping = v
+		if v.Kind == yaml.MappingNode && len(v.Content) > 0 {
+			indent = e.indentOf(v.Content[0].Line - 1)
+		}
+	}
+	return nil
+}
+
+// AddVolume mounts a host directory in the container, unless it is already mounted.
+// Mounting another host directory at the same guest path is an error.
+func (e *Editor) AddVolume(host string, guest string) (bool, error) {
+	root, err := e.root()
+	if err != nil {
+		return false, err
+	}
+	if root != nil {
+		if _, volumes := lookup(root, "volumes"); volumes != nil && volumes.Kind == yaml.SequenceNode {
+			entries := []VolumeEntry{}
+			if err := volumes.Decode(&entries); err != nil {
+				return false, err
+			}
+			for _, entry := range entries {
+				if entry.Volume.Guest == guest && entry.Volume.Host != host {
+					return false, errors.New(guest + " is already mounted from " + entry.Volume.Source())
+				}
+			}
+		}
+	}
+	item := &yaml.Node{}
+	if err := item.Encode(VolumeEntry{Volume: Volume{Host: host, Guest: guest}}); err != nil {
+		return false, err
+	}
+	return e.addToList("volumes", item, func(existing *yaml.Node) bool {
+		entry := VolumeEntry{}
+		return existing.Decode(&entry) == nil && entry.Volume.Host == host && entry.Volume.Guest == guest
+	}, "")
+}
+
+// AddNetwork attaches the container to a network, with an alias when set, unless it is already attached with that alias.
+func (e *Editor) AddNetwork(name string, alias string) (bool, error) {
+	item := &yaml.Node{}
+	if err := item.Encode(NetworkEntry{Network: Network{Name: name, Alias: alias}}); err != nil {
+		return false, err
+	}
+	return e.addToList("networks", item, func(existing *yaml.Node) bool {
+		entry := NetworkEntry{}
+		return existing.Decode(&entry) == nil && entry.Network.Name == name && (entry.Network.Alias == alias || alias == "")
+	}, "")
+}
+
+// RemoveLinks removes the links set in the config file, and returns them.
+// Comments about links directly above them, as in the sample configs, are removed too.
+func (e *Editor) RemoveLinks() ([]LinkEntry, error) {
+	root, err := e.root()
+	if err != nil || root == nil {
+		return nil, err
+	}
+	key, links := lookup(root, "links")
+	if key == nil || isNull(links) {
+		return nil, nil
+	}
+	entries := []LinkEntry{}
+	if err := links.Decode(&entries); err != nil {
+		return nil, err
+	}
+	start := key.Line - 1
+	end := e.entryEnd(start, 0, links)
+	for start > 0 {
+		line := strings.TrimSpace(e.lines[start-1])
+		if !strings.HasPrefix(line, "#") || !strings.Contains(strings.ToLower(line), "link") {
+			break
+		}
+		start--
+	}
+	e.lines = slices.Concat(e.lines[:start], e.lines[end+1:])
+	// don't leave two blank lines, or a blank line at the end
+	if start > 0 && strings.TrimSpace(e.lines[start-1]) == "" && (start == len(e.lines) || strings.TrimSpace(e.lines[start]) == "") {
+		e.lines = slices.Delete(e.lines, start-1, start)
+	}
+	return entries, nil
+}
+
+// AddToList adds an item to a top level list, such as templates or expose, unless it is already there.
+// A commented out item is uncommented instead, as in the sample configs.
+func (e *Editor) AddToList(key string, item string) (bool, error) {
+	return e.addToList(key, &yaml.Node{Kind: yaml.ScalarNode, Value: item}, func(existing *yaml.Node) bool {
+		return existing.Kind == yaml.ScalarNode && existing.Value == item
+	}, regexp.QuoteMeta(item))
+}
+
+// RemoveFromList comments out an item of a top level list, as in the sample configs, so AddToList uncomments it again.
+func (e *Editor) RemoveFromList(key string, item string) (bool, error) {
+	root, err := e.root()
+	if err != nil || root == nil {
+		return false, err
+	}
+	k, v := lookup(root, key)
+	if k == nil || isNull(v) {
+		return false, nil
+	}
+	if v.Kind != yaml.SequenceNode || v.Style&yaml.FlowStyle != 0 {
+		return false, errors.New(key + " is not a list")
+	}
+	i := slices.IndexFunc(v.Content, func(existing *yaml.Node) bool {
+		return existing.Kind == yaml.ScalarNode && existing.Value == item
+	})
+	if i < 0 {
+		return false, nil
+	}
+	line := v.Content[i].Line - 1
+	indent := e.indentOf(line)
+	e.lines[line] = e.lines[line][:indent] + "#" + e.lines[line][indent:]
+	return true, nil
+}
+
+func (e *Editor) addToList(key string, item *yaml.Node, exists func(*yaml.Node) bool, commented string) (bool, error) {
+	root, err := e.root()
+	if err != nil {
+		return false, err
+	}
+	list := &yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{item}}
+	if root == nil {
+		e.lines, _ = render(0, nested([]string{key}, list))
+		return true, nil
+	}
+	k, v := lookup(root, key)
+	if k == nil {
+		return true, e.insertEntry(root, 0, 0, len(e.lines)-1, nested([]string{key}, list))
+	}
+	if isNull(v) {
+		return true, e.replaceEntry(k, v, 0, nested([]string{key}, list))
+	}
+	if v.Kind != yaml.SequenceNode || v.Style&yaml.FlowStyle != 0 || len(v.Content) == 0 {
+		return false, errors.New(key + " is not a list")
+	}
+	if slices.ContainsFunc(v.Content, exists) {
+		return false, nil
+	}
+
+	last := v.Content[len(v.Content)-1]
+	if item.Kind == yaml.ScalarNode && last.Kind == yaml.ScalarNode {
+		item.Style = last.Style
+	}
+	indent := e.indentOf(v.Content[0].Line - 1)
+	rendered, err := render(indent, list)
+	if err != nil {
+		return false, err
+	}
+	if commented != "" {
+		pattern := regexp.MustCompile(`^ {` + strconv.Itoa(indent) + `}#\s*-\s*["']?` + commented + `["']?\s*(#.*)?$`)
+		if i := e.find(pattern, k.Line, e.entryEnd(k.Line-1, 0, v)); i >= 0 && len(rendered) == 1 {
+			e.lines[i] = rendered[0]
+			return true, nil
+		}
+	}
+	e.insertLines(e.entryEnd(last.Line-1, indent, nil)+1, rendered)
+	return true, nil
+}
+
+func (e *Editor) root() (*yaml.Node, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(e.Bytes(), &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || isNull(doc.Content[0]) {
+		return nil, nil
+	}
+	if doc.Content[0].Kind != yaml.MappingNode || doc.Content[0].Style&yaml.FlowStyle != 0 {
+		return nil, errors.New("config " + e.Name + " is not a map of settings")
+	}
+	return doc.Content[0], nil
+}
+
+// insertEntry adds an entry to a mapping, in place of a matching commented out key in its region of lines,
+// or after its last entry.
+func (e *Editor) insertEntry(mapping *yaml.Node, indent int, regionStart int, regionEnd int, entry *yaml.Node) error {
+	rendered, err := render(indent, entry)
+	if err != nil {
+		return err
+	}
+	key := entry.Content[0].Value
+	if entry.Content[1].Kind == yaml.ScalarNode && len(rendered) == 1 {
+		pattern := regexp.MustCompile(`^ {` + strconv.Itoa(indent) + `}#\s*` + regexp.QuoteMeta(key) + `\s*:`)
+		if i := e.find(pattern, regionStart, regionEnd); i >= 0 {
+			e.lines[i] = rendered[0]
+			return nil
+		}
+	}
+	at := regionEnd + 1
+	if len(mapping.Content) > 0 {
+		lastKey, lastValue := mapping.Content[len(mapping.Content)-2], mapping.Content[len(mapping.Content)-1]
+		at = e.entryEnd(lastKey.Line-1, indent, lastValue) + 1
+	}
+	e.insertLines(at, rendered)
+	return nil
+}
+
+// replaceEntry rewrites the lines of a mapping entry.
+func (e *Editor) replaceEntry(key *yaml.Node, value *yaml.Node, indent int, entry *yaml.Node) error {
+	rendered, err := render(indent, entry)
+	if err != nil {
+		return err
+	}
+	start := key.Line - 1
+	end := e.entryEnd(start, indent, value)
+	e.lines = slices.Concat(e.lines[:start], rendered, e.lines[end+1:])
+	return nil
+}
+
+// entryEnd finds the last line of an entry starting at a line: the following lines indented further,
+// and list items at the same indent when the entry's value is a list.
+// Trailing blank lines are left out.
+func (e *Editor) entryEnd(start int, indent int, value *yaml.Node) int {
+	listIndent := -1
+	if value != nil && value.Kind == yaml.SequenceNode && len(value.Content) > 0 {
+		listIndent = e.indentOf(value.Content[0].Line - 1)
+	}
+	end := start
+	for i := start + 1; i < len(e.lines); i++ {
+		line := strings.TrimSpace(e.lines[i])
+		if line == "" {
+			continue
+		}
+		lineIndent := e.indentOf(i)
+		isItem := lineIndent == listIndent && (line == "-" || strings.HasPrefix(line, "- "))
+		if lineIndent <= indent && !isItem {
+			break
+		}
+		end = i
+	}
+	return end
+}
+
+func (e *Editor) find(pattern *regexp.Regexp, start int, end int) int {
+	for i := start; i <= end && i < len(e.lines); i++ {
+		if pattern.MatchString(e.lines[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *Editor) insertLines(at int, lines []string) {
+	e.lines = slices.Concat(e.lines[:at], lines, e.lines[at:])
+}
+
+func (e *Editor) indentOf(line int) int {
+	return len(e.lines[line]) - len(strings.TrimLeft(e.lines[line], " "))
+}
+
+func lookup(mapping *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i], mapping.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+// nested builds a mapping entry for a path of keys, e.g. env: {KEY: value}.
+func nested(keys []string, value *yaml.Node) *yaml.Node {
+	for i := len(keys) - 1; i >= 0; i-- {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: keys[i]}
+		value = &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{key, value}}
+	}
+	return value
+}
+
+func render(indent int, node *yaml.Node) ([]string, error) {
+	buf := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = strings.Repeat(" ", indent) + line
+		}
+	}
+	return lines, nil
+}
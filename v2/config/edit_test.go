@@ -0,0 +1,218 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/launcher/v2/config"
+	"os"
+)
+
+var _ = Describe("Edit", func() {
+	var testDir string
+
+	const sample = `## the all-in-one config
+templates:
+  - "templates/web.template.yml"
+  ## Uncomment these two lines if you wish to add Lets Encrypt (https)
+  #- "templates/web.ssl.template.yml"
+
+## which ports should this container expose?
+expose:
+  - "80:80"   # http
+
+env:
+  LANG: en_US.UTF-8
+
+  ## The domain name this Discourse instance will respond to
+  DISCOURSE_HOSTNAME: 'discourse.example.com'
+  DISCOURSE_SMTP_PORT: 587 # submission
+  WELCOME: |
+    multiline
+
+    value
+
+  ## If you added the Lets Encrypt template, uncomment below
+  #LETSENCRYPT_ACCOUNT_EMAIL: me@example.com
+
+## trailing comment
+`
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	edit := func(content string) *config.Editor {
+		editor, err := config.NewEditor(testDir, "app", []byte(content))
+		Expect(err).To(BeNil())
+		return editor
+	}
+
+	It("gets values", func() {
+		editor := edit(sample)
+		value, ok := editor.Get("env.DISCOURSE_HOSTNAME")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("discourse.example.com"))
+		_, ok = editor.Get("env.LETSENCRYPT_ACCOUNT_EMAIL")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("replaces values, keeping quotes and comments", func() {
+		editor := edit(sample)
+		Expect(editor.Set("env.DISCOURSE_HOSTNAME", "forum.example.com")).To(Succeed())
+		Expect(editor.Set("env.DISCOURSE_SMTP_PORT", "2525")).To(Succeed())
+		Expect(editor.Set("env.WELCOME", "hello")).To(Succeed())
+		Expect(string(editor.Bytes())).To(Equal(`## the all-in-one config
+templates:
+  - "templates/web.template.yml"
+  ## Uncomment these two lines if you wish to add Lets Encrypt (https)
+  #- "templates/web.ssl.template.yml"
+
+## which ports should this container expose?
+expose:
+  - "80:80"   # http
+
+env:
+  LANG: en_US.UTF-8
+
+  ## The domain name this Discourse instance will respond to
+  DISCOURSE_HOSTNAME: 'forum.example.com'
+  DISCOURSE_SMTP_PORT: "2525" # submission
+  WELCOME: hello
+
+  ## If you added the Lets Encrypt template, uncomment below
+  #LETSENCRYPT_ACCOUNT_EMAIL: me@example.com
+
+## trailing comment
+`))
+	})
+
+	It("uncomments keys and list items", func() {
+		editor := edit(sample)
+		Expect(editor.Set("env.LETSENCRYPT_ACCOUNT_EMAIL", "admin@example.com")).To(Succeed())
+		added, err := editor.AddToList("templates", "templates/web.ssl.template.yml")
+		Expect(err).To(BeNil())
+		Expect(added).To(BeTrue())
+		Expect(string(editor.Bytes())).To(ContainSubstring("  - \"templates/web.template.yml\"\n" +
+			"  ## Uncomment these two lines if you wish to add Lets Encrypt (https)\n" +
+			"  - \"templates/web.ssl.template.yml\"\n"))
+		Expect(string(editor.Bytes())).To(ContainSubstring("  ## If you added the Lets Encrypt template, uncomment below\n" +
+			"  LETSENCRYPT_ACCOUNT_EMAIL: admin@example.com\n\n## trailing comment\n"))
+	})
+
+	It("comments out removed list items, so they are uncommented when added again", func() {
+		editor := edit(sample)
+		_, err := editor.AddToList("templates", "templates/web.ssl.template.yml")
+		Expect(err).To(BeNil())
+		removed, err := editor.RemoveFromList("templates", "templates/web.ssl.template.yml")
+		Expect(err).To(BeNil())
+		Expect(removed).To(BeTrue())
+		Expect(string(editor.Bytes())).To(Equal(sample))
+		removed, err = editor.RemoveFromList("templates", "templates/web.ssl.template.yml")
+		Expect(err).To(BeNil())
+		Expect(removed).To(BeFalse())
+		_, err = editor.RemoveFromList("env", "LANG")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("adds keys and list items after the last entry", func() {
+		editor := edit(sample)
+		Expect(editor.Set("env.UNICORN_WORKERS", "4")).To(Succeed())
+		added, err := editor.AddToList("expose", "443:443")
+		Expect(err).To(BeNil())
+		Expect(added).To(BeTrue())
+		added, err = editor.AddToList("expose", "80:80")
+		Expect(err).To(BeNil())
+		Expect(added).To(BeFalse())
+		Expect(string(editor.Bytes())).To(ContainSubstring("expose:\n  - \"80:80\"   # http\n  - \"443:443\"\n\nenv:\n"))
+		Expect(string(editor.Bytes())).To(ContainSubstring("    value\n  UNICORN_WORKERS: \"4\"\n\n  ## If you added"))
+	})
+
+	It("adds missing maps and lists", func() {
+		editor := edit("base_image: discourse/base\n# the end\n")
+		Expect(editor.Set("env.DISCOURSE_HOSTNAME", "forum.example.com")).To(Succeed())
+		_, err := editor.AddToList("templates", "templates/web.template.yml")
+		Expect(err).To(BeNil())
+		Expect(string(editor.Bytes())).To(Equal("base_image: discourse/base\n" +
+			"env:\n  DISCOURSE_HOSTNAME: forum.example.com\n" +
+			"templates:\n  - templates/web.template.yml\n" +
+			"# the end\n"))
+
+		editor = edit("")
+		Expect(editor.Set("env.LANG", "en_US.UTF-8")).To(Succeed())
+		Expect(string(editor.Bytes())).To(Equal("env:\n  LANG: en_US.UTF-8\n"))
+	})
+
+	It("removes entries, keeping neighbouring comments", func() {
+		editor := edit(sample)
+		Expect(editor.Unset("env.WELCOME")).To(Succeed())
+		Expect(editor.Unset("env.DISCOURSE_HOSTNAME")).To(Succeed())
+		Expect(string(editor.Bytes())).To(ContainSubstring("  ## The domain name this Discourse instance will respond to\n" +
+			"  DISCOURSE_SMTP_PORT: 587 # submission\n\n  ## If you added"))
+		Expect(editor.Unset("expose")).To(Succeed())
+		Expect(string(editor.Bytes())).To(ContainSubstring("## which ports should this container expose?\n\nenv:\n"))
+		Expect(editor.Unset("env.MISSING")).ToNot(Succeed())
+		Expect(editor.Unset("templates.x")).ToNot(Succeed())
+	})
+
+	It("adds volumes", func() {
+		editor := edit("volumes:\n  - volume:\n      host: /var/discourse/shared/standalone\n      guest: /shared\n# plugins\n")
+		added, err := editor.AddVolume("/var/discourse/shared/uploads", "/uploads")
+		Expect(err).To(BeNil())
+		Expect(added).To(BeTrue())
+		added, err = editor.AddVolume("/var/discourse/shared/uploads", "/uploads")
+		Expect(err).To(BeNil())
+		Expect(added).To(BeFalse())
+		_, err = editor.AddVolume("/somewhere/else", "/shared")
+		Expect(err).ToNot(BeNil())
+		Expect(string(editor.Bytes())).To(Equal("volumes:\n" +
+			"  - volume:\n      host: /var/discourse/shared/standalone\n      guest: /shared\n" +
+			"  - volume:\n      host: /var/discourse/shared/uploads\n      guest: /uploads\n" +
+			"# plugins\n"))
+	})
+
+	It("errors when setting a map", func() {
+		editor := edit(sample)
+		Expect(editor.Set("env", "value")).ToNot(Succeed())
+		Expect(editor.Set("expose.port", "value")).ToNot(Succeed())
+	})
+
+	It("saves configs that load", func() {
+		os.WriteFile(testDir+"/web.template.yml", []byte("base_image: discourse/base\n"), 0644)
+		editor := edit("templates:\n  - web.template.yml\n")
+		Expect(editor.Set("env.DISCOURSE_HOSTNAME", "forum.example.com")).To(Succeed())
+		Expect(editor.Save(testDir, "local_discourse")).To(Succeed())
+		content, _ := os.ReadFile(testDir + "/app.yml")
+		Expect(string(content)).To(Equal("templates:\n  - web.template.yml\nenv:\n  DISCOURSE_HOSTNAME: forum.example.com\n"))
+
+		editor = edit("templates:\n  - missing.template.yml\n")
+		Expect(editor.Save(testDir, "local_discourse")).ToNot(Succeed())
+		content, _ = os.ReadFile(testDir + "/app.yml")
+		Expect(string(content)).To(ContainSubstring("web.template.yml"))
+		files, _ := os.ReadDir(testDir)
+		Expect(files).To(HaveLen(2))
+	})
+
+	It("checks configs load under their own name, and keeps their mode", func() {
+		os.WriteFile(testDir+"/app.yml", []byte("base_image: discourse/base\n"), 0600)
+		// a config extending itself only fails under its own name
+		editor := edit("base_image: discourse/base\nextends: app\n")
+		err := editor.Save(testDir, "local_discourse")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("app -> app"))
+
+		editor = edit("base_image: discourse/base\nenv:\n  LOG_DIR: /var/log/{{config}}\n")
+		Expect(editor.Save(testDir, "local_discourse")).To(Succeed())
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "local_discourse")
+		Expect(err).To(BeNil())
+		Expect(conf.Env["LOG_DIR"]).To(Equal("/var/log/app"))
+		info, _ := os.Stat(testDir + "/app.yml")
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		files, _ := os.ReadDir(testDir)
+		Expect(files).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Image labels recording the config an image was built and configured from.
+const (
+	BuildHashLabel = "org.discourse.launcher.build-hash"
+	EnvHashLabel   = "org.discourse.launcher.env-hash"
+)
+
+// BuildHash covers everything baked into an image on build: the base image,
+// and the pups config from templates and the config itself.
+func (config *Config) BuildHash() string {
+	hash := sha256.New()
+	hash.Write([]byte("base_image=" + config.Base_Image + "\n"))
+	hash.Write([]byte("update_pups=" + strconv.FormatBool(config.Update_Pups) + "\n"))
+	hash.Write([]byte("boot_command=" + config.BootCommand() + "\n"))
+	settings := config.pupsSettings()
+	keys := []string{}
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		hash.Write([]byte(k + ":\n" + settings[k]))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// EnvHash covers the env an image is configured with.
+func (config *Config) EnvHash() string {
+	sum := sha256.Sum256([]byte(strings.Join(config.EnvArray(true), "\x00")))
+	return hex.EncodeToString(sum[:])
+}
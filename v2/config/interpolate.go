@@ -0,0 +1,195 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+// undefinedValue is returned from variable lookups that did not resolve.
+// It may be rescued by piping into `default`, otherwise interpolation fails.
+type undefinedValue struct {
+	name string
+}
+
+// interpolator renders the {{...}} variables allowed in config values:
+//
+//	{{config}}                   name of the config being loaded
+//	{{hostname}}                 hostname of the host machine
+//	{{namespace}}                image namespace
+//	{{env "NAME"}}               value of NAME in the host environment
+//	{{var "KEY"}}                value of KEY from the config's env section
+//	{{env "NAME" | default "x"}} fall back to "x" when NAME is not defined
+//
+// Only values calling one of these are interpolated, so other values containing
+// {{ are left as is. In interpolated values, a literal {{ is written {{"{{"}}.
+type interpolator struct {
+	config    *Config
+	namespace string
+	resolved  map[string]string
+	resolving map[string]bool
+	undefined map[string]int
+}
+
+// interpolated matches values calling one of the interpolator's functions.
+var interpolated = regexp.MustCompile(`\{\{-?\s*\(?\s*(config|hostname|namespace|env|var|default)(\s|\)|\||-?\}\})`)
+
+func newInterpolator(config *Config, namespace string) *interpolator {
+	if namespace == "" {
+		namespace = utils.DefaultNamespace
+	}
+	return &interpolator{
+		config:    config,
+		namespace: namespace,
+		resolved:  map[string]string{},
+		resolving: map[string]bool{},
+		undefined: map[string]int{},
+	}
+}
+
+func (i *interpolator) funcs() template.FuncMap {
+	return template.FuncMap{
+		"config": func() string {
+			return i.config.Name
+		},
+		"hostname": func() (string, error) {
+			return os.Hostname()
+		},
+		"namespace": func() string {
+			return i.namespace
+		},
+		"env": func(name string) any {
+			if val, ok := os.LookupEnv(name); ok {
+				return val
+			}
+			return i.markUndefined("env " + name)
+		},
+		"var": func(key string) (any, error) {
+			if _, ok := i.config.Env[key]; !ok {
+				return i.markUndefined("var " + key), nil
+			}
+			return i.resolveEnv(key)
+		},
+		"default": func(def string, val any) any {
+			if u, ok := val.(undefinedValue); ok {
+				i.undefined[u.name]--
+				if i.undefined[u.name] <= 0 {
+					delete(i.undefined, u.name)
+				}
+				return def
+			}
+			return val
+		},
+	}
+}
+
+func (i *interpolator) markUndefined(name string) undefinedValue {
+	i.undefined[name]++
+	return undefinedValue{name: name}
+}
+
+// resolveEnv renders a config env value, following references to other env keys.
+func (i *interpolator) resolveEnv(key string) (string, error) {
+	if val, ok := i.resolved[key]; ok {
+		return val, nil
+	}
+	if i.resolving[key] {
+		return "", errors.New("env " + key + " references itself")
+	}
+	i.resolving[key] = true
+	defer delete(i.resolving, key)
+	val, err := i.render("env "+key, i.config.Env[key])
+	if err != nil {
+		return "", err
+	}
+	i.resolved[key] = val
+	return val, nil
+}
+
+func (i *interpolator) render(field string, value string) (string, error) {
+	if !interpolated.MatchString(value) {
+		return value, nil
+	}
+	tmpl, err := template.New(field).Funcs(i.funcs()).Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse %s: %w", field, err)
+	}
+	// nested renders from var lookups track their own undefined variables
+	outer := i.undefined
+	i.undefined = map[string]int{}
+	defer func() { i.undefined = outer }()
+	builder := strings.Builder{}
+	if err := tmpl.Execute(&builder, nil); err != nil {
+		return "", fmt.Errorf("unable to interpolate %s: %w", field, err)
+	}
+	if len(i.undefined) > 0 {
+		names := []string{}
+		for name := range i.undefined {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return "", errors.New("undefined variable in " + field + ": " + strings.Join(names, ", "))
+	}
+	return builder.String(), nil
+}
+
+func (config *Config) interpolate(namespace string) error {
+	i := newInterpolator(config, namespace)
+
+	for k := range config.Env {
+		val, err := i.resolveEnv(k)
+		if err != nil {
+			return err
+		}
+		config.Env[k] = val
+	}
+
+	for k, v := range config.Labels {
+		val, err := i.render("label "+k, v)
+		if err != nil {
+			return err
+		}
+		config.Labels[k] = val
+	}
+
+	for idx, v := range config.Volumes {
+		host, err := i.render("volume host", v.Volume.Host)
+		if err != nil {
+			return err
+		}
+		guest, err := i.render("volume guest", v.Volume.Guest)
+		if err != nil {
+			return err
+		}
+		name, err := i.render("volume name", v.Volume.Name)
+		if err != nil {
+			return err
+		}
+		config.Volumes[idx].Volume.Host = host
+		config.Volumes[idx].Volume.Guest = guest
+		config.Volumes[idx].Volume.Name = name
+	}
+
+	for idx, v := range config.Expose {
+		val, err := i.render("expose", v)
+		if err != nil {
+			return err
+		}
+		config.Expose[idx] = val
+	}
+
+	var err error
+	if config.Docker_Args, err = i.render("docker_args", config.Docker_Args); err != nil {
+		return err
+	}
+	if config.Run_Image, err = i.render("run_image", config.Run_Image); err != nil {
+		return err
+	}
+	return nil
+}
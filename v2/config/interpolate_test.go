@@ -0,0 +1,156 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+)
+
+var _ = Describe("Interpolate", func() {
+	var testDir string
+
+	writeConfig := func(name string, content string) {
+		err := os.WriteFile(testDir+"/"+name+".yml", []byte(content), 0644)
+		Expect(err).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		os.Setenv("LAUNCHER_TEST_VAR", "from-host")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+		os.Unsetenv("LAUNCHER_TEST_VAR")
+	})
+
+	It("replaces config, namespace, and hostname variables", func() {
+		writeConfig("app", `
+base_image: discourse/base
+run_image: "{{namespace}}/{{config}}-run"
+env:
+  CONFIG: "{{config}}/{{config}}"
+  HOST: "{{hostname}}"
+labels:
+  app: "{{config}}"
+`)
+		conf, err := config.LoadConfig(testDir, "app", false, testDir, "testnamespace")
+		Expect(err).To(BeNil())
+		hostname, _ := os.Hostname()
+		Expect(conf.Env["CONFIG"]).To(Equal("app/app"))
+		Expect(conf.Env["HOST"]).To(Equal(hostname))
+		Expect(conf.Labels["app"]).To(Equal("app"))
+		Expect(conf.RunImage()).To(Equal("testnamespace/app-run"))
+	})
+
+	It("uses the default namespace when none is given", func() {
+		writeConfig("app", `
+base_image: discourse/base
+run_image: "{{namespace}}/{{config}}"
+`)
+		conf, err := config.LoadConfig(testDir, "app", false, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.RunImage()).To(Equal("local_discourse/app"))
+	})
+
+	It("looks up host env, defaults, and other env keys", func() {
+		writeConfig("app", `
+base_image: discourse/base
+docker_args: '--log-opt tag={{var "DISCOURSE_HOSTNAME"}}'
+expose:
+  - '{{env "LAUNCHER_TEST_PORT" | default "8080"}}:80'
+volumes:
+  - volume:
+      host: "/var/discourse/shared/{{config}}"
+      guest: /shared
+env:
+  DISCOURSE_HOSTNAME: forum.example.com
+  FROM_HOST: '{{env "LAUNCHER_TEST_VAR"}}'
+  DEFAULTED: '{{env "LAUNCHER_TEST_UNSET" | default "fallback"}}'
+  CDN: 'https://cdn.{{var "DISCOURSE_HOSTNAME"}}'
+  NESTED: '{{var "CDN"}}/assets'
+`)
+		conf, err := config.LoadConfig(testDir, "app", false, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Env["FROM_HOST"]).To(Equal("from-host"))
+		Expect(conf.Env["DEFAULTED"]).To(Equal("fallback"))
+		Expect(conf.Env["CDN"]).To(Equal("https://cdn.forum.example.com"))
+		Expect(conf.Env["NESTED"]).To(Equal("https://cdn.forum.example.com/assets"))
+		Expect(conf.Expose).To(Equal([]string{"8080:80"}))
+		Expect(conf.Volumes[0].Volume.Host).To(Equal("/var/discourse/shared/app"))
+		Expect(conf.DockerArgs()).To(Equal([]string{"--log-opt", "tag=forum.example.com"}))
+
+		// pups gets the same values as launcher
+		Expect(conf.Yaml()).ToNot(ContainSubstring("{{"))
+		docs := strings.Split(conf.Yaml(), "_FILE_SEPERATOR_")
+		pups := struct{ Env map[string]string }{}
+		Expect(yaml.Unmarshal([]byte(docs[len(docs)-1]), &pups)).To(Succeed())
+		Expect(pups.Env).To(Equal(conf.Env))
+	})
+
+	It("errors on undefined host env variables", func() {
+		writeConfig("app", `
+base_image: discourse/base
+env:
+  MISSING: '{{env "LAUNCHER_TEST_UNSET"}}'
+`)
+		_, err := config.LoadConfig(testDir, "app", false, testDir, "")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("undefined variable in env MISSING: env LAUNCHER_TEST_UNSET"))
+	})
+
+	It("errors on undefined env key references", func() {
+		writeConfig("app", `
+base_image: discourse/base
+labels:
+  host: '{{var "DISCOURSE_HOSTNAME"}}'
+`)
+		_, err := config.LoadConfig(testDir, "app", false, testDir, "")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("undefined variable in label host: var DISCOURSE_HOSTNAME"))
+	})
+
+	It("errors on self referencing env keys", func() {
+		writeConfig("app", `
+base_image: discourse/base
+env:
+  A: '{{var "B"}}'
+  B: '{{var "A"}}'
+`)
+		_, err := config.LoadConfig(testDir, "app", false, testDir, "")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("references itself"))
+	})
+
+	It("leaves values that call no variables as is", func() {
+		writeConfig("app", `
+base_image: discourse/base
+env:
+  DISCOURSE_DB_PASSWORD: 'p{{w'
+  UNKNOWN: '{{nope}}'
+  ESCAPED: '{{config}}-{{"{{"}}w'
+`)
+		conf, err := config.LoadConfig(testDir, "app", false, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Env["DISCOURSE_DB_PASSWORD"]).To(Equal("p{{w"))
+		Expect(conf.Env["UNKNOWN"]).To(Equal("{{nope}}"))
+		Expect(conf.Env["ESCAPED"]).To(Equal("app-{{w"))
+	})
+
+	It("reports interpolation errors as config errors naming the key", func() {
+		writeConfig("app", `
+base_image: discourse/base
+env:
+  BAD: '{{env "LAUNCHER_TEST_VAR"}}{{w'
+`)
+		_, err := config.LoadConfig(testDir, "app", false, testDir, "")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("unable to parse env BAD"))
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitConfig))
+	})
+})
@@ -0,0 +1,207 @@
+package config
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+
+	"dario.cat/mergo"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// MergeAppend appends to inherited lists, and merges inherited maps key by key.
+	MergeAppend = "append"
+	// MergeReplace replaces inherited lists and maps.
+	MergeReplace = "replace"
+)
+
+// resetTag marks a field whose inherited value is replaced, or a map key that is unset.
+const resetTag = "!reset"
+
+// fields that support merge strategies
+var mergeFields = []string{"expose", "volumes", "links", "networks", "depends_on", "env", "labels", "secrets"}
+
+// mergeOptions are the merge settings for a single config or template file.
+type mergeOptions struct {
+	// fields defined in the file
+	present map[string]bool
+	// fields replacing their inherited value
+	replace map[string]bool
+	// env and label keys to unset
+	unset map[string][]string
+	// env and label keys set to null, which unsets them when inherited
+	null map[string][]string
+}
+
+// parseConfigFile reads config yaml along with its merge settings.
+// Merge settings are stripped from the returned raw yaml, as pups does not understand them.
+func parseConfigFile(content []byte) (*Config, *mergeOptions, string, error) {
+	opts := &mergeOptions{
+		present: map[string]bool{},
+		replace: map[string]bool{},
+		unset:   map[string][]string{},
+		null:    map[string][]string{},
+	}
+	raw := string(content[:])
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(content, doc); err != nil {
+		return nil, nil, "", err
+	}
+	config := &Config{}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		if err := doc.Decode(config); err != nil {
+			return nil, nil, "", err
+		}
+		return config, opts, raw, nil
+	}
+
+	root := doc.Content[0]
+	rewritten := false
+	strategies := map[string]string{}
+	entries := []*yaml.Node{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		if key.Value == "merge" {
+			if err := value.Decode(&strategies); err != nil {
+				return nil, nil, "", errors.New("merge must be a map of field to strategy: " + err.Error())
+			}
+			rewritten = true
+			continue
+		}
+
+		if slices.Contains(mergeFields, key.Value) {
+			opts.present[key.Value] = true
+			if value.Tag == resetTag {
+				opts.replace[key.Value] = true
+				clearTag(value)
+				rewritten = true
+			}
+			if value.Kind == yaml.MappingNode {
+				kept := []*yaml.Node{}
+				for j := 0; j+1 < len(value.Content); j += 2 {
+					if isNull(value.Content[j+1]) {
+						opts.null[key.Value] = append(opts.null[key.Value], value.Content[j].Value)
+					}
+					if value.Content[j+1].Tag == resetTag {
+						opts.unset[key.Value] = append(opts.unset[key.Value], value.Content[j].Value)
+						rewritten = true
+						continue
+					}
+					kept = append(kept, value.Content[j], value.Content[j+1])
+				}
+				value.Content = kept
+			}
+		}
+		entries = append(entries, key, value)
+	}
+	root.Content = entries
+
+	for field, strategy := range strategies {
+		if !slices.Contains(mergeFields, field) {
+			return nil, nil, "", errors.New("unknown merge field '" + field + "', must be one of: " + strings.Join(mergeFields, ", "))
+		}
+		switch strategy {
+		case MergeAppend:
+		case MergeReplace:
+			if opts.present[field] {
+				opts.replace[field] = true
+			}
+		default:
+			return nil, nil, "", errors.New("unknown merge strategy '" + strategy + "' for " + field + ", must be append or replace")
+		}
+	}
+
+	if err := doc.Decode(config); err != nil {
+		return nil, nil, "", err
+	}
+
+	if rewritten {
+		out, err := yaml.Marshal(doc)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		raw = string(out[:])
+	}
+	return config, opts, raw, nil
+}
+
+func clearTag(node *yaml.Node) {
+	node.Tag = ""
+	node.Style &^= yaml.TaggedStyle
+}
+
+// merge applies src on top of config.
+// Scalar fields, including each resources setting, are overridden when set in src. Expose, volumes, links, networks, and depends_on are
+// appended to by default, skipping duplicates. Env and labels are merged key by key.
+func (config *Config) merge(src *Config, opts *mergeOptions) error {
+	scalars := *src
+	scalars.Expose = nil
+	scalars.Volumes = nil
+	scalars.Links = nil
+	scalars.Networks = nil
+	scalars.Depends_On = nil
+	scalars.Env = nil
+	scalars.Labels = nil
+	scalars.Secrets = nil
+	if err := mergo.Merge(config, &scalars, mergo.WithOverride); err != nil {
+		return err
+	}
+
+	config.Expose = mergeList(config.Expose, src.Expose, opts.replace["expose"])
+	config.Volumes = mergeList(config.Volumes, src.Volumes, opts.replace["volumes"])
+	config.Links = mergeList(config.Links, src.Links, opts.replace["links"])
+	config.Networks = mergeList(config.Networks, src.Networks, opts.replace["networks"])
+	config.Depends_On = mergeList(config.Depends_On, src.Depends_On, opts.replace["depends_on"])
+	config.Secrets = mergeList(config.Secrets, src.Secrets, opts.replace["secrets"])
+	if !opts.replace["env"] {
+		opts.unset["env"] = append(opts.unset["env"], inherited(config.Env, opts.null["env"])...)
+	}
+	if !opts.replace["labels"] {
+		opts.unset["labels"] = append(opts.unset["labels"], inherited(config.Labels, opts.null["labels"])...)
+	}
+	config.Env = mergeMap(config.Env, src.Env, opts.replace["env"], opts.unset["env"])
+	config.Labels = mergeMap(config.Labels, src.Labels, opts.replace["labels"], opts.unset["labels"])
+	return nil
+}
+
+func mergeList[T comparable](dst []T, src []T, replace bool) []T {
+	if replace {
+		return slices.Clone(src)
+	}
+	for _, v := range src {
+		if !slices.Contains(dst, v) {
+			dst = append(dst, v)
+		}
+	}
+	return dst
+}
+
+// inherited lists the keys already set in dst. Null unsets these, while for keys
+// set first, null is an empty value, as in the standard templates.
+func inherited(dst map[string]string, keys []string) []string {
+	set := []string{}
+	for _, k := range keys {
+		if _, ok := dst[k]; ok {
+			set = append(set, k)
+		}
+	}
+	return set
+}
+
+func mergeMap(dst map[string]string, src map[string]string, replace bool, unset []string) map[string]string {
+	if replace || dst == nil {
+		dst = map[string]string{}
+	}
+	maps.Copy(dst, src)
+	for _, k := range unset {
+		delete(dst, k)
+	}
+	if len(dst) == 0 {
+		return nil
+	}
+	return dst
+}
@@ -0,0 +1,277 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+	"os"
+)
+
+var _ = Describe("Merge", func() {
+	var testDir string
+
+	writeFile := func(name string, content string) {
+		err := os.WriteFile(testDir+"/"+name, []byte(content), 0644)
+		Expect(err).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		writeFile("base.template.yml", `
+base_image: discourse/base
+expose:
+  - "80:80"
+volumes:
+  - volume:
+      host: /var/discourse/shared/standalone
+      guest: /shared
+links:
+  - link:
+      name: data
+      alias: data
+env:
+  RAILS_ENV: production
+  UNICORN_WORKERS: 3
+  DISCOURSE_DB_SOCKET: /var/run/postgresql
+labels:
+  team: web
+`)
+		writeFile("ssl.template.yml", `
+expose:
+  - "80:80"
+  - "443:443"
+volumes:
+  - volume:
+      host: /var/discourse/shared/standalone/ssl
+      guest: /shared/ssl
+env:
+  DISCOURSE_FORCE_HTTPS: true
+`)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("appends lists and merges maps across templates by default", func() {
+		writeFile("app.yml", `
+templates:
+  - base.template.yml
+  - ssl.template.yml
+expose:
+  - "2222:22"
+env:
+  UNICORN_WORKERS: 8
+`)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Expose).To(Equal([]string{"80:80", "443:443", "2222:22"}))
+		Expect(len(conf.Volumes)).To(Equal(2))
+		Expect(conf.Volumes[0].Volume.Guest).To(Equal("/shared"))
+		Expect(conf.Volumes[1].Volume.Guest).To(Equal("/shared/ssl"))
+		Expect(len(conf.Links)).To(Equal(1))
+		Expect(conf.Env).To(Equal(map[string]string{
+			"RAILS_ENV":             "production",
+			"UNICORN_WORKERS":       "8",
+			"DISCOURSE_DB_SOCKET":   "/var/run/postgresql",
+			"DISCOURSE_FORCE_HTTPS": "true",
+		}))
+		Expect(conf.Labels).To(Equal(map[string]string{"team": "web"}))
+	})
+
+	It("merges resources setting by setting", func() {
+		writeFile("limits.template.yml", `
+resources:
+  memory: 2g
+  shm_size: 1g
+  ulimits:
+    nofile: 1024
+    nproc: 512
+`)
+		writeFile("app.yml", `
+templates:
+  - base.template.yml
+  - limits.template.yml
+resources:
+  memory: 4g
+  ulimits:
+    nofile: 4096
+`)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Resources).To(Equal(config.Resources{
+			Memory:   "4g",
+			Shm_Size: "1g",
+			Ulimits:  map[string]string{"nofile": "4096", "nproc": "512"},
+		}))
+	})
+
+	It("merges declared secrets, which are masked and not passed to builds", func() {
+		defer func() { utils.SecretKeys = nil }()
+		writeFile("secrets.template.yml", "secrets:\n  - MAXMIND_KEY\nenv:\n  MAXMIND_KEY: abc\n")
+		writeFile("app.yml", "templates:\n  - base.template.yml\n  - secrets.template.yml\nsecrets:\n  - S3_SECRET\nenv:\n  S3_SECRET: xyz\n")
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Secrets).To(Equal([]string{"MAXMIND_KEY", "S3_SECRET"}))
+		Expect(conf.EnvArray(false)).ToNot(ContainElement("MAXMIND_KEY=abc"))
+		Expect(conf.EnvArray(false)).ToNot(ContainElement("S3_SECRET=xyz"))
+		Expect(conf.EnvArray(true)).To(ContainElement("S3_SECRET=xyz"))
+		Expect(conf.Redacted().Env["S3_SECRET"]).To(Equal(utils.RedactedValue))
+		Expect(conf.Redacted().Env["RAILS_ENV"]).To(Equal("production"))
+		Expect(conf.Env["S3_SECRET"]).To(Equal("xyz"))
+	})
+
+	It("replaces inherited values for fields tagged with !reset", func() {
+		writeFile("app.yml", `
+templates:
+  - base.template.yml
+  - ssl.template.yml
+expose: !reset
+  - "8080:80"
+volumes: !reset
+links: !reset []
+labels: !reset
+  team: forum
+`)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Expose).To(Equal([]string{"8080:80"}))
+		Expect(conf.Volumes).To(BeEmpty())
+		Expect(conf.Links).To(BeEmpty())
+		Expect(conf.Labels).To(Equal(map[string]string{"team": "forum"}))
+		Expect(conf.Env["RAILS_ENV"]).To(Equal("production"))
+	})
+
+	It("unsets env and labels keys tagged with !reset", func() {
+		writeFile("app.yml", `
+templates:
+  - base.template.yml
+env:
+  DISCOURSE_DB_SOCKET: !reset
+  DISCOURSE_DB_HOST: data
+labels:
+  team: !reset null
+`)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Env).ToNot(HaveKey("DISCOURSE_DB_SOCKET"))
+		Expect(conf.Env["DISCOURSE_DB_HOST"]).To(Equal("data"))
+		Expect(conf.Labels).To(BeEmpty())
+		// pups does not understand merge settings, so they are not passed along
+		Expect(conf.Yaml()).ToNot(ContainSubstring("!reset"))
+		Expect(conf.Yaml()).To(ContainSubstring("DISCOURSE_DB_HOST: data"))
+	})
+
+	It("unsets inherited env and labels keys set to null, and keeps empty strings", func() {
+		writeFile("app.yml", `
+templates:
+  - base.template.yml
+env:
+  DISCOURSE_DB_SOCKET:
+  DISCOURSE_DB_PORT:
+  UNICORN_WORKERS: ''
+labels:
+  team: null
+`)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Env).ToNot(HaveKey("DISCOURSE_DB_SOCKET"))
+		// keys not set before are set empty, as in the standard templates
+		Expect(conf.Env).To(HaveKeyWithValue("DISCOURSE_DB_PORT", ""))
+		Expect(conf.Env).To(HaveKeyWithValue("UNICORN_WORKERS", ""))
+		Expect(conf.Labels).To(BeEmpty())
+	})
+
+	It("does not pass unset keys to pups from earlier templates", func() {
+		writeFile("app.yml", `
+templates:
+  - base.template.yml
+env:
+  DISCOURSE_DB_SOCKET: !reset
+  RAILS_ENV:
+`)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Yaml()).ToNot(ContainSubstring("DISCOURSE_DB_SOCKET"))
+		Expect(conf.Yaml()).ToNot(ContainSubstring("RAILS_ENV"))
+		Expect(conf.Yaml()).To(ContainSubstring("UNICORN_WORKERS: \"3\""))
+	})
+
+	It("replaces inherited values with the merge setting", func() {
+		writeFile("app.yml", `
+templates:
+  - base.template.yml
+  - ssl.template.yml
+merge:
+  expose: replace
+  env: replace
+  volumes: append
+expose:
+  - "8080:80"
+env:
+  RAILS_ENV: development
+`)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Expose).To(Equal([]string{"8080:80"}))
+		Expect(conf.Env).To(Equal(map[string]string{"RAILS_ENV": "development"}))
+		Expect(len(conf.Volumes)).To(Equal(2))
+		Expect(conf.Yaml()).ToNot(ContainSubstring("merge:"))
+	})
+
+	It("keeps inherited values when a replaced field is not set", func() {
+		writeFile("app.yml", `
+templates:
+  - base.template.yml
+merge:
+  expose: replace
+`)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Expose).To(Equal([]string{"80:80"}))
+	})
+
+	It("errors on unknown merge settings", func() {
+		writeFile("app.yml", `
+templates:
+  - base.template.yml
+merge:
+  expose: prepend
+`)
+		_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("unknown merge strategy 'prepend' for expose"))
+
+		writeFile("app.yml", `
+merge:
+  hooks: replace
+`)
+		_, err = config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("unknown merge field 'hooks'"))
+	})
+
+	It("applies merge settings when extending configs", func() {
+		writeFile("base-site.yml", `
+templates:
+  - base.template.yml
+env:
+  DISCOURSE_HOSTNAME: base.example.com
+`)
+		writeFile("app.yml", `
+extends: base-site
+expose: !reset
+  - "8080:80"
+env:
+  DISCOURSE_HOSTNAME: app.example.com
+  UNICORN_WORKERS: !reset
+`)
+		conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+		Expect(err).To(BeNil())
+		Expect(conf.Expose).To(Equal([]string{"8080:80"}))
+		Expect(conf.Env["DISCOURSE_HOSTNAME"]).To(Equal("app.example.com"))
+		Expect(conf.Env).ToNot(HaveKey("UNICORN_WORKERS"))
+	})
+})
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+const gitTemplatePrefix = "git::"
+
+var commitRegexp = regexp.MustCompile("^[0-9a-f]{40}$")
+
+var httpClient = &http.Client{Timeout: 60 * time.Second}
+
+// Remote templates are referenced either by git repository and ref:
+//
+//	git::https://github.com/example/templates.git//web.template.yml?ref=v1.2.0
+//
+// or by http(s) url with a sha256 checksum of the file contents:
+//
+//	https://example.com/web.template.yml#sha256=<hex digest>
+//
+// Both are cached under utils.CacheDir and reused when offline.
+func isRemoteTemplate(template string) bool {
+	return strings.HasPrefix(template, gitTemplatePrefix) ||
+		strings.HasPrefix(template, "https://") ||
+		strings.HasPrefix(template, "http://")
+}
+
+func fetchRemoteTemplate(template string) ([]byte, error) {
+	if strings.HasPrefix(template, gitTemplatePrefix) {
+		return fetchGitTemplate(strings.TrimPrefix(template, gitTemplatePrefix))
+	}
+	return fetchHttpTemplate(template)
+}
+
+func cacheKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func fetchHttpTemplate(template string) ([]byte, error) {
+	url, fragment, _ := strings.Cut(template, "#")
+	checksum, found := strings.CutPrefix(fragment, "sha256=")
+	checksum = strings.ToLower(checksum)
+	if !found || len(checksum) != sha256.Size*2 {
+		return nil, errors.New("remote template " + template + " must be pinned with a checksum, e.g. " + url + "#sha256=<sha256 of file>")
+	}
+
+	cacheFile := filepath.Join(utils.CacheDir, "templates", "sha256", checksum+".yml")
+	if content, err := os.ReadFile(cacheFile); err == nil && cacheKey(string(content[:])) == checksum {
+		return content, nil
+	}
+
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download template %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unable to download template " + url + ": " + resp.Status)
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download template %s: %w", url, err)
+	}
+	if actual := cacheKey(string(content[:])); actual != checksum {
+		return nil, errors.New("checksum mismatch for template " + url + ": expected " + checksum + ", got " + actual)
+	}
+
+	if err := writeCacheFile(cacheFile, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+func writeCacheFile(file string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func fetchGitTemplate(template string) ([]byte, error) {
+	source, ref, _ := strings.Cut(template, "?ref=")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	// the file path is separated from the repository by a double slash, after any scheme
+	scheme, rest, hasScheme := strings.Cut(source, "://")
+	if !hasScheme {
+		scheme, rest = "", source
+	}
+	repo, path, found := strings.Cut(rest, "//")
+	if !found || path == "" {
+		return nil, errors.New("git template " + template + " must specify a file, e.g. git::https://example.com/templates.git//web.template.yml?ref=v1")
+	}
+	if hasScheme {
+		repo = scheme + "://" + repo
+	}
+
+	cacheRepo := filepath.Join(utils.CacheDir, "templates", "git", cacheKey(repo)+".git")
+	if _, err := os.Stat(cacheRepo); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(cacheRepo), 0755); err != nil {
+			return nil, err
+		}
+		cmd := exec.Command("git", "clone", "--quiet", "--mirror", repo, cacheRepo)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			os.RemoveAll(cacheRepo)
+			return nil, fmt.Errorf("unable to clone template repository %s: %w\n%s", repo, err, out)
+		}
+	} else if !commitRegexp.MatchString(ref) || !gitHasCommit(cacheRepo, ref) {
+		// pinned commits never change, anything else may have moved upstream
+		cmd := exec.Command("git", "--git-dir", cacheRepo, "fetch", "--quiet", "--prune", "--force", "origin")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			utils.LogWarn("unable to update template repository " + repo + ", using cached copy: " + strings.TrimSpace(string(out[:])))
+		}
+	}
+
+	cmd := exec.Command("git", "--git-dir", cacheRepo, "show", ref+":"+path)
+	content, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s at %s from template repository %s: %w", path, ref, repo, err)
+	}
+	return content, nil
+}
+
+func gitHasCommit(repo string, ref string) bool {
+	cmd := exec.Command("git", "--git-dir", repo, "cat-file", "-e", ref+"^{commit}")
+	return cmd.Run() == nil
+}
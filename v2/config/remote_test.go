@@ -0,0 +1,161 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Remote templates", func() {
+	var testDir string
+	var cacheDir string
+	var originalCacheDir string
+
+	writeFile := func(name string, content string) {
+		err := os.WriteFile(testDir+"/"+name, []byte(content), 0644)
+		Expect(err).To(BeNil())
+	}
+
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		Expect(err).To(BeNil(), string(out[:]))
+	}
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		cacheDir, _ = os.MkdirTemp("", "ddocker-cache")
+		originalCacheDir = utils.CacheDir
+		utils.CacheDir = cacheDir
+	})
+
+	AfterEach(func() {
+		utils.CacheDir = originalCacheDir
+		os.RemoveAll(testDir)
+		os.RemoveAll(cacheDir)
+	})
+
+	Context("from git", func() {
+		var repo string
+
+		BeforeEach(func() {
+			work := testDir + "/work"
+			repo = testDir + "/templates.git"
+			Expect(os.MkdirAll(work, 0755)).To(Succeed())
+			git(testDir, "init", "--quiet", "--bare", repo)
+			git(work, "init", "--quiet")
+			Expect(os.WriteFile(work+"/web.template.yml", []byte("base_image: discourse/base:v1\nenv:\n  VERSION: v1\n"), 0644)).To(Succeed())
+			git(work, "add", ".")
+			git(work, "commit", "--quiet", "-m", "v1")
+			git(work, "tag", "v1")
+			Expect(os.WriteFile(work+"/web.template.yml", []byte("base_image: discourse/base:v2\nenv:\n  VERSION: v2\n"), 0644)).To(Succeed())
+			git(work, "commit", "--quiet", "-am", "v2")
+			git(work, "push", "--quiet", repo, "HEAD:refs/heads/main", "--tags")
+		})
+
+		It("loads templates at a pinned ref", func() {
+			writeFile("app.yml", "templates:\n  - git::"+repo+"//web.template.yml?ref=v1\n")
+			conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).To(BeNil())
+			Expect(conf.Base_Image).To(Equal("discourse/base:v1"))
+			Expect(conf.Env["VERSION"]).To(Equal("v1"))
+			Expect(conf.MergeChain()[0]).To(Equal("git::" + repo + "//web.template.yml?ref=v1"))
+
+			writeFile("app.yml", "templates:\n  - git::"+repo+"//web.template.yml?ref=main\n")
+			conf, err = config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).To(BeNil())
+			Expect(conf.Env["VERSION"]).To(Equal("v2"))
+		})
+
+		It("reuses the cached repository when offline", func() {
+			writeFile("app.yml", "templates:\n  - git::"+repo+"//web.template.yml?ref=v1\n")
+			_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).To(BeNil())
+
+			Expect(os.RemoveAll(repo)).To(Succeed())
+			conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).To(BeNil())
+			Expect(conf.Env["VERSION"]).To(Equal("v1"))
+		})
+
+		It("errors on missing files and refs", func() {
+			writeFile("app.yml", "templates:\n  - git::"+repo+"//missing.template.yml?ref=v1\n")
+			_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).ToNot(BeNil())
+
+			writeFile("app.yml", "templates:\n  - git::"+repo+"//web.template.yml?ref=v9\n")
+			_, err = config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).ToNot(BeNil())
+
+			writeFile("app.yml", "templates:\n  - git::"+repo+"?ref=v1\n")
+			_, err = config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("must specify a file"))
+		})
+	})
+
+	Context("from http", func() {
+		var server *httptest.Server
+		var checksum string
+		template := "base_image: discourse/base:http\nenv:\n  FROM: http\n"
+
+		BeforeEach(func() {
+			sum := sha256.Sum256([]byte(template))
+			checksum = hex.EncodeToString(sum[:])
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/web.template.yml" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write([]byte(template))
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("loads templates matching their checksum, and reuses them when offline", func() {
+			writeFile("app.yml", "templates:\n  - "+server.URL+"/web.template.yml#sha256="+checksum+"\n")
+			conf, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).To(BeNil())
+			Expect(conf.Env["FROM"]).To(Equal("http"))
+
+			server.Close()
+			conf, err = config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).To(BeNil())
+			Expect(conf.Base_Image).To(Equal("discourse/base:http"))
+		})
+
+		It("errors on checksum mismatch", func() {
+			wrong := hex.EncodeToString(make([]byte, sha256.Size))
+			writeFile("app.yml", "templates:\n  - "+server.URL+"/web.template.yml#sha256="+wrong+"\n")
+			_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("checksum mismatch"))
+		})
+
+		It("errors on templates without a checksum", func() {
+			writeFile("app.yml", "templates:\n  - "+server.URL+"/web.template.yml\n")
+			_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("must be pinned with a checksum"))
+		})
+
+		It("errors on missing templates", func() {
+			writeFile("app.yml", "templates:\n  - "+server.URL+"/missing.yml#sha256="+checksum+"\n")
+			_, err := config.LoadConfig(testDir, "app", true, testDir, "")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("404"))
+		})
+	})
+})
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Shared memory size containers and image builds get when resources do not set one.
+// Postgres needs more than docker's default of 64m.
+const DefaultShmSize = "512m"
+
+// Resources limits what a container may use. Sizes are docker sizes, such as 512m or 4g.
+type Resources struct {
+	Memory string `yaml:"memory,omitempty"`
+	// Memory plus swap, -1 for unlimited swap
+	Memory_Swap string `yaml:",omitempty"`
+	// CPUs the container may use, such as 1.5
+	Cpus string `yaml:"cpus,omitempty"`
+	// Processes the container may run, -1 for unlimited
+	Pids_Limit int    `yaml:",omitempty"`
+	Shm_Size   string `yaml:",omitempty"`
+	// Ulimits by name, as soft:hard, or a single value for both
+	Ulimits map[string]string `yaml:"ulimits,omitempty"`
+}
+
+// ulimits docker supports setting
+var ulimitNames = []string{
+	"core", "cpu", "data", "fsize", "locks", "memlock", "msgqueue", "nice",
+	"nofile", "nproc", "rss", "rtprio", "rttime", "sigpending", "stack",
+}
+
+var sizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?) ?([kmgtp])?i?b?$`)
+
+// parseSize reads a docker size in bytes. Units are binary, as docker's are.
+func parseSize(size string) (int64, error) {
+	match := sizePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(size)))
+	if match == nil {
+		return 0, errors.New("invalid size " + size + ", use a number with an optional unit, such as 512m or 4g")
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	if match[2] != "" {
+		value *= float64(int64(1) << (10 * (strings.Index("kmgtp", match[2]) + 1)))
+	}
+	return int64(value), nil
+}
+
+// formatSize writes bytes in the largest unit that holds them exactly.
+func formatSize(bytes int64) string {
+	for i := 4; i >= 0; i-- {
+		unit := int64(1) << (10 * (i + 1))
+		if bytes >= unit && bytes%unit == 0 {
+			return strconv.FormatInt(bytes/unit, 10) + string("kmgtp"[i])
+		}
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+// parseUlimit reads soft:hard, or a single value for both. -1 is unlimited.
+func parseUlimit(name string, value string) (int64, int64, error) {
+	softValue, hardValue, found := strings.Cut(value, ":")
+	if !found {
+		hardValue = softValue
+	}
+	soft, softErr := strconv.ParseInt(strings.TrimSpace(softValue), 10, 64)
+	hard, hardErr := strconv.ParseInt(strings.TrimSpace(hardValue), 10, 64)
+	switch {
+	case softErr != nil || hardErr != nil || soft < -1 || hard < -1:
+		return 0, 0, errors.New("invalid ulimit " + name + ": " + value + ", use soft:hard, or a single value, -1 for unlimited")
+	case hard != -1 && (soft == -1 || soft > hard):
+		return 0, 0, errors.New("invalid ulimit " + name + ": " + value + ", the soft limit is above the hard limit")
+	}
+	return soft, hard, nil
+}
+
+func (r Resources) validate() error {
+	var memory int64
+	if r.Memory != "" {
+		var err error
+		if memory, err = parseSize(r.Memory); err != nil {
+			return errors.New("resources memory: " + err.Error())
+		}
+		// the smallest limit docker accepts
+		if memory < 6<<20 {
+			return errors.New("resources memory must be at least 6m")
+		}
+	}
+	if r.Memory_Swap != "" && r.Memory_Swap != "-1" {
+		swap, err := parseSize(r.Memory_Swap)
+		switch {
+		case err != nil:
+			return errors.New("resources memory_swap: " + err.Error())
+		case r.Memory == "":
+			return errors.New("resources memory_swap needs memory to be set")
+		case swap < memory:
+			return errors.New("resources memory_swap is memory plus swap, it must be at least memory " + r.Memory)
+		}
+	}
+	if r.Cpus != "" {
+		if cpus, err := strconv.ParseFloat(r.Cpus, 64); err != nil || cpus <= 0 {
+			return errors.New("invalid resources cpus " + r.Cpus + ", use a number of CPUs, such as 1.5")
+		}
+	}
+	if r.Pids_Limit < -1 {
+		return errors.New("invalid resources pids_limit " + strconv.Itoa(r.Pids_Limit) + ", use -1 for unlimited")
+	}
+	if r.Shm_Size != "" {
+		if _, err := parseSize(r.Shm_Size); err != nil {
+			return errors.New("resources shm_size: " + err.Error())
+		}
+	}
+	for name, value := range r.Ulimits {
+		if !slices.Contains(ulimitNames, name) {
+			return errors.New("unknown ulimit " + name + ", must be one of: " + strings.Join(ulimitNames, ", "))
+		}
+		if _, _, err := parseUlimit(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docker run flags resources set, by the resources setting that sets them
+var resourceDockerArgs = map[string]string{
+	"--memory": "memory", "-m": "memory", "--memory-swap": "memory_swap", "--cpus": "cpus",
+	"--pids-limit": "pids_limit", "--shm-size": "shm_size", "--ulimit": "ulimits",
+}
+
+func (r Resources) isSet() bool {
+	return r.Memory != "" || r.Memory_Swap != "" || r.Cpus != "" || r.Pids_Limit != 0 || r.Shm_Size != "" || len(r.Ulimits) > 0
+}
+
+// checkDockerArgs refuses docker args setting limits when resources are set, as which of the two
+// applies would depend on the order of the flags.
+func (r Resources) checkDockerArgs(args []string) error {
+	if !r.isSet() {
+		return nil
+	}
+	for _, flag := range dockerArgFlags(args) {
+		if setting, ok := resourceDockerArgs[flag]; ok {
+			return errors.New("docker_args: " + flag + " conflicts with resources, set resources " + setting + " instead")
+		}
+	}
+	return nil
+}
+
+// ShmSize is the shared memory size, DefaultShmSize unless set.
+func (r Resources) ShmSize() string {
+	if r.Shm_Size != "" {
+		return r.Shm_Size
+	}
+	return DefaultShmSize
+}
+
+// RunArgs are the docker run flags applying the limits.
+func (r Resources) RunArgs() []string {
+	args := []string{"--shm-size=" + r.ShmSize()}
+	if r.Memory != "" {
+		args = append(args, "--memory="+r.Memory)
+	}
+	if r.Memory_Swap != "" {
+		args = append(args, "--memory-swap="+r.Memory_Swap)
+	}
+	if r.Cpus != "" {
+		args = append(args, "--cpus="+r.Cpus)
+	}
+	if r.Pids_Limit != 0 {
+		args = append(args, "--pids-limit="+strconv.Itoa(r.Pids_Limit))
+	}
+	return append(args, r.ulimitArgs()...)
+}
+
+// BuildArgs are the docker build flags applying the limits. Builds only support
+// shared memory and ulimits, memory and CPU limits apply to containers.
+func (r Resources) BuildArgs() []string {
+	return append([]string{"--shm-size=" + r.ShmSize()}, r.ulimitArgs()...)
+}
+
+func (r Resources) ulimitArgs() []string {
+	args := []string{}
+	for _, name := range r.ulimitList() {
+		args = append(args, "--ulimit="+name)
+	}
+	return args
+}
+
+// ulimitList lists ulimits as name=soft:hard, sorted by name.
+func (r Resources) ulimitList() []string {
+	list := []string{}
+	for name, value := range r.Ulimits {
+		soft, hard, err := parseUlimit(name, value)
+		if err != nil {
+			list = append(list, name+"="+value)
+			continue
+		}
+		list = append(list, name+"="+strconv.FormatInt(soft, 10)+":"+strconv.FormatInt(hard, 10))
+	}
+	slices.Sort(list)
+	return list
+}
+
+// resourceList lists the limits as name=value, with sizes in a single form, so
+// limits written differently, or read from a container, compare equal.
+func (config *Config) resourceList() []string {
+	r := config.Resources
+	size := func(value string) string {
+		if bytes, err := parseSize(value); err == nil {
+			return formatSize(bytes)
+		}
+		return value
+	}
+	list := []string{"shm_size=" + size(r.ShmSize())}
+	if r.Memory != "" {
+		list = append(list, "memory="+size(r.Memory))
+	}
+	// docker sets swap to twice the memory when it is not set
+	memory, _ := parseSize(r.Memory)
+	if swap, err := parseSize(r.Memory_Swap); r.Memory_Swap == "-1" || (err == nil && swap != 2*memory) {
+		list = append(list, "memory_swap="+size(r.Memory_Swap))
+	}
+	if cpus, err := strconv.ParseFloat(r.Cpus, 64); err == nil {
+		list = append(list, "cpus="+strconv.FormatFloat(cpus, 'f', -1, 64))
+	}
+	// docker treats 0 and below as unlimited
+	if r.Pids_Limit > 0 {
+		list = append(list, "pids_limit="+strconv.Itoa(r.Pids_Limit))
+	}
+	for _, ulimit := range r.ulimitList() {
+		list = append(list, "ulimit "+ulimit)
+	}
+	return list
+}
@@ -2,11 +2,12 @@ package docker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
 	"os/exec"
 	"runtime"
+	"slices"
 	"sort"
 	"strings"
 	"syscall"
@@ -48,12 +49,12 @@ func (r *DockerBuilder) Run() error {
 	cmd.Args = append(cmd.Args, "--force-rm")
 	cmd.Args = append(cmd.Args, "-t")
 	cmd.Args = append(cmd.Args, r.Namespace+"/"+r.Config.Name+":"+r.ImageTag)
-	cmd.Args = append(cmd.Args, "--shm-size=512m")
+	cmd.Args = append(cmd.Args, r.Config.Resources.BuildArgs()...)
 	cmd.Args = append(cmd.Args, "-f")
 	cmd.Args = append(cmd.Args, "-")
 	cmd.Args = append(cmd.Args, ".")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = utils.Stdout
+	cmd.Stderr = utils.Stderr
 	cmd.Stdin = r.Stdin
 	if err := utils.CmdRunner(cmd).Run(); err != nil {
 		return err
@@ -145,16 +146,40 @@ func (r *DockerRunner) Run() error {
 	}
 
 	for _, v := range r.Config.Volumes {
+		if v.Volume.Kind() == config.VolumeTmpfs {
+			mount := v.Volume.Guest
+			if options := v.Volume.MountOptions(); len(options) > 0 {
+				mount += ":" + strings.Join(options, ",")
+			}
+			cmd.Args = append(cmd.Args, "--tmpfs")
+			cmd.Args = append(cmd.Args, mount)
+			continue
+		}
 		cmd.Args = append(cmd.Args, "--volume")
-		cmd.Args = append(cmd.Args, v.Volume.Host+":"+v.Volume.Guest)
+		cmd.Args = append(cmd.Args, v.Volume.String())
 	}
 
-	for _, v := range r.Config.Links {
-		cmd.Args = append(cmd.Args, "--link")
-		cmd.Args = append(cmd.Args, v.Link.Name+":"+v.Link.Alias)
+	networks, aliases := r.Config.NetworkAliases()
+	if len(networks) == 1 {
+		cmd.Args = append(cmd.Args, "--network")
+		cmd.Args = append(cmd.Args, networks[0])
+		for _, alias := range aliases[networks[0]] {
+			cmd.Args = append(cmd.Args, "--network-alias")
+			cmd.Args = append(cmd.Args, alias)
+		}
+	} else {
+		// attaching to several networks on run needs the long form, with aliases per network
+		for _, network := range networks {
+			flag := "name=" + network
+			for _, alias := range aliases[network] {
+				flag += ",alias=" + alias
+			}
+			cmd.Args = append(cmd.Args, "--network")
+			cmd.Args = append(cmd.Args, flag)
+		}
 	}
 
-	cmd.Args = append(cmd.Args, "--shm-size=512m")
+	cmd.Args = append(cmd.Args, r.Config.Resources.RunArgs()...)
 
 	if r.Rm {
 		cmd.Args = append(cmd.Args, "--rm")
@@ -189,27 +214,40 @@ func (r *DockerRunner) Run() error {
 	cmd.Args = append(cmd.Args, "--name")
 	cmd.Args = append(cmd.Args, r.ContainerId)
 
+	image := r.Config.RunImage()
 	if len(r.CustomImage) > 0 {
-		cmd.Args = append(cmd.Args, r.CustomImage)
-	} else {
-		cmd.Args = append(cmd.Args, r.Config.RunImage())
+		image = r.CustomImage
 	}
+	cmd.Args = append(cmd.Args, image)
 
 	for _, c := range r.Cmd {
 		cmd.Args = append(cmd.Args, c)
 	}
 
 	if !r.Detatch {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = utils.Stdout
+		cmd.Stderr = utils.Stderr
 		cmd.Stdin = r.Stdin
 	}
 
+	// dry runs print the network commands along with the docker run, rather than running them
+	connect := utils.CmdRunner
+	if r.DryRun {
+		connect = utils.NewDryRunCmdRunner
+	}
+	if err := CreateNetworks(r.Config, connect); err != nil {
+		return err
+	}
+	if err := ConnectLinks(r.Config, connect); err != nil {
+		return err
+	}
+
 	runner := utils.CmdRunner(cmd)
 
 	if r.DryRun {
-		fmt.Println(cmd)
+		fmt.Fprintln(utils.Out, utils.RedactCmd(cmd))
 	} else {
+		utils.Emit(utils.Event{Type: utils.EventContainer, Container: r.ContainerId, Image: image})
 		if err := runner.Run(); err != nil {
 			return err
 		}
@@ -275,15 +313,17 @@ func (r *DockerPupsRunner) Run() error {
 			"--change",
 			"LABEL org.opencontainers.image.created=\""+time.Now().UTC().Format(time.RFC3339)+"\"",
 			"--change",
+			"LABEL "+config.EnvHashLabel+"="+r.Config.EnvHash(),
+			"--change",
 			"CMD [\""+r.Config.BootCommand()+"\"]",
 			r.ContainerId,
 			r.SavedImageName,
 		)
 
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = utils.Stdout
+		cmd.Stderr = utils.Stderr
 
-		fmt.Fprintln(utils.Out, cmd)
+		utils.EchoCmd(cmd)
 
 		if err := utils.CmdRunner(cmd).Run(); err != nil {
 			return err
@@ -322,3 +362,100 @@ func ContainerRunning(container string) (bool, error) {
 
 	return false, nil
 }
+
+// CreateNetworks creates a config's networks as bridge networks, unless they already exist.
+// Networks are queried with utils.CmdRunner, and created with run.
+func CreateNetworks(conf *config.Config, run func(*exec.Cmd) utils.ICmdRunner) error {
+	networks, _ := conf.NetworkAliases()
+	for _, network := range networks {
+		cmd := exec.Command(utils.DockerPath, "network", "ls", "--format", "{{.Name}}", "--filter", "name="+network)
+		result, err := utils.CmdRunner(cmd).Output()
+		if err != nil {
+			return err
+		}
+		// the name filter also matches partial names
+		if slices.Contains(strings.Fields(string(result[:])), network) {
+			continue
+		}
+		cmd = exec.Command(utils.DockerPath, "network", "create", "--driver", "bridge", network)
+		utils.EchoCmd(cmd)
+		if err := run(cmd).Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectLinks connects the containers a config links to to config.LinkNetwork, with their
+// link alias, so the config's container reaches them as it did with docker's deprecated --link.
+// Linked containers are inspected with utils.CmdRunner, and connected with run.
+func ConnectLinks(conf *config.Config, run func(*exec.Cmd) utils.ICmdRunner) error {
+	if len(conf.Links) == 0 {
+		return nil
+	}
+	utils.LogWarn("links are deprecated, linked containers are connected to the " + config.LinkNetwork + " network instead. Run ./launcher config migrate-links to move links to networks in the config")
+	for _, l := range conf.Links {
+		inspect, err := inspectContainer(l.Link.Name)
+		if err != nil {
+			return errors.New("Unable to connect linked container " + l.Link.Name + ": " + err.Error())
+		}
+		if network, ok := inspect.NetworkSettings.Networks[config.LinkNetwork]; ok {
+			if !slices.Contains(network.Aliases, l.Link.Alias) {
+				utils.LogWarn(l.Link.Name + " is on the " + config.LinkNetwork + " network without its link alias " + l.Link.Alias +
+					", reconnect it with: docker network disconnect " + config.LinkNetwork + " " + l.Link.Name +
+					" && docker network connect --alias " + l.Link.Alias + " " + config.LinkNetwork + " " + l.Link.Name)
+			}
+			continue
+		}
+		cmd := exec.Command(utils.DockerPath, "network", "connect", "--alias", l.Link.Alias, config.LinkNetwork, l.Link.Name)
+		utils.EchoCmd(cmd)
+		if err := run(cmd).Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateVolume creates a named volume.
+func CreateVolume(name string) error {
+	cmd := exec.Command(utils.DockerPath, "volume", "create", name)
+	utils.EchoCmd(cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+// BuildContainers lists running containers launcher started from an image to migrate or configure it.
+func BuildContainers(image string) ([]string, error) {
+	cmd := exec.Command(utils.DockerPath, "ps", "--quiet", "--filter", "name=discourse-build-", "--filter", "ancestor="+image)
+	result, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(result)), nil
+}
+
+// Available checks whether the docker daemon can be reached.
+func Available() bool {
+	if utils.DockerPath == "" {
+		return false
+	}
+	cmd := exec.Command(utils.DockerPath, "info", "--format", "{{.ServerVersion}}")
+	_, err := utils.CmdRunner(cmd).Output()
+	return err == nil
+}
+
+// ClassifyError reports errors from docker commands as ErrDockerUnavailable when docker can't be reached,
+// as commands then fail for reasons unrelated to what they were doing.
+func ClassifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if kind, ok := utils.ErrorKindOf(err); ok && kind != utils.ErrBuild && kind != utils.ErrMigrate && kind != utils.ErrPrecompile {
+		return err
+	}
+	var execErr *exec.Error
+	var exitErr *exec.ExitError
+	if utils.DockerPath == "" || errors.As(err, &execErr) || (errors.As(err, &exitErr) && !Available()) {
+		return utils.NewError(utils.ErrDockerUnavailable, "Docker is not available. Check docker is installed and the docker daemon is running.", err)
+	}
+	return err
+}
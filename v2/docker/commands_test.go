@@ -6,6 +6,8 @@ import (
 
 	"bytes"
 	"context"
+	"os/exec"
+
 	"github.com/discourse/launcher/v2/config"
 	"github.com/discourse/launcher/v2/docker"
 	. "github.com/discourse/launcher/v2/test_utils"
@@ -39,5 +41,158 @@ var _ = Describe("Commands", func() {
 			cmd = GetLastCommand()
 			Expect(cmd.String()).To(ContainSubstring("docker rm"))
 		})
+
+		It("creates missing networks, and attaches containers with their aliases", func() {
+			conf.Networks = []config.NetworkEntry{
+				{Network: config.Network{Name: "discourse", Alias: "data"}},
+				{Network: config.Network{Name: "discourse", Alias: "db"}},
+			}
+			// the name filter matches partial names
+			CmdOutputResponse = []byte("discourse-old\n")
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test"}
+			Expect(runner.Run()).To(Succeed())
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker network ls --format {{.Name}} --filter name=discourse"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker network create --driver bridge discourse"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker run"))
+			Expect(cmd.String()).To(ContainSubstring("--network discourse --network-alias data --network-alias db"))
+		})
+
+		It("runs links as aliases on the discourse network, connecting linked containers", func() {
+			conf.Links = []config.LinkEntry{
+				{Link: config.Link{Name: "data", Alias: "db"}},
+				{Link: config.Link{Name: "mail", Alias: "smtp"}},
+			}
+			CmdOutputResponses["docker network ls"] = []byte("discourse\n")
+			CmdOutputResponses["container data"] = []byte(`[{"NetworkSettings": {"Networks": {"bridge": {}}}}]`)
+			CmdOutputResponses["container mail"] = []byte(`[{"NetworkSettings": {"Networks": {"discourse": {"Aliases": ["mail"]}}}}]`)
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test"}
+			Expect(runner.Run()).To(Succeed())
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker network ls"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker inspect --type container data"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker network connect --alias db discourse data"))
+			// already on the network, but without its alias, which needs reconnecting by hand
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker inspect --type container mail"))
+			Expect(out.String()).To(ContainSubstring("docker network connect --alias smtp discourse mail"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker run"))
+			Expect(cmd.String()).To(ContainSubstring("--network discourse"))
+			Expect(cmd.String()).ToNot(ContainSubstring("--link"))
+			Expect(RanCmds).To(BeEmpty())
+
+			CmdOutputResponses["container data"] = []byte(`[]`)
+			err := runner.Run()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Unable to connect linked container data: container data was not found"))
+		})
+
+		It("prints network commands on dry runs, rather than running them", func() {
+			utils.DryRun = true
+			defer func() { utils.DryRun = false }()
+			conf.Links = []config.LinkEntry{{Link: config.Link{Name: "data", Alias: "db"}}}
+			CmdOutputResponses["container data"] = []byte(`[{"NetworkSettings": {"Networks": {"bridge": {}}}}]`)
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test", DryRun: true}
+			Expect(runner.Run()).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("docker network create --driver bridge discourse\n"))
+			Expect(out.String()).To(ContainSubstring("docker network connect --alias db discourse data\n"))
+			Expect(out.String()).To(ContainSubstring("docker run"))
+			// only the queries ran
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker network ls"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker inspect --type container data"))
+			Expect(RanCmds).To(BeEmpty())
+		})
+
+		It("mounts named volumes, tmpfs, and mount options", func() {
+			conf.Volumes = []config.VolumeEntry{
+				{Volume: config.Volume{Host: "/var/discourse/shared/app", Guest: "/shared", Options: "z"}},
+				{Volume: config.Volume{Name: "uploads", Guest: "/uploads", Read_Only: true}},
+				{Volume: config.Volume{Tmpfs: true, Guest: "/tmp", Options: "size=64m"}},
+			}
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test"}
+			Expect(runner.Run()).To(Succeed())
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("--volume /var/discourse/shared/app:/shared:z --volume uploads:/uploads:ro --tmpfs /tmp:size=64m"))
+		})
+
+		It("applies resource limits to builds and runs", func() {
+			conf.Resources = config.Resources{Memory: "4g", Cpus: "2", Shm_Size: "1g", Ulimits: map[string]string{"nofile": "4096:8192"}}
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test"}
+			Expect(runner.Run()).To(Succeed())
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("--shm-size=1g --memory=4g --cpus=2 --ulimit=nofile=4096:8192 --restart=no"))
+
+			builder := docker.DockerBuilder{Config: conf, Ctx: &ctx, Namespace: "local_discourse"}
+			Expect(builder.Run()).To(Succeed())
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker build"))
+			Expect(cmd.String()).To(ContainSubstring("--shm-size=1g --ulimit=nofile=4096:8192 -f"))
+			Expect(cmd.String()).ToNot(ContainSubstring("--memory"))
+		})
+
+		It("attaches containers to several networks", func() {
+			conf.Networks = []config.NetworkEntry{
+				{Network: config.Network{Name: "discourse", Alias: "data"}},
+				{Network: config.Network{Name: "monitoring"}},
+			}
+			CmdOutputResponse = []byte("discourse\nmonitoring\n")
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test"}
+			Expect(runner.Run()).To(Succeed())
+			GetLastCommand()
+			GetLastCommand()
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker run"))
+			Expect(cmd.String()).To(ContainSubstring("--network name=discourse,alias=data --network name=monitoring"))
+			Expect(RanCmds).To(BeEmpty())
+		})
+	})
+
+	Context("when classifying errors", func() {
+		var failed error
+
+		BeforeEach(func() {
+			utils.DockerPath = "docker"
+			utils.CmdRunner = CreateNewFakeCmdRunner()
+			failed = exec.Command("sh", "-c", "exit 1").Run()
+		})
+
+		It("reports failed commands as docker unavailable when the daemon can't be reached", func() {
+			CmdOutputError = failed
+			err := docker.ClassifyError(utils.NewError(utils.ErrBuild, "build failed", failed))
+			kind, _ := utils.ErrorKindOf(err)
+			Expect(kind).To(Equal(utils.ErrDockerUnavailable))
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("docker info"))
+		})
+
+		It("keeps errors when docker is available", func() {
+			err := docker.ClassifyError(utils.NewError(utils.ErrBuild, "build failed", failed))
+			kind, _ := utils.ErrorKindOf(err)
+			Expect(kind).To(Equal(utils.ErrBuild))
+		})
+
+		It("reports docker as unavailable when it is not installed", func() {
+			utils.DockerPath = ""
+			utils.CmdRunner = utils.NewExecCmdRunner
+			_, err := docker.ContainerExists("test")
+			err = docker.ClassifyError(err)
+			kind, _ := utils.ErrorKindOf(err)
+			Expect(kind).To(Equal(utils.ErrDockerUnavailable))
+		})
+
+		It("does not check docker for errors unrelated to it", func() {
+			CmdOutputError = failed
+			err := docker.ClassifyError(utils.NewError(utils.ErrConfig, "YAML syntax error", nil))
+			kind, _ := utils.ErrorKindOf(err)
+			Expect(kind).To(Equal(utils.ErrConfig))
+			Expect(RanCmds).To(BeEmpty())
+		})
 	})
 })
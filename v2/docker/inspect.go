@@ -0,0 +1,291 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+type containerInspect struct {
+	Id     string
+	Image  string
+	State  ContainerState
+	Config struct {
+		Image        string
+		Env          []string
+		Labels       map[string]string
+		ExposedPorts map[string]struct{}
+	}
+	HostConfig struct {
+		Binds        []string
+		Tmpfs        map[string]string
+		Links        []string
+		PortBindings map[string][]struct {
+			HostIp   string
+			HostPort string
+		}
+		Memory     int64
+		MemorySwap int64
+		NanoCpus   int64
+		PidsLimit  *int64
+		ShmSize    int64
+		Ulimits    []struct {
+			Name string
+			Soft int64
+			Hard int64
+		}
+	}
+	NetworkSettings struct {
+		Networks map[string]struct {
+			Aliases []string
+		}
+	}
+}
+
+// networks docker attaches containers to, which configs do not list
+var defaultNetworks = []string{"bridge", "host", "none"}
+
+// InspectContainer reads the settings a container was started with, as a config.
+// Run_Image is set to the image name the container was started from.
+func InspectContainer(container string) (*config.Config, error) {
+	inspect, err := inspectContainer(container)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &config.Config{
+		Name:      container,
+		Run_Image: inspect.Config.Image,
+		Env:       map[string]string{},
+		Labels:    inspect.Config.Labels,
+	}
+
+	for _, e := range inspect.Config.Env {
+		k, v, _ := strings.Cut(e, "=")
+		conf.Env[k] = v
+	}
+
+	for port, bindings := range inspect.HostConfig.PortBindings {
+		containerPort := strings.TrimSuffix(port, "/tcp")
+		for _, b := range bindings {
+			published := b.HostPort + ":" + containerPort
+			if b.HostIp != "" {
+				published = b.HostIp + ":" + published
+			}
+			conf.Expose = append(conf.Expose, published)
+		}
+	}
+	for port := range inspect.Config.ExposedPorts {
+		conf.Expose = append(conf.Expose, strings.TrimSuffix(port, "/tcp"))
+	}
+	slices.Sort(conf.Expose)
+
+	for _, bind := range inspect.HostConfig.Binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) < 2 {
+			continue
+		}
+		volume := config.Volume{Host: parts[0], Guest: parts[1]}
+		if !strings.HasPrefix(parts[0], "/") {
+			volume = config.Volume{Name: parts[0], Guest: parts[1]}
+		}
+		if len(parts) > 2 {
+			volume.Options = parts[2]
+		}
+		conf.Volumes = append(conf.Volumes, config.VolumeEntry{Volume: volume})
+	}
+	tmpfs := []string{}
+	for guest := range inspect.HostConfig.Tmpfs {
+		tmpfs = append(tmpfs, guest)
+	}
+	slices.Sort(tmpfs)
+	for _, guest := range tmpfs {
+		conf.Volumes = append(conf.Volumes, config.VolumeEntry{Volume: config.Volume{Tmpfs: true, Guest: guest, Options: inspect.HostConfig.Tmpfs[guest]}})
+	}
+
+	// links are reported as /name:/container/alias
+	for _, link := range inspect.HostConfig.Links {
+		name, alias, _ := strings.Cut(link, ":")
+		conf.Links = append(conf.Links, config.LinkEntry{Link: config.Link{
+			Name:  strings.TrimPrefix(name, "/"),
+			Alias: alias[strings.LastIndex(alias, "/")+1:],
+		}})
+	}
+
+	// docker adds the container's name and short id as aliases
+	networks := []string{}
+	for name := range inspect.NetworkSettings.Networks {
+		if !slices.Contains(defaultNetworks, name) {
+			networks = append(networks, name)
+		}
+	}
+	slices.Sort(networks)
+	for _, name := range networks {
+		aliases := slices.DeleteFunc(slices.Clone(inspect.NetworkSettings.Networks[name].Aliases), func(alias string) bool {
+			return alias == container || (len(alias) == 12 && strings.HasPrefix(inspect.Id, alias))
+		})
+		if len(aliases) == 0 {
+			conf.Networks = append(conf.Networks, config.NetworkEntry{Network: config.Network{Name: name}})
+		}
+		for _, alias := range aliases {
+			conf.Networks = append(conf.Networks, config.NetworkEntry{Network: config.Network{Name: name, Alias: alias}})
+		}
+	}
+
+	conf.Resources = inspectResources(inspect)
+
+	return conf, nil
+}
+
+// inspectResources reads a container's limits, with sizes in bytes.
+func inspectResources(inspect *containerInspect) config.Resources {
+	host := inspect.HostConfig
+	resources := config.Resources{}
+	if host.ShmSize > 0 {
+		resources.Shm_Size = strconv.FormatInt(host.ShmSize, 10)
+	}
+	if host.Memory > 0 {
+		resources.Memory = strconv.FormatInt(host.Memory, 10)
+	}
+	if host.MemorySwap != 0 {
+		resources.Memory_Swap = strconv.FormatInt(host.MemorySwap, 10)
+	}
+	if host.NanoCpus > 0 {
+		resources.Cpus = strconv.FormatFloat(float64(host.NanoCpus)/1e9, 'f', -1, 64)
+	}
+	if host.PidsLimit != nil {
+		resources.Pids_Limit = int(*host.PidsLimit)
+	}
+	for _, u := range host.Ulimits {
+		if resources.Ulimits == nil {
+			resources.Ulimits = map[string]string{}
+		}
+		resources.Ulimits[u.Name] = strconv.FormatInt(u.Soft, 10) + ":" + strconv.FormatInt(u.Hard, 10)
+	}
+	return resources
+}
+
+// ContainerImageId returns the id of the image a container was started from.
+func ContainerImageId(container string) (string, error) {
+	inspect, err := inspectContainer(container)
+	if err != nil {
+		return "", err
+	}
+	return inspect.Image, nil
+}
+
+// ContainerState is whether a container is running, and its health when it has a healthcheck.
+type ContainerState struct {
+	Status string
+	Health *struct {
+		Status string
+	}
+}
+
+// Ready reports whether a container is running, and healthy when it has a healthcheck.
+func (s *ContainerState) Ready() bool {
+	return s.Status == "running" && (s.Health == nil || s.Health.Status == "healthy")
+}
+
+func (s *ContainerState) String() string {
+	if s.Health != nil {
+		return s.Status + ", " + s.Health.Status
+	}
+	return s.Status
+}
+
+// InspectState reads the state of a container.
+func InspectState(container string) (*ContainerState, error) {
+	inspect, err := inspectContainer(container)
+	if err != nil {
+		return nil, err
+	}
+	return &inspect.State, nil
+}
+
+// VolumeInfo is a docker managed volume.
+type VolumeInfo struct {
+	Name       string
+	Driver     string
+	Mountpoint string
+}
+
+// InspectVolume reads a named volume, or returns nil if it does not exist.
+func InspectVolume(name string) (*VolumeInfo, error) {
+	cmd := exec.Command(utils.DockerPath, "volume", "ls", "--format", "{{json .}}", "--filter", "name="+name)
+	result, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return nil, err
+	}
+	// the name filter also matches partial names
+	for _, line := range strings.Split(string(result[:]), "\n") {
+		info := &VolumeInfo{}
+		if json.Unmarshal([]byte(line), info) == nil && info.Name == name {
+			return info, nil
+		}
+	}
+	return nil, nil
+}
+
+// ImageId returns the id of an image, or an empty string if it does not exist.
+func ImageId(image string) (string, error) {
+	cmd := exec.Command(utils.DockerPath, "image", "inspect", "--format", "{{.Id}}", image)
+	result, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(result[:])), nil
+}
+
+// DaemonInfo is the docker daemon's version and storage settings.
+type DaemonInfo struct {
+	ServerVersion string
+	Driver        string
+	DockerRootDir string
+}
+
+// Info queries the docker daemon's version and storage settings.
+func Info() (*DaemonInfo, error) {
+	if utils.DockerPath == "" {
+		return nil, errors.New("docker was not found in PATH")
+	}
+	cmd := exec.Command(utils.DockerPath, "info", "--format", "{{json .}}")
+	result, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return nil, err
+	}
+	info := &DaemonInfo{}
+	if err := json.Unmarshal(result, info); err != nil {
+		return nil, err
+	}
+	if info.ServerVersion == "" {
+		return nil, errors.New("docker daemon did not report a version, check it is running")
+	}
+	return info, nil
+}
+
+func inspectContainer(container string) (*containerInspect, error) {
+	cmd := exec.Command(utils.DockerPath, "inspect", "--type", "container", container)
+	result, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return nil, err
+	}
+	inspects := []containerInspect{}
+	if err := json.Unmarshal(result, &inspects); err != nil {
+		return nil, err
+	}
+	if len(inspects) == 0 {
+		return nil, utils.NewError(utils.ErrNotFound, "container "+container+" was not found", nil)
+	}
+	return &inspects[0], nil
+}
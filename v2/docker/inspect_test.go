@@ -0,0 +1,96 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/launcher/v2/config"
+	"github.com/discourse/launcher/v2/docker"
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Inspect", func() {
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+
+	It("reads container settings as a config", func() {
+		CmdOutputResponse = []byte(`[{
+			"Id": "0123456789abcdef0123",
+			"Image": "sha256:abc",
+			"Config": {
+				"Image": "local_discourse/app",
+				"Env": ["PATH=/usr/bin", "MULTI=a=b"],
+				"Labels": {"app": "forum"},
+				"ExposedPorts": {"80/tcp": {}, "90/tcp": {}}
+			},
+			"HostConfig": {
+				"Binds": ["/var/discourse/shared/app:/shared", "/var/log/app:/var/log:ro", "uploads:/uploads:z"],
+				"Tmpfs": {"/tmp": "size=64m"},
+				"Links": ["/data:/app/db"],
+				"PortBindings": {"80/tcp": [{"HostIp": "", "HostPort": "8080"}], "443/tcp": [{"HostIp": "127.0.0.1", "HostPort": "443"}]},
+				"Memory": 4294967296,
+				"MemorySwap": -1,
+				"NanoCpus": 1500000000,
+				"PidsLimit": null,
+				"ShmSize": 536870912,
+				"Ulimits": [{"Name": "nofile", "Soft": 1024, "Hard": 4096}]
+			},
+			"NetworkSettings": {
+				"Networks": {
+					"bridge": {"Aliases": null},
+					"discourse": {"Aliases": ["app", "0123456789ab", "forum"]},
+					"monitoring": {"Aliases": ["0123456789ab"]}
+				}
+			}
+		}]`)
+		conf, err := docker.InspectContainer("app")
+		Expect(err).To(BeNil())
+		cmd := GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker inspect --type container app"))
+		Expect(conf.Run_Image).To(Equal("local_discourse/app"))
+		Expect(conf.Env).To(Equal(map[string]string{"PATH": "/usr/bin", "MULTI": "a=b"}))
+		Expect(conf.Labels).To(Equal(map[string]string{"app": "forum"}))
+		Expect(conf.Expose).To(Equal([]string{"127.0.0.1:443:443", "80", "8080:80", "90"}))
+		Expect(conf.Volumes).To(Equal([]config.VolumeEntry{
+			{Volume: config.Volume{Host: "/var/discourse/shared/app", Guest: "/shared"}},
+			{Volume: config.Volume{Host: "/var/log/app", Guest: "/var/log", Options: "ro"}},
+			{Volume: config.Volume{Name: "uploads", Guest: "/uploads", Options: "z"}},
+			{Volume: config.Volume{Tmpfs: true, Guest: "/tmp", Options: "size=64m"}},
+		}))
+		Expect(conf.Links).To(Equal([]config.LinkEntry{{Link: config.Link{Name: "data", Alias: "db"}}}))
+		Expect(conf.Networks).To(Equal([]config.NetworkEntry{
+			{Network: config.Network{Name: "discourse", Alias: "forum"}},
+			{Network: config.Network{Name: "monitoring"}},
+		}))
+
+		Expect(conf.Resources).To(Equal(config.Resources{
+			Memory:      "4294967296",
+			Memory_Swap: "-1",
+			Cpus:        "1.5",
+			Shm_Size:    "536870912",
+			Ulimits:     map[string]string{"nofile": "1024:4096"},
+		}))
+
+		id, err := docker.ContainerImageId("app")
+		Expect(err).To(BeNil())
+		Expect(id).To(Equal("sha256:abc"))
+	})
+
+	It("errors when the container is not found", func() {
+		CmdOutputResponse = []byte(`[]`)
+		_, err := docker.InspectContainer("app")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("reads docker daemon info", func() {
+		CmdOutputResponse = []byte(`{"ServerVersion": "27.1.1", "Driver": "overlay2", "DockerRootDir": "/var/lib/docker", "Containers": 3}`)
+		info, err := docker.Info()
+		Expect(err).To(BeNil())
+		Expect(*info).To(Equal(docker.DaemonInfo{ServerVersion: "27.1.1", Driver: "overlay2", DockerRootDir: "/var/lib/docker"}))
+		cmd := GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker info --format {{json .}}"))
+	})
+})
@@ -12,6 +12,7 @@ require (
 	github.com/posener/complete v1.2.3
 	github.com/willabides/kongplete v0.4.0
 	golang.org/x/sys v0.28.0
+	golang.org/x/term v0.27.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -1,6 +1,8 @@
 package main_test
 
 import (
+	"os/exec"
+	"strings"
 	"testing"
 
 	"github.com/discourse/launcher/v2/utils"
@@ -16,3 +18,30 @@ func TestMain(t *testing.T) {
 var _ = BeforeSuite(func() {
 	utils.CommitWait = 0
 })
+
+// linkedDataRunner answers the queries connecting the test config's link to data, without recording them,
+// as data is already on the discourse network.
+type linkedDataRunner struct {
+	utils.ICmdRunner
+	cmd *exec.Cmd
+}
+
+var linkQueries int
+
+func (r *linkedDataRunner) Output() ([]byte, error) {
+	switch {
+	case strings.Contains(r.cmd.String(), "docker network ls"):
+		linkQueries++
+		return []byte("discourse\n"), nil
+	case strings.Contains(r.cmd.String(), "docker inspect --type container data"):
+		linkQueries++
+		return []byte(`[{"NetworkSettings": {"Networks": {"discourse": {"Aliases": ["data"]}}}}]`), nil
+	}
+	return r.ICmdRunner.Output()
+}
+
+func withLinkedData(runner func(*exec.Cmd) utils.ICmdRunner) func(*exec.Cmd) utils.ICmdRunner {
+	return func(cmd *exec.Cmd) utils.ICmdRunner {
+		return &linkedDataRunner{ICmdRunner: runner(cmd), cmd: cmd}
+	}
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/alecthomas/kong"
+	"github.com/discourse/launcher/v2/docker"
 	"github.com/discourse/launcher/v2/utils"
 	"github.com/posener/complete"
 	"github.com/willabides/kongplete"
 	"golang.org/x/sys/unix"
+	"io"
 	"os"
-	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Cli struct {
@@ -19,6 +24,16 @@ type Cli struct {
 	TemplatesDir string             `default:"." hidden:"" help:"Home project directory containing a templates/ directory which in turn contains pups yaml templates." predictor:"dir"`
 	BuildDir     string             `default:"./tmp" hidden:"" help:"Temporary build folder for building images." predictor:"dir"`
 	Namespace    string             `default:"local_discourse" env:"DISCOURSE_NAMESPACE" help:"image namespace."`
+	ReportFile   string             `name:"report-file" help:"Write a JSON report of timed stages to a file." predictor:"file"`
+	Events       string             `name:"events" enum:"none,json" default:"none" help:"Emit machine-readable progress events (none, json). json writes newline delimited json to --events-file."`
+	EventsFile   string             `name:"events-file" help:"File to write events to, such as /dev/fd/3." predictor:"file"`
+	LogLevel     string             `name:"log-level" enum:"debug,info,warn,error" default:"info" help:"Print messages of this level and above (debug, info, warn, error)."`
+	Quiet        bool               `short:"q" xor:"verbosity" help:"Only print warnings and errors. Same as --log-level warn."`
+	Verbose      bool               `short:"v" xor:"verbosity" help:"Also print debug messages, such as docker queries. Same as --log-level debug."`
+	LogFile      string             `name:"log-file" help:"Append a full transcript, including docker output and debug messages, to a file." predictor:"file"`
+	ShowSecrets  bool               `name:"show-secrets" help:"Print secret env values in commands and configs, instead of masking them."`
+	DryRun       bool               `name:"dry-run" short:"n" help:"Print docker commands instead of running them. Read-only docker queries still run."`
+	WaitLock     bool               `name:"wait-lock" help:"Wait for another launcher command on the same config to finish, instead of failing."`
 	BuildCmd     DockerBuildCmd     `cmd:"" name:"build" help:"Build a base image. This command does not need a running database. Saves resulting container."`
 	ConfigureCmd DockerConfigureCmd `cmd:"" name:"configure" help:"Configure and save an image with all dependencies and environment baked in. Updates themes and precompiles all assets. Saves resulting container."`
 	MigrateCmd   DockerMigrateCmd   `cmd:"" name:"migrate" help:"Run migration tasks for a site. Running container is temporary and is not saved."`
@@ -33,8 +48,131 @@ type Cli struct {
 	StopCmd    StopCmd    `cmd:"" name:"stop" help:"Stops container."`
 	RestartCmd RestartCmd `cmd:"" name:"restart" help:"Stops then starts container."`
 	RebuildCmd RebuildCmd `cmd:"" name:"rebuild" help:"Builds new image, then destroys old container, and starts new container."`
+	UpCmd      UpCmd      `cmd:"" name:"up" help:"Starts containers, starting the containers they depend on or link to first."`
+	DownCmd    DownCmd    `cmd:"" name:"down" help:"Stops containers, stopping containers that depend on others first."`
+	ApplyCmd   ApplyCmd   `cmd:"" name:"apply" help:"Compares config against the running container, then runs the minimal steps to apply it: nothing, restart with new settings, reconfigure, or full rebuild."`
+
+	ConfigCmd  ConfigCmd  `cmd:"" name:"config" help:"Inspect and edit configs."`
+	VolumesCmd VolumesCmd `cmd:"" name:"volumes" help:"List a config's volumes, and whether their host directories and named volumes exist. Creates missing ones with --create."`
+	BackupCmd  BackupCmd  `cmd:"" name:"backup" help:"Archive a config's host directory volumes, stopping its container meanwhile."`
+	RestoreCmd RestoreCmd `cmd:"" name:"restore" help:"Restore a config's host directory volumes from a backup archive."`
+	DiffCmd    DiffCmd    `cmd:"" name:"diff" help:"Compare a config against its running container, or against another config. Reports whether a rebuild is required."`
+	DoctorCmd  DoctorCmd  `cmd:"" name:"doctor" help:"Check host prerequisites: docker, disk space, memory, and, for a config, its ports and DNS."`
+	SetupCmd   SetupCmd   `cmd:"" name:"setup" help:"Interactively configure hostname, admin emails, SMTP, and Let's Encrypt, and write containers/app.yml."`
 
 	InstallCompletions kongplete.InstallCompletions `cmd:"" aliases:"sh" help:"Print shell autocompletions. Add output to dotfiles, or 'source <(./launcher sh)'."`
+
+	report       utils.Report
+	locks        map[string]*utils.Lock
+	buildDirLock *utils.Lock
+}
+
+// Times a stage of the command, for the report printed when the command finishes.
+func (cli *Cli) stage(name string, image string, run func() error) error {
+	return cli.report.Stage(name, image, run)
+}
+
+// Lock file in the build dir, held shared by commands locking a config, and exclusively by cleanup
+const buildDirLockName = "launcher.lock"
+
+// Locks a config for the duration of a command that changes its images or container, so two launchers
+// do not race on its build dir, container, and image. Commands run within another command, such as the
+// build in a rebuild, share the lock already held. Release the lock by calling the returned func, which
+// does nothing once the lock is released.
+// Locking a config also shares the build dir lock, so cleanup does not prune images and containers in use.
+func (cli *Cli) lock(ctx *context.Context, configName string, command string) (func(), error) {
+	if _, held := cli.locks[configName]; held || cli.DryRun {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(cli.BuildDir, 0755); err != nil {
+		return nil, err
+	}
+	if cli.buildDirLock == nil {
+		lock, err := utils.AcquireSharedLock(*ctx, cli.BuildDir+"/"+buildDirLockName, command+" "+configName, cli.WaitLock)
+		if err != nil {
+			return nil, err
+		}
+		cli.buildDirLock = lock
+	}
+	lock, err := utils.AcquireLock(*ctx, cli.BuildDir+"/"+configName+".lock", command+" "+configName, cli.WaitLock)
+	if err != nil {
+		cli.releaseBuildDirLock()
+		return nil, err
+	}
+	if cli.locks == nil {
+		cli.locks = map[string]*utils.Lock{}
+	}
+	cli.locks[configName] = lock
+	return func() {
+		if cli.locks[configName] != lock {
+			return
+		}
+		delete(cli.locks, configName)
+		lock.Release()
+		cli.releaseBuildDirLock()
+	}, nil
+}
+
+// Releases the shared build dir lock once no configs are locked.
+func (cli *Cli) releaseBuildDirLock() {
+	if cli.buildDirLock != nil && len(cli.locks) == 0 {
+		cli.buildDirLock.Release()
+		cli.buildDirLock = nil
+	}
+}
+
+// Locks the whole build dir for a command that affects every config, such as cleanup, once no other
+// launcher holds a config's lock. Release the lock by calling the returned func.
+func (cli *Cli) lockBuildDir(ctx *context.Context, command string) (func(), error) {
+	if cli.DryRun {
+		return func() {}, nil
+	}
+	if cli.buildDirLock != nil {
+		return nil, errors.New(command + " cannot run while this launcher holds a config's lock")
+	}
+	if err := os.MkdirAll(cli.BuildDir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := utils.AcquireLock(*ctx, cli.BuildDir+"/"+buildDirLockName, command, cli.WaitLock)
+	if err != nil {
+		return nil, err
+	}
+	return lock.Release, nil
+}
+
+// Opens --events-file. File descriptors inherited from a wrapping tool are opened as /dev/fd/<n>.
+// configLoadError reports a config that did not load. Errors of a known kind, such as failed
+// interpolation, are kept as they are, otherwise it is reported as a YAML syntax error.
+func configLoadError(err error) error {
+	if _, ok := utils.ErrorKindOf(err); ok {
+		return err
+	}
+	return utils.NewError(utils.ErrConfig, "YAML syntax error. Please check your containers/*.yml config files.", err)
+}
+
+func (cli *Cli) openEvents() (*os.File, error) {
+	if cli.EventsFile == "" {
+		return nil, errors.New("--events json needs an --events-file to write to, e.g. --events-file /dev/fd/3")
+	}
+	return os.OpenFile(cli.EventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// Reports the outcome of the command: emits the final events, prints the report of timed stages, if any,
+// and writes it to --report-file when set.
+func (cli *Cli) FinishReport(command string, started time.Time, err error) error {
+	cli.report.Finish(command, started, err)
+	if err != nil {
+		utils.EmitError(err)
+	}
+	utils.Emit(utils.Event{Type: utils.EventCommandFinished, Status: cli.report.Status, ExitCode: cli.report.ExitCode, Duration: cli.report.Duration})
+	if len(cli.report.Stages) > 0 {
+		fmt.Fprintln(utils.Out)
+		cli.report.Print(utils.Out)
+	}
+	if cli.ReportFile != "" {
+		return cli.report.WriteFile(cli.ReportFile)
+	}
+	return nil
 }
 
 func main() {
@@ -56,6 +194,46 @@ func main() {
 	ctx, err := parser.Parse(os.Args[1:])
 	parser.FatalIfErrorf(err)
 
+	utils.Level = utils.LogLevels[cli.LogLevel]
+	if cli.Quiet {
+		utils.Level = utils.LevelWarn
+	}
+	if cli.Verbose {
+		utils.Level = utils.LevelDebug
+	}
+	if cli.LogFile != "" {
+		logFile, err := os.OpenFile(cli.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			ctx.Fatalf("unable to open log file: %v", err)
+		}
+		defer logFile.Close()
+		fmt.Fprintf(logFile, "==> %s launcher %s\n", time.Now().UTC().Format(time.RFC3339), strings.Join(os.Args[1:], " "))
+		utils.LogFile = logFile
+		utils.Out = io.MultiWriter(utils.Out, logFile)
+		utils.Stdout = io.MultiWriter(utils.Stdout, logFile)
+		utils.Stderr = io.MultiWriter(utils.Stderr, logFile)
+	}
+
+	if cli.Events == "json" {
+		events, err := cli.openEvents()
+		if err != nil {
+			ctx.Fatalf("unable to open events output: %v", err)
+		}
+		defer events.Close()
+		utils.Events = events
+	}
+
+	utils.ShowSecrets = cli.ShowSecrets
+
+	if cli.DryRun {
+		utils.DryRun = true
+		utils.CmdRunner = utils.NewDryRunCmdRunner
+		utils.CommitWait = 0
+	}
+	if utils.Events != nil {
+		utils.CmdRunner = utils.WithEvents(utils.CmdRunner)
+	}
+
 	defer cancel()
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, unix.SIGTERM)
@@ -65,28 +243,39 @@ func main() {
 	go func() {
 		select {
 		case <-sigChan:
-			fmt.Fprintln(utils.Out, "Command interrupted")
+			utils.LogWarn("Command interrupted")
 			cancel()
 		case <-done:
 		}
 	}()
+	started := time.Now()
 	err = ctx.Run()
+	if err != nil && runCtx.Err() != nil {
+		err = utils.NewError(utils.ErrInterrupted, "Aborted with exit code "+strconv.Itoa(utils.ExitCode(err)), err)
+	} else {
+		err = docker.ClassifyError(err)
+	}
+	if reportErr := cli.FinishReport(strings.Join(os.Args[1:], " "), started, err); reportErr != nil {
+		utils.LogError("Unable to write report:", reportErr)
+	}
 	if err == nil {
 		return
 	}
-	if exiterr, ok := err.(*exec.ExitError); ok {
+
+	exitStatus := utils.ExitStatus(err)
+	kind, _ := utils.ErrorKindOf(err)
+	switch {
+	case exitStatus == utils.ExitRetry:
 		// Magic exit code that indicates a retry
-		if exiterr.ExitCode() == 77 {
-			os.Exit(77)
-		} else if runCtx.Err() != nil {
-			fmt.Fprintln(utils.Out, "Aborted with exit code", exiterr.ExitCode())
-		} else {
-			ctx.Fatalf(
-				"run failed with exit code %v\n"+
-					"** FAILED TO BOOTSTRAP ** please scroll up and look for earlier error messages, there may be more than one.\n"+
-					"./discourse-doctor may help diagnose the problem.", exiterr.ExitCode())
-		}
-	} else {
-		ctx.FatalIfErrorf(err)
+	case kind == utils.ErrInterrupted:
+		utils.LogWarn(err)
+	case kind == utils.ErrBuild || kind == utils.ErrMigrate || kind == utils.ErrPrecompile:
+		ctx.Errorf(
+			"%v\n"+
+				"** FAILED TO BOOTSTRAP ** please scroll up and look for earlier error messages, there may be more than one.\n"+
+				"./launcher doctor may help diagnose the problem.", err)
+	default:
+		ctx.Errorf("%v", err)
 	}
+	os.Exit(exitStatus)
 }
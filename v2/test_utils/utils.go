@@ -3,23 +3,42 @@ package test_utils
 import (
 	"github.com/discourse/launcher/v2/utils"
 	"os/exec"
+	"strings"
 )
 
 var RanCmds []exec.Cmd
 var CmdOutputResponse []byte
 var CmdOutputError error
 
+// Output responses for commands containing the given substring, e.g. "docker image inspect".
+// Commands that do not match fall back to CmdOutputResponse.
+var CmdOutputResponses map[string][]byte
+
+// Run errors for commands containing the given substring.
+// Commands that do not match fall back to CmdOutputError.
+var CmdRunErrors map[string]error
+
 type FakeCmdRunner struct {
 	Cmd *exec.Cmd
 }
 
 func (r FakeCmdRunner) Run() error {
 	RanCmds = append(RanCmds, *r.Cmd)
+	for match, err := range CmdRunErrors {
+		if strings.Contains(r.Cmd.String(), match) {
+			return err
+		}
+	}
 	return CmdOutputError
 }
 
 func (r FakeCmdRunner) Output() ([]byte, error) {
 	RanCmds = append(RanCmds, *r.Cmd)
+	for match, response := range CmdOutputResponses {
+		if strings.Contains(r.Cmd.String(), match) {
+			return response, CmdOutputError
+		}
+	}
 	return CmdOutputResponse, CmdOutputError
 }
 
@@ -29,6 +48,8 @@ func CreateNewFakeCmdRunner() func(cmd *exec.Cmd) utils.ICmdRunner {
 	RanCmds = []exec.Cmd{}
 	CmdOutputResponse = []byte{}
 	CmdOutputError = nil
+	CmdOutputResponses = map[string][]byte{}
+	CmdRunErrors = map[string]error{}
 	return func(cmd *exec.Cmd) utils.ICmdRunner {
 		cmdRunner := &FakeCmdRunner{Cmd: cmd}
 		return cmdRunner
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// TarDir writes a directory tree to a tar archive under prefix, keeping modes, owners, and symlinks.
+// Returns sha256 checksums of the files written, by their path in the archive.
+func TarDir(tw *tar.Writer, dir string, prefix string) (map[string]string, error) {
+	checksums := map[string]string{}
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		link := ""
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		case !info.Mode().IsRegular() && !info.IsDir():
+			LogWarn("Skipping " + file + ", only files, directories, and symlinks are archived")
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tw, hash), f); err != nil {
+			return err
+		}
+		checksums[name] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+	return checksums, err
+}
+
+// Untar extracts an archive entry below dest, keeping its mode, and its owner when run as root.
+// Entries that would extract outside dest, symlinks pointing outside of it, and entries
+// written through a symlink are an error, so an archive can not overwrite other host files.
+func Untar(header *tar.Header, r io.Reader, dest string) error {
+	dest = filepath.Clean(dest)
+	target := filepath.Join(dest, filepath.FromSlash(header.Name))
+	if !within(dest, target) {
+		return errors.New("archive entry " + header.Name + " is outside of " + dest)
+	}
+	if err := checkNoSymlinks(dest, target); err != nil {
+		return errors.New("archive entry " + header.Name + " " + err.Error())
+	}
+	mode := fs.FileMode(header.Mode).Perm()
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode); err != nil {
+			return err
+		}
+		// MkdirAll leaves existing directories as they are
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if filepath.IsAbs(header.Linkname) || !within(dest, filepath.Join(filepath.Dir(target), header.Linkname)) {
+			return errors.New("archive entry " + header.Name + " links to " + header.Linkname + ", outside of " + dest)
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|unix.O_NOFOLLOW, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if os.Geteuid() == 0 {
+		return os.Lchown(target, header.Uid, header.Gid)
+	}
+	return nil
+}
+
+func within(dir string, file string) bool {
+	return file == dir || strings.HasPrefix(file, dir+string(os.PathSeparator))
+}
+
+// checkNoSymlinks checks target and its parents below dest are not symlinks, which writes would follow.
+func checkNoSymlinks(dest string, target string) error {
+	for file := target; file != dest; file = filepath.Dir(file) {
+		info, err := os.Lstat(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return errors.New("is written through symlink " + file)
+		}
+	}
+	return nil
+}
+
+// FileChecksum is the sha256 checksum of a file.
+func FileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return Checksum(f)
+}
+
+// Checksum is the sha256 checksum of what is left to read.
+func Checksum(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
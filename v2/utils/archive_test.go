@@ -0,0 +1,100 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Archive", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = os.MkdirTemp("", "ddocker-test")
+		os.MkdirAll(dir+"/src/nested", 0750)
+		os.WriteFile(dir+"/src/nested/file", []byte("hello"), 0640)
+		os.Symlink("nested/file", dir+"/src/link")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("archives and extracts a directory tree", func() {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		checksums, err := utils.TarDir(tw, dir+"/src", "volumes/0")
+		Expect(err).To(BeNil())
+		Expect(tw.Close()).To(Succeed())
+		Expect(checksums).To(Equal(map[string]string{
+			"volumes/0/nested/file": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		}))
+
+		tr := tar.NewReader(buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).To(BeNil())
+			header.Name = strings.TrimPrefix(strings.TrimPrefix(header.Name, "volumes/0"), "/")
+			Expect(utils.Untar(header, tr, dir+"/dest")).To(Succeed())
+		}
+		content, _ := os.ReadFile(dir + "/dest/nested/file")
+		Expect(string(content)).To(Equal("hello"))
+		info, _ := os.Stat(dir + "/dest/nested/file")
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+		info, _ = os.Stat(dir + "/dest/nested")
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0750)))
+		link, _ := os.Readlink(dir + "/dest/link")
+		Expect(link).To(Equal("nested/file"))
+	})
+
+	It("refuses symlinks out of the destination, and writes through symlinks", func() {
+		os.MkdirAll(dir+"/host", 0755)
+		os.WriteFile(dir+"/host/passwd", []byte("root"), 0644)
+		os.MkdirAll(dir+"/dest/nested", 0755)
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: "data", Typeflag: tar.TypeSymlink, Linkname: dir + "/host", Mode: 0777})
+		tw.WriteHeader(&tar.Header{Name: "relative", Typeflag: tar.TypeSymlink, Linkname: "../host", Mode: 0777})
+		tw.WriteHeader(&tar.Header{Name: "inside", Typeflag: tar.TypeSymlink, Linkname: "nested", Mode: 0777})
+		tw.WriteHeader(&tar.Header{Name: "inside/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+		tw.Write([]byte("evil"))
+		tw.Close()
+
+		errs := []string{}
+		tr := tar.NewReader(buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err := utils.Untar(header, tr, dir+"/dest"); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		Expect(errs).To(HaveLen(3))
+		Expect(errs[0]).To(ContainSubstring("archive entry data links to " + dir + "/host, outside of"))
+		Expect(errs[1]).To(ContainSubstring("archive entry relative links to ../host, outside of"))
+		Expect(errs[2]).To(ContainSubstring("archive entry inside/passwd is written through symlink"))
+		content, _ := os.ReadFile(dir + "/host/passwd")
+		Expect(string(content)).To(Equal("root"))
+	})
+
+	It("refuses entries outside of the destination", func() {
+		header := &tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}
+		err := utils.Untar(header, strings.NewReader("hi"), dir+"/dest")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("outside of"))
+		_, err = os.Stat(dir + "/escape")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"os/exec"
 )
 
@@ -18,6 +19,7 @@ func (r *ExecCmdRunner) Run() error {
 }
 
 func (r *ExecCmdRunner) Output() ([]byte, error) {
+	LogDebug(r.Cmd)
 	return r.Cmd.Output()
 }
 
@@ -25,4 +27,36 @@ func NewExecCmdRunner(cmd *exec.Cmd) ICmdRunner {
 	return &ExecCmdRunner{Cmd: cmd}
 }
 
+// Prints commands instead of running them.
+// Output still runs the command, as it is only used to query docker state,
+// so dry runs follow the same code paths a real run would.
+type DryRunCmdRunner struct {
+	Cmd *exec.Cmd
+}
+
+func (r *DryRunCmdRunner) Run() error {
+	fmt.Fprintln(Out, RedactCmd(r.Cmd))
+	return nil
+}
+
+func (r *DryRunCmdRunner) Output() ([]byte, error) {
+	LogDebug(r.Cmd)
+	return r.Cmd.Output()
+}
+
+func NewDryRunCmdRunner(cmd *exec.Cmd) ICmdRunner {
+	return &DryRunCmdRunner{Cmd: cmd}
+}
+
 var CmdRunner = NewExecCmdRunner
+
+// Set when commands are printed rather than run
+var DryRun = false
+
+// Prints a command that is about to run.
+// Dry runs print every command they skip, so they are not printed twice.
+func EchoCmd(cmd *exec.Cmd) {
+	if !DryRun {
+		LogInfo(RedactCmd(cmd))
+	}
+}
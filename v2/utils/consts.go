@@ -44,6 +44,30 @@ func findDockerPath() string {
 
 var DockerPath = findDockerPath()
 
+func findCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "./tmp/cache"
+	}
+	return dir + "/discourse-launcher"
+}
+
+// Cache for remote templates
+var CacheDir = findCacheDir()
+
 var Out io.Writer = os.Stdout
 
+// Answers to prompts
+var Stdin io.Reader = os.Stdin
+
+// Stdout of docker builds and runs, also copied to the log file when set
+var Stdout io.Writer = os.Stdout
+
+// Stderr of docker builds and runs, also copied to the log file when set,
+// and tailed for transient errors when retrying
+var Stderr io.Writer = os.Stderr
+
 var CommitWait = 2 * time.Second
+
+// How often to check whether a started container is ready
+var ReadyPollInterval = time.Second
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Kinds of errors launcher exits with, each with its own exit code.
+type ErrorKind int
+
+const (
+	ErrConfig ErrorKind = iota
+	ErrDockerUnavailable
+	ErrBuild
+	ErrMigrate
+	ErrPrecompile
+	ErrNotFound
+	ErrPreflight
+	ErrLocked
+	ErrInterrupted
+)
+
+// Exit codes, documented in the README. Tools wrapping launcher depend on these, so they must not change.
+const (
+	ExitGeneral           = 1
+	ExitConfig            = 10
+	ExitDockerUnavailable = 11
+	ExitBuild             = 20
+	ExitMigrate           = 21
+	ExitPrecompile        = 22
+	ExitNotFound          = 30
+	ExitPreflight         = 40
+	ExitLocked            = 41
+	// pups exits with 77 to request a retry, which is passed through as is
+	ExitRetry       = 77
+	ExitInterrupted = 130
+)
+
+var errorKinds = map[ErrorKind]struct {
+	category string
+	exitCode int
+}{
+	ErrConfig:            {"config", ExitConfig},
+	ErrDockerUnavailable: {"docker_unavailable", ExitDockerUnavailable},
+	ErrBuild:             {"build", ExitBuild},
+	ErrMigrate:           {"migrate", ExitMigrate},
+	ErrPrecompile:        {"precompile", ExitPrecompile},
+	ErrNotFound:          {"not_found", ExitNotFound},
+	ErrPreflight:         {"preflight", ExitPreflight},
+	ErrLocked:            {"locked", ExitLocked},
+	ErrInterrupted:       {"interrupted", ExitInterrupted},
+}
+
+func (k ErrorKind) Category() string {
+	return errorKinds[k].category
+}
+
+func (k ErrorKind) ExitCode() int {
+	return errorKinds[k].exitCode
+}
+
+// Error is an error of a known kind, optionally wrapping its cause.
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+func NewError(kind ErrorKind, message string, err error) *Error {
+	return &Error{Kind: kind, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" && e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKindOf finds the kind of an error, if it has one.
+func ErrorKindOf(err error) (ErrorKind, bool) {
+	var launcherErr *Error
+	if errors.As(err, &launcherErr) {
+		return launcherErr.Kind, true
+	}
+	return 0, false
+}
+
+// ExitStatus is the code launcher exits with for an error.
+// Retry requests from pups are passed through, otherwise it is the exit code of the error's kind.
+func ExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if ExitCode(err) == ExitRetry {
+		return ExitRetry
+	}
+	if kind, ok := ErrorKindOf(err); ok {
+		return kind.ExitCode()
+	}
+	return ExitGeneral
+}
+
+// ErrorCategory classifies an error by its kind. Errors without a kind are categorized as
+// docker when a command failed, otherwise launcher.
+func ErrorCategory(err error) string {
+	if kind, ok := ErrorKindOf(err); ok {
+		return kind.Category()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "docker"
+	}
+	return "launcher"
+}
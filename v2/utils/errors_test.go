@@ -0,0 +1,54 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Errors", func() {
+	It("exits with the code of the error kind", func() {
+		Expect(utils.ExitStatus(nil)).To(Equal(0))
+		Expect(utils.ExitStatus(errors.New("failed"))).To(Equal(utils.ExitGeneral))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrConfig, "YAML syntax error", nil))).To(Equal(10))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrDockerUnavailable, "", nil))).To(Equal(11))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrBuild, "", nil))).To(Equal(20))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrMigrate, "", nil))).To(Equal(21))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrPrecompile, "", nil))).To(Equal(22))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrNotFound, "", nil))).To(Equal(30))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrPreflight, "", nil))).To(Equal(40))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrLocked, "", nil))).To(Equal(41))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrInterrupted, "", nil))).To(Equal(130))
+	})
+
+	It("passes through retry requests", func() {
+		retry := exec.Command("sh", "-c", "exit 77").Run()
+		Expect(utils.ExitStatus(retry)).To(Equal(utils.ExitRetry))
+		Expect(utils.ExitStatus(utils.NewError(utils.ErrMigrate, "migrate failed", retry))).To(Equal(utils.ExitRetry))
+	})
+
+	It("finds kinds of wrapped errors", func() {
+		cause := exec.Command("sh", "-c", "exit 3").Run()
+		err := fmt.Errorf("bootstrap: %w", utils.NewError(utils.ErrPrecompile, "configure failed", cause))
+
+		kind, ok := utils.ErrorKindOf(err)
+		Expect(ok).To(BeTrue())
+		Expect(kind).To(Equal(utils.ErrPrecompile))
+		Expect(utils.ErrorCategory(err)).To(Equal("precompile"))
+		Expect(utils.ExitCode(err)).To(Equal(3))
+		Expect(err.Error()).To(Equal("bootstrap: configure failed"))
+
+		_, ok = utils.ErrorKindOf(cause)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("uses the message of its cause without one", func() {
+		err := utils.NewError(utils.ErrNotFound, "", errors.New("no such container"))
+		Expect(err.Error()).To(Equal("no such container"))
+	})
+})
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventStageStarted    = "stage_started"
+	EventStageFinished   = "stage_finished"
+	EventStageRetry      = "stage_retry"
+	EventDockerCommand   = "docker_command"
+	EventContainer       = "container"
+	EventImageProduced   = "image_produced"
+	EventError           = "error"
+	EventCommandFinished = "command_finished"
+)
+
+// Event is a machine-readable progress update, for tools wrapping launcher.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Stage     string    `json:"stage,omitempty"`
+	Command   []string  `json:"command,omitempty"`
+	Container string    `json:"container,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	ExitCode  int       `json:"exit_code,omitempty"`
+	Duration  float64   `json:"duration_seconds,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Category  string    `json:"category,omitempty"`
+}
+
+// Events are written as newline delimited json when set
+var Events io.Writer
+
+var eventsMutex sync.Mutex
+
+func Emit(event Event) {
+	if Events == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	Events.Write(append(line, '\n'))
+}
+
+// EmitError reports a failed command, along with its category and the code launcher exits with.
+func EmitError(err error) {
+	Emit(Event{Type: EventError, Message: err.Error(), Category: ErrorCategory(err), ExitCode: ExitStatus(err)})
+}
+
+// Wraps a CmdRunner to emit an event for each command run.
+// Output is only used to query docker state, and is not reported.
+func WithEvents(runner func(cmd *exec.Cmd) ICmdRunner) func(cmd *exec.Cmd) ICmdRunner {
+	return func(cmd *exec.Cmd) ICmdRunner {
+		return &eventCmdRunner{cmd: cmd, runner: runner(cmd)}
+	}
+}
+
+type eventCmdRunner struct {
+	cmd    *exec.Cmd
+	runner ICmdRunner
+}
+
+func (r *eventCmdRunner) Run() error {
+	Emit(Event{Type: EventDockerCommand, Command: RedactArgs(r.cmd.Args)})
+	return r.runner.Run()
+}
+
+func (r *eventCmdRunner) Output() ([]byte, error) {
+	return r.runner.Output()
+}
@@ -0,0 +1,92 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strings"
+
+	. "github.com/discourse/launcher/v2/test_utils"
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Events", func() {
+	var events *bytes.Buffer
+
+	readEvents := func() []utils.Event {
+		parsed := []utils.Event{}
+		for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+			event := utils.Event{}
+			Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+			parsed = append(parsed, event)
+		}
+		return parsed
+	}
+
+	BeforeEach(func() {
+		events = &bytes.Buffer{}
+		utils.Events = events
+	})
+
+	AfterEach(func() {
+		utils.Events = nil
+	})
+
+	It("does nothing when events are not enabled", func() {
+		utils.Events = nil
+		utils.Emit(utils.Event{Type: utils.EventContainer})
+		Expect(events.String()).To(BeEmpty())
+	})
+
+	It("emits stage events from reports", func() {
+		report := &utils.Report{}
+		report.Stage("build", "local_discourse/app:latest", func() error { return nil })
+		report.Stage("configure", "local_discourse/app", func() error { return errors.New("failed") })
+
+		parsed := readEvents()
+		Expect(parsed).To(HaveLen(5))
+		Expect(parsed[0].Type).To(Equal(utils.EventStageStarted))
+		Expect(parsed[0].Stage).To(Equal("build"))
+		Expect(parsed[0].Time.IsZero()).To(BeFalse())
+		Expect(parsed[1].Type).To(Equal(utils.EventStageFinished))
+		Expect(parsed[1].Status).To(Equal("ok"))
+		Expect(parsed[2].Type).To(Equal(utils.EventImageProduced))
+		Expect(parsed[2].Image).To(Equal("local_discourse/app:latest"))
+		Expect(parsed[3].Stage).To(Equal("configure"))
+		Expect(parsed[4].Type).To(Equal(utils.EventStageFinished))
+		Expect(parsed[4].Status).To(Equal("failed"))
+		Expect(parsed[4].ExitCode).To(Equal(1))
+		Expect(parsed[4].Image).To(BeEmpty())
+	})
+
+	It("emits commands that are run, but not queries", func() {
+		runner := utils.WithEvents(CreateNewFakeCmdRunner())
+		runner(exec.Command("docker", "ps")).Output()
+		runner(exec.Command("docker", "stop", "app")).Run()
+
+		Expect(RanCmds).To(HaveLen(2))
+		parsed := readEvents()
+		Expect(parsed).To(HaveLen(1))
+		Expect(parsed[0].Type).To(Equal(utils.EventDockerCommand))
+		Expect(parsed[0].Command).To(Equal([]string{"docker", "stop", "app"}))
+	})
+
+	It("categorizes errors", func() {
+		utils.EmitError(exec.Command("sh", "-c", "exit 2").Run())
+		utils.EmitError(errors.New("unknown step"))
+		utils.EmitError(utils.NewError(utils.ErrConfig, "YAML syntax error", nil))
+
+		parsed := readEvents()
+		Expect(parsed[0].Type).To(Equal(utils.EventError))
+		Expect(parsed[0].Category).To(Equal("docker"))
+		Expect(parsed[0].ExitCode).To(Equal(utils.ExitGeneral))
+		Expect(parsed[1].Category).To(Equal("launcher"))
+		Expect(parsed[1].Message).To(Equal("unknown step"))
+		Expect(parsed[2].Category).To(Equal("config"))
+		Expect(parsed[2].ExitCode).To(Equal(utils.ExitConfig))
+	})
+})
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// How often to retry a held lock when waiting for it
+var LockPollInterval = time.Second
+
+// LockHolder records which launcher process holds a lock, for the error other processes report.
+type LockHolder struct {
+	Pid     int       `json:"pid"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+// Lock is an advisory lock on a file, held by one launcher process at a time.
+// The lock is released when the process exits, so it is never left stale.
+type Lock struct {
+	file   *os.File
+	shared bool
+}
+
+// AcquireLock takes an exclusive lock on a file, and records the command holding it.
+// When another process holds the lock it fails with ErrLocked, or with wait set,
+// waits for the lock to be released until ctx is done.
+func AcquireLock(ctx context.Context, filename string, command string, wait bool) (*Lock, error) {
+	return acquireLock(ctx, filename, command, wait, false)
+}
+
+// AcquireSharedLock takes a lock on a file that other processes may also hold shared,
+// but not exclusively. Shared holders are not recorded, as there may be several.
+func AcquireSharedLock(ctx context.Context, filename string, command string, wait bool) (*Lock, error) {
+	return acquireLock(ctx, filename, command, wait, true)
+}
+
+func acquireLock(ctx context.Context, filename string, command string, wait bool, shared bool) (*Lock, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := unix.LOCK_EX
+	if shared {
+		how = unix.LOCK_SH
+	}
+	waiting := false
+	for {
+		err := unix.Flock(int(file.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			file.Close()
+			return nil, err
+		}
+		message := readLockHolder(file).String()
+		if !wait {
+			file.Close()
+			return nil, NewError(ErrLocked, message+". Run with --wait-lock to wait for it to finish.", nil)
+		}
+		if !waiting {
+			LogInfo("Waiting for lock: " + message)
+			waiting = true
+		}
+		select {
+		case <-time.After(LockPollInterval):
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		}
+	}
+
+	if shared {
+		return &Lock{file: file, shared: true}, nil
+	}
+	holder, _ := json.Marshal(LockHolder{Pid: os.Getpid(), Command: command, Started: time.Now().UTC()})
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt(holder, 0)
+	}
+	return &Lock{file: file}, nil
+}
+
+func (l *Lock) Release() {
+	if !l.shared {
+		l.file.Truncate(0)
+	}
+	unix.Flock(int(l.file.Fd()), unix.LOCK_UN)
+	l.file.Close()
+}
+
+func readLockHolder(file *os.File) *LockHolder {
+	holder := &LockHolder{}
+	file.Seek(0, io.SeekStart)
+	content, _ := io.ReadAll(file)
+	if json.Unmarshal(content, holder) != nil {
+		return nil
+	}
+	return holder
+}
+
+func (h *LockHolder) String() string {
+	if h == nil || h.Pid == 0 {
+		return "another launcher command is already in progress"
+	}
+	return fmt.Sprintf("%s already in progress by PID %d since %s", h.Command, h.Pid, h.Started.Local().Format(time.RFC3339))
+}
@@ -0,0 +1,62 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Lock", func() {
+	var dir string
+	var ctx context.Context
+
+	BeforeEach(func() {
+		dir, _ = os.MkdirTemp("", "ddocker-test")
+		ctx = context.Background()
+		utils.LockPollInterval = 10 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		utils.LockPollInterval = time.Second
+		os.RemoveAll(dir)
+	})
+
+	It("fails while another holder has the lock, naming it", func() {
+		lock, err := utils.AcquireLock(ctx, dir+"/app.lock", "rebuild app", false)
+		Expect(err).To(BeNil())
+		_, err = utils.AcquireLock(ctx, dir+"/app.lock", "start app", false)
+		Expect(utils.ExitStatus(err)).To(Equal(utils.ExitLocked))
+		Expect(err.Error()).To(ContainSubstring("rebuild app already in progress by PID " + strconv.Itoa(os.Getpid()) + " since "))
+
+		lock.Release()
+		lock, err = utils.AcquireLock(ctx, dir+"/app.lock", "start app", false)
+		Expect(err).To(BeNil())
+		lock.Release()
+	})
+
+	It("waits for the lock to be released", func() {
+		lock, _ := utils.AcquireLock(ctx, dir+"/app.lock", "rebuild app", false)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			lock.Release()
+		}()
+		waited, err := utils.AcquireLock(ctx, dir+"/app.lock", "start app", true)
+		Expect(err).To(BeNil())
+		waited.Release()
+	})
+
+	It("stops waiting when cancelled", func() {
+		lock, _ := utils.AcquireLock(ctx, dir+"/app.lock", "rebuild app", false)
+		defer lock.Release()
+		cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := utils.AcquireLock(cancelled, dir+"/app.lock", "start app", true)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+})
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var LogLevels = map[string]LogLevel{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+// Messages below this level are not printed
+var Level = LevelInfo
+
+// Log file with a full transcript. Out, Stdout and Stderr are also copied to it when set,
+// so only messages below Level are written to it directly.
+var LogFile io.Writer
+
+// LogDebug messages help troubleshoot launcher itself, such as docker queries
+func LogDebug(a ...any) {
+	logln(LevelDebug, "", a...)
+}
+
+// LogInfo messages report progress
+func LogInfo(a ...any) {
+	logln(LevelInfo, "", a...)
+}
+
+func LogWarn(a ...any) {
+	logln(LevelWarn, "WARNING: ", a...)
+}
+
+func LogError(a ...any) {
+	logln(LevelError, "ERROR: ", a...)
+}
+
+func logln(level LogLevel, prefix string, a ...any) {
+	msg := prefix + fmt.Sprintln(a...)
+	if level >= Level {
+		fmt.Fprint(Out, msg)
+	} else if LogFile != nil {
+		fmt.Fprint(LogFile, msg)
+	}
+}
@@ -0,0 +1,58 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Log", func() {
+	var out *bytes.Buffer
+	var logFile *bytes.Buffer
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		logFile = &bytes.Buffer{}
+		utils.Out = out
+	})
+
+	AfterEach(func() {
+		utils.Level = utils.LevelInfo
+		utils.LogFile = nil
+	})
+
+	logAll := func() {
+		utils.LogDebug("docker ps")
+		utils.LogInfo("starting container")
+		utils.LogWarn("app was not found")
+		utils.LogError("config file does not exist")
+	}
+
+	It("prints info and above by default", func() {
+		logAll()
+		Expect(out.String()).To(Equal("starting container\nWARNING: app was not found\nERROR: config file does not exist\n"))
+	})
+
+	It("prints messages at the given level and above", func() {
+		utils.Level = utils.LevelWarn
+		logAll()
+		Expect(out.String()).To(Equal("WARNING: app was not found\nERROR: config file does not exist\n"))
+
+		out.Reset()
+		utils.Level = utils.LevelDebug
+		logAll()
+		Expect(out.String()).To(HavePrefix("docker ps\nstarting container\n"))
+	})
+
+	It("writes messages below the level to the log file", func() {
+		utils.Level = utils.LevelError
+		utils.LogFile = logFile
+		logAll()
+		Expect(out.String()).To(Equal("ERROR: config file does not exist\n"))
+		// printed messages reach the log file through Out
+		Expect(logFile.String()).To(Equal("docker ps\nstarting container\nWARNING: app was not found\n"))
+	})
+})
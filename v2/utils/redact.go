@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+const RedactedValue = "[REDACTED]"
+
+// Print secret values instead of masking them
+var ShowSecrets = false
+
+// Env keys declared secret by configs, in addition to KnownSecrets
+var SecretKeys []string
+
+func AddSecretKeys(keys ...string) {
+	for _, k := range keys {
+		if !slices.Contains(SecretKeys, k) {
+			SecretKeys = append(SecretKeys, k)
+		}
+	}
+}
+
+func IsSecret(key string) bool {
+	return slices.Contains(KnownSecrets, key) || slices.Contains(SecretKeys, key)
+}
+
+// RedactValue masks the value of a secret env key.
+func RedactValue(key string, value string) string {
+	if ShowSecrets || value == "" || !IsSecret(key) {
+		return value
+	}
+	return RedactedValue
+}
+
+// RedactArgs masks secret values of KEY=value arguments, such as --env KEY=value or --env=KEY=value.
+func RedactArgs(args []string) []string {
+	if ShowSecrets {
+		return args
+	}
+	redacted := make([]string, 0, len(args))
+	for _, arg := range args {
+		prefix, rest := "", arg
+		if strings.HasPrefix(arg, "-") {
+			flag, value, found := strings.Cut(arg, "=")
+			if found {
+				prefix, rest = flag+"=", value
+			}
+		}
+		if key, value, found := strings.Cut(rest, "="); found && RedactValue(key, value) != value {
+			arg = prefix + key + "=" + RedactedValue
+		}
+		redacted = append(redacted, arg)
+	}
+	return redacted
+}
+
+// RedactCmd formats a command for printing, with secret values masked.
+func RedactCmd(cmd *exec.Cmd) string {
+	redacted := *cmd
+	redacted.Args = RedactArgs(cmd.Args)
+	return redacted.String()
+}
@@ -0,0 +1,39 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"os/exec"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Redact", func() {
+	AfterEach(func() {
+		utils.ShowSecrets = false
+		utils.SecretKeys = nil
+	})
+
+	It("masks values of known and declared secrets", func() {
+		utils.AddSecretKeys("MY_API_KEY")
+		Expect(utils.RedactValue("DISCOURSE_DB_PASSWORD", "hunter2")).To(Equal(utils.RedactedValue))
+		Expect(utils.RedactValue("MY_API_KEY", "abc")).To(Equal(utils.RedactedValue))
+		Expect(utils.RedactValue("LANG", "en_US.UTF-8")).To(Equal("en_US.UTF-8"))
+		Expect(utils.RedactValue("DISCOURSE_DB_PASSWORD", "")).To(Equal(""))
+	})
+
+	It("masks KEY=value arguments", func() {
+		cmd := exec.Command("docker", "run", "--env", "DISCOURSE_DB_PASSWORD=hunter2", "--env=DISCOURSE_SMTP_PASSWORD=secret",
+			"--env", "LANG=en_US.UTF-8", "--env", "DISCOURSE_DB_HOST", "--label", "app=web", "image")
+		Expect(utils.RedactCmd(cmd)).To(HaveSuffix("run --env DISCOURSE_DB_PASSWORD=[REDACTED] --env=DISCOURSE_SMTP_PASSWORD=[REDACTED] " +
+			"--env LANG=en_US.UTF-8 --env DISCOURSE_DB_HOST --label app=web image"))
+		Expect(cmd.Args).To(ContainElement("DISCOURSE_DB_PASSWORD=hunter2"))
+	})
+
+	It("shows secrets when asked to", func() {
+		utils.ShowSecrets = true
+		Expect(utils.RedactValue("DISCOURSE_DB_PASSWORD", "hunter2")).To(Equal("hunter2"))
+		Expect(utils.RedactArgs([]string{"DISCOURSE_DB_PASSWORD=hunter2"})).To(Equal([]string{"DISCOURSE_DB_PASSWORD=hunter2"}))
+	})
+})
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+	"time"
+)
+
+// Result of a timed stage, such as build, migrate, or configure.
+type StageResult struct {
+	Stage    string    `json:"stage"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+	// Image the stage produced, if any
+	Image    string `json:"image,omitempty"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// Report times the stages of a command, to summarize long builds.
+type Report struct {
+	Command  string        `json:"command"`
+	Started  time.Time     `json:"started"`
+	Duration float64       `json:"duration_seconds"`
+	Status   string        `json:"status"`
+	ExitCode int           `json:"exit_code"`
+	Stages   []StageResult `json:"stages"`
+}
+
+// Stage runs and times a stage, recording the image it produces on success.
+func (r *Report) Stage(stage string, image string, run func() error) error {
+	Emit(Event{Type: EventStageStarted, Stage: stage})
+	started := time.Now()
+	err := run()
+	result := StageResult{
+		Stage:    stage,
+		Started:  started.UTC(),
+		Duration: time.Since(started).Seconds(),
+		Status:   status(err),
+		ExitCode: ExitCode(err),
+	}
+	if err == nil {
+		result.Image = image
+	}
+	r.Stages = append(r.Stages, result)
+	Emit(Event{
+		Type:     EventStageFinished,
+		Stage:    stage,
+		Status:   result.Status,
+		ExitCode: result.ExitCode,
+		Duration: result.Duration,
+		Image:    result.Image,
+	})
+	if result.Image != "" {
+		Emit(Event{Type: EventImageProduced, Stage: stage, Image: result.Image})
+	}
+	return err
+}
+
+// Finish records the outcome of the command, started at the given time.
+func (r *Report) Finish(command string, started time.Time, err error) {
+	r.Command = command
+	r.Started = started.UTC()
+	r.Duration = time.Since(started).Seconds()
+	r.Status = status(err)
+	r.ExitCode = ExitStatus(err)
+}
+
+// Print writes a table of stages, followed by the total.
+func (r *Report) Print(w io.Writer) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "STAGE\tDURATION\tSTATUS\tIMAGE")
+	for _, s := range r.Stages {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", s.Stage, formatSeconds(s.Duration), statusText(s.Status, s.ExitCode), s.Image)
+	}
+	fmt.Fprintf(table, "%s\t%s\t%s\t\n", "total", formatSeconds(r.Duration), statusText(r.Status, r.ExitCode))
+	table.Flush()
+}
+
+// WriteFile writes the report as JSON.
+func (r *Report) WriteFile(file string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(content, '\n'), 0644)
+}
+
+// ExitCode of a command's error: 0 on success, the exit code of failed commands, or 1.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+func status(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return "failed"
+}
+
+func statusText(status string, exitCode int) string {
+	if exitCode != 0 {
+		return fmt.Sprintf("%s (exit code %d)", status, exitCode)
+	}
+	return status
+}
+
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds * float64(time.Second))).Round(time.Second / 10).String()
+}
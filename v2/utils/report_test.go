@@ -0,0 +1,77 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("Report", func() {
+	var report *utils.Report
+
+	BeforeEach(func() {
+		report = &utils.Report{}
+	})
+
+	It("records stages with the image they produce", func() {
+		started := time.Now()
+		err := report.Stage("build", "local_discourse/app:latest", func() error { return nil })
+		Expect(err).To(BeNil())
+		err = report.Stage("configure", "local_discourse/app", func() error { return errors.New("failed") })
+		Expect(err).ToNot(BeNil())
+		report.Finish("bootstrap app", started, err)
+
+		Expect(report.Stages).To(HaveLen(2))
+		Expect(report.Stages[0].Stage).To(Equal("build"))
+		Expect(report.Stages[0].Status).To(Equal("ok"))
+		Expect(report.Stages[0].Image).To(Equal("local_discourse/app:latest"))
+		Expect(report.Stages[0].Duration).To(BeNumerically(">=", 0))
+		Expect(report.Stages[1].Status).To(Equal("failed"))
+		Expect(report.Stages[1].ExitCode).To(Equal(1))
+		// failed stages produce no image
+		Expect(report.Stages[1].Image).To(BeEmpty())
+		Expect(report.Status).To(Equal("failed"))
+
+		out := &bytes.Buffer{}
+		report.Print(out)
+		Expect(out.String()).To(MatchRegexp(`STAGE\s+DURATION\s+STATUS\s+IMAGE\n`))
+		Expect(out.String()).To(MatchRegexp(`build\s+\S+s\s+ok\s+local_discourse/app:latest\n`))
+		Expect(out.String()).To(MatchRegexp(`configure\s+\S+s\s+failed \(exit code 1\)\s*\n`))
+		Expect(out.String()).To(MatchRegexp(`total\s+\S+s\s+failed \(exit code 1\)`))
+	})
+
+	It("records exit codes of failed commands", func() {
+		err := report.Stage("migrate", "", func() error { return exec.Command("sh", "-c", "exit 3").Run() })
+		Expect(err).ToNot(BeNil())
+		Expect(report.Stages[0].ExitCode).To(Equal(3))
+	})
+
+	It("writes json", func() {
+		file, _ := os.CreateTemp("", "report")
+		file.Close()
+		defer os.Remove(file.Name())
+
+		report.Stage("build", "local_discourse/app:latest", func() error { return nil })
+		report.Finish("build app", time.Now(), nil)
+		Expect(report.WriteFile(file.Name())).To(Succeed())
+
+		content, _ := os.ReadFile(file.Name())
+		written := map[string]any{}
+		Expect(json.Unmarshal(content, &written)).To(Succeed())
+		Expect(written["command"]).To(Equal("build app"))
+		Expect(written["status"]).To(Equal("ok"))
+		stages := written["stages"].([]any)
+		Expect(stages).To(HaveLen(1))
+		Expect(stages[0]).To(HaveKeyWithValue("stage", "build"))
+		Expect(stages[0]).To(HaveKeyWithValue("image", "local_discourse/app:latest"))
+		Expect(stages[0]).To(HaveKey("duration_seconds"))
+	})
+})
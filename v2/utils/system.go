@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Resolves hostnames for DNS checks
+var LookupHost = net.LookupHost
+
+// Renames files and directories, so tests can fail it as renaming a mountpoint does
+var Rename = os.Rename
+
+// MemTotal is the total memory of the host in bytes, read from /proc/meminfo.
+func MemTotal() (uint64, error) {
+	return memInfo("MemTotal")
+}
+
+// SwapTotal is the total swap of the host in bytes, read from /proc/meminfo.
+func SwapTotal() (uint64, error) {
+	return memInfo("SwapTotal")
+}
+
+func memInfo(field string) (uint64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == field+":" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	return 0, errors.New(field + " not found in /proc/meminfo")
+}
+
+// DiskFree is the space available in bytes on the filesystem of a path.
+// Paths that do not exist yet are checked on the filesystem of their nearest existing parent.
+func DiskFree(path string) (uint64, error) {
+	stat := unix.Statfs_t{}
+	if err := unix.Statfs(nearestExisting(path), &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// Writable checks a path can be written to. Paths that do not exist yet must be
+// creatable, as docker creates missing volume host paths.
+func Writable(path string) error {
+	existing := nearestExisting(path)
+	if err := unix.Access(existing, unix.W_OK); err != nil {
+		return errors.New(existing + " is not writable: " + err.Error())
+	}
+	return nil
+}
+
+func nearestExisting(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// PortInUse checks whether another process listens on a TCP port on the host.
+func PortInUse(port string) bool {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return errors.Is(err, syscall.EADDRINUSE)
+	}
+	listener.Close()
+	return false
+}
+
+// MoveDir moves a directory to dest. Directories that can not be renamed, such as
+// mountpoints, or that are on another filesystem than dest have their contents
+// copied to dest instead, and are left in place empty. dest may be an empty directory.
+func MoveDir(src string, dest string) error {
+	err := Rename(src, dest)
+	if !errors.Is(err, syscall.EBUSY) && !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyDir(src, dest); err != nil {
+		return err
+	}
+	return RemoveContents(src)
+}
+
+// RemoveContents removes everything in a directory, but not the directory itself.
+func RemoveContents(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDir copies a directory tree, keeping modes, and owners when run as root.
+func copyDir(src string, dest string) error {
+	return filepath.WalkDir(src, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, file)
+		target := filepath.Join(dest, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case entry.Type().IsRegular():
+			if err := copyFile(file, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+			return os.Lchown(target, int(stat.Uid), int(stat.Gid))
+		}
+		return nil
+	})
+}
+
+func copyFile(src string, dest string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|unix.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,96 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("System", func() {
+	It("reads total memory", func() {
+		if runtime.GOOS != "linux" {
+			Skip("reads /proc/meminfo")
+		}
+		mem, err := utils.MemTotal()
+		Expect(err).To(BeNil())
+		Expect(mem).To(BeNumerically(">", 0))
+	})
+
+	It("reads free disk space of paths that do not exist yet", func() {
+		free, err := utils.DiskFree(os.TempDir() + "/does/not/exist")
+		Expect(err).To(BeNil())
+		Expect(free).To(BeNumerically(">", 0))
+	})
+
+	It("checks paths are writable", func() {
+		dir, _ := os.MkdirTemp("", "ddocker-test")
+		defer os.RemoveAll(dir)
+		Expect(utils.Writable(dir + "/not/created/yet")).To(Succeed())
+		if os.Geteuid() == 0 {
+			Skip("root can write to read-only directories")
+		}
+		os.Chmod(dir, 0500)
+		defer os.Chmod(dir, 0700)
+		Expect(utils.Writable(dir + "/not/created/yet")).ToNot(Succeed())
+	})
+
+	It("checks whether ports are in use", func() {
+		listener, err := net.Listen("tcp", ":0")
+		Expect(err).To(BeNil())
+		port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		Expect(utils.PortInUse(port)).To(BeTrue())
+		listener.Close()
+		Expect(utils.PortInUse(port)).To(BeFalse())
+	})
+
+	Context("moving directories", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir, _ = os.MkdirTemp("", "ddocker-test")
+			os.MkdirAll(dir+"/mount/data", 0700)
+			os.WriteFile(dir+"/mount/data/PG_VERSION", []byte("15\n"), 0600)
+			os.Symlink("data/PG_VERSION", dir+"/mount/version")
+		})
+
+		AfterEach(func() {
+			utils.Rename = os.Rename
+			os.RemoveAll(dir)
+		})
+
+		It("renames directories", func() {
+			Expect(utils.MoveDir(dir+"/mount", dir+"/moved")).To(Succeed())
+			Expect(dir + "/mount").ToNot(BeADirectory())
+			Expect(dir + "/moved/data/PG_VERSION").To(BeARegularFile())
+		})
+
+		It("copies directories that can not be renamed, leaving them empty", func() {
+			utils.Rename = func(string, string) error {
+				return &os.LinkError{Op: "rename", Err: syscall.EBUSY}
+			}
+			Expect(utils.MoveDir(dir+"/mount", dir+"/moved")).To(Succeed())
+			entries, err := os.ReadDir(dir + "/mount")
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+			content, _ := os.ReadFile(dir + "/moved/version")
+			Expect(string(content)).To(Equal("15\n"))
+			info, _ := os.Stat(dir + "/moved/data")
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+		})
+
+		It("returns other rename errors", func() {
+			utils.Rename = func(string, string) error {
+				return &os.LinkError{Op: "rename", Err: syscall.EACCES}
+			}
+			Expect(utils.MoveDir(dir+"/mount", dir+"/moved")).ToNot(Succeed())
+			Expect(dir + "/mount/data/PG_VERSION").To(BeARegularFile())
+		})
+	})
+})
@@ -0,0 +1,26 @@
+package utils
+
+import "sync"
+
+// TailWriter keeps the last Size bytes written to it.
+type TailWriter struct {
+	Size  int
+	buf   []byte
+	mutex sync.Mutex
+}
+
+func (w *TailWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > w.Size {
+		w.buf = w.buf[len(w.buf)-w.Size:]
+	}
+	return len(p), nil
+}
+
+func (w *TailWriter) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return string(w.buf)
+}
@@ -0,0 +1,20 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"fmt"
+
+	"github.com/discourse/launcher/v2/utils"
+)
+
+var _ = Describe("TailWriter", func() {
+	It("keeps the last bytes written", func() {
+		tail := &utils.TailWriter{Size: 10}
+		fmt.Fprint(tail, "hello")
+		Expect(tail.String()).To(Equal("hello"))
+		fmt.Fprint(tail, " world, again")
+		Expect(tail.String()).To(Equal("rld, again"))
+	})
+})